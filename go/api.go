@@ -10,6 +10,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -38,6 +39,9 @@ func makeHandler(handler APIFunc) http.HandlerFunc {
 		if err != nil {
 			if e, ok := err.(APIError); ok {
 				fmt.Println("API error:", e.Msg)
+				for k, v := range e.Headers {
+					w.Header().Set(k, v)
+				}
 				writeJSON(w, e.StatusCode, e)
 			} else {
 				fmt.Println("error:", err)
@@ -51,6 +55,11 @@ var jwtSecret = []byte("TODO: stop using me")
 
 type CustomClaims struct {
 	UserId int `json:"user_id"`
+	// tokens issued before the last password or email change are rejected
+	TokenVersion int `json:"token_version"`
+	// set on the short lived tokens of the second login step, which only
+	// work on the MFA endpoints
+	Purpose string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -58,7 +67,7 @@ func corsMiddleware(handler APIFunc) APIFunc {
     return func(w http.ResponseWriter, r *http.Request) error {
         w.Header().Set("Access-Control-Allow-Origin", "*")
         w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Kiosk-Token")
         if r.Method == "OPTIONS" {
             w.WriteHeader(http.StatusOK)
             return nil
@@ -74,39 +83,35 @@ func (s *Server) jwtMiddleware(handler APIFunc) APIFunc {
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) error {
-		var tokenString string
 		authHeader := r.Header.Get("Authorization")
 		if authHeader != "" && !strings.HasPrefix(authHeader, "Bearer ") {
 			return writeJSON(w, http.StatusUnauthorized, "Missing or invalid Authorization header")
 		}
-		tokenString = strings.TrimPrefix(authHeader, "Bearer ")
 
-		token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (any, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method")
-			}
-			return jwtSecret, nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := parseJWT(strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil || claims.Purpose != "" {
 			return InvalidToken()
 		}
 
-		claims, ok := token.Claims.(*CustomClaims)
-		if !ok {
+		// contains database query for user permissions
+		session, err := s.getEmployeeSession(claims.UserId)
+		if err != nil {
 			return InvalidToken()
 		}
 
-		// contains database query for user permissions
-		accessAllowed, err := s.getEmployeeAccess(claims.UserId)
-		if err != nil {
+		if claims.TokenVersion != session.TokenVersion {
 			return InvalidToken()
 		}
 
-		if !accessAllowed {
+		if !session.AccessAllowed || session.Status != EmployeeActive {
 			return AccessNotAllowed()
 		}
 
+		// tokens from before the role started requiring MFA
+		if session.RequireMFA && !session.MFAEnabled {
+			return NewAPIError(http.StatusUnauthorized, "multi-factor authentication enrollment required, log in again")
+		}
+
 		ctx := context.WithValue(r.Context(), userIdClaim, claims.UserId)
 		r = r.WithContext(ctx)
 
@@ -114,9 +119,25 @@ func (s *Server) jwtMiddleware(handler APIFunc) APIFunc {
 	}
 }
 
-func createJWT(userId int) (string, error) {
+// optionalJWTMiddleware authenticates employees on endpoints kiosks and
+// patients may also call, requests without an Authorization header go through
+// anonymously
+func (s *Server) optionalJWTMiddleware(handler APIFunc) APIFunc {
+	authenticated := s.jwtMiddleware(handler)
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if r.Header.Get("Authorization") == "" {
+			return handler(w, r)
+		}
+
+		return authenticated(w, r)
+	}
+}
+
+func createJWT(userId int, tokenVersion int) (string, error) {
 	claims := CustomClaims{
 		UserId: userId,
+		TokenVersion: tokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -127,6 +148,26 @@ func createJWT(userId int) (string, error) {
 	return token.SignedString(jwtSecret)
 }
 
+func parseJWT(tokenString string) (*CustomClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (any, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return jwtSecret, nil
+	})
+
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	claims, ok := token.Claims.(*CustomClaims)
+	if !ok {
+		return nil, fmt.Errorf("invalid token claims")
+	}
+
+	return claims, nil
+}
+
 func getIdFromToken(r *http.Request) (int, error) {
 	id, ok := r.Context().Value(userIdClaim).(int)
 	if !ok {
@@ -158,8 +199,23 @@ func getPathId(wildcard string, r *http.Request) (int, error) {
 }
 
 type Server struct {
-	port string
-	db   *pgxpool.Pool
+	port      string
+	db        *pgxpool.Pool
+	retention RetentionPolicy
+	// versions never change once written, keyed by [questionnaire id, version]
+	questionnaireVersions sync.Map
+	speech                SpeechProvider
+	audio                 *audioGateway
+	mailer                Mailer
+	passwordReset         PasswordResetConfig
+	authLimiter           *rateLimiter
+	reportLimiter         *rateLimiter
+	logins                *loginGuard
+	registration          RegistrationConfig
+	surveillance          SurveillanceConfig
+	redFlags              RedFlagConfig
+	// nil when single sign-on is not configured
+	oidc *oidcProvider
 }
 
 func NewServer(port string) *Server {
@@ -168,27 +224,115 @@ func NewServer(port string) *Server {
 	}
 
 	s.initDB()
+	initCPFValidation()
+	initFieldEncryption()
+	go s.runKeyRotation()
+	s.initRetention()
+	s.initSpeechProvider()
+	s.initAudioGateway()
+	s.initMailer()
+	s.initPasswordReset()
+	s.initRateLimits()
+	s.initRegistration()
+	s.initOIDC()
+	s.initSurveillance()
+	s.initRedFlags()
 
 	http.HandleFunc("GET /reports", makeHandler(s.jwtMiddleware(s.handleGetReports)))
+	http.HandleFunc("GET /reports/export", makeHandler(s.jwtMiddleware(s.handleExportReports)))
+	http.HandleFunc("POST /import/patients", makeHandler(s.jwtMiddleware(s.handleImportPatients)))
+	http.HandleFunc("POST /import/reports", makeHandler(s.jwtMiddleware(s.handleImportReports)))
 	http.HandleFunc("GET /reports/{id}", makeHandler(s.jwtMiddleware(s.handleGetReportById)))
 	http.HandleFunc("GET /reports/{id}/pdf", makeHandler(s.jwtMiddleware(s.handleGetReportPDF)))
 	http.HandleFunc("PATCH /reports/{id}", makeHandler(s.jwtMiddleware(s.handleChangeReportUrgency)))
 	http.HandleFunc("POST /reports/{id}/consultation", makeHandler(s.jwtMiddleware(s.handleCreateConsultation)))
-	http.HandleFunc("POST /reports", makeHandler(s.handleCreateReport))
+	http.HandleFunc("POST /reports/{id}/call", makeHandler(s.jwtMiddleware(s.handleCallReport)))
+	http.HandleFunc("GET /reports/{id}/recordings", makeHandler(s.jwtMiddleware(s.handleGetReportRecordings)))
+	http.HandleFunc("POST /reports", makeHandler(s.limitReports(s.optionalJWTMiddleware(s.handleCreateReport))))
 
 	http.HandleFunc("GET /patients", makeHandler(s.jwtMiddleware(s.handleGetPatients)))
 	http.HandleFunc("GET /patients/{id}", makeHandler(s.jwtMiddleware(s.handleGetPatientById)))
 	http.HandleFunc("GET /patients/{id}/reports", makeHandler(s.jwtMiddleware(s.handleGetPatientReports)))
+	http.HandleFunc("GET /patients/{id}/data-export", makeHandler(s.jwtMiddleware(s.handleExportPatientData)))
+	http.HandleFunc("POST /patients/{id}/anonymize", makeHandler(s.jwtMiddleware(s.handleAnonymizePatient)))
 
 	http.HandleFunc("GET /employees", makeHandler(s.jwtMiddleware(s.handleGetEmployees)))
 	http.HandleFunc("GET /employees/{id}", makeHandler(s.jwtMiddleware(s.handleGetEmployeeById)))
 	http.HandleFunc("PATCH /employees/{id}", makeHandler(s.jwtMiddleware(s.handlePatchEmployeePermissions)))
+	http.HandleFunc("GET /employees/pending", makeHandler(s.jwtMiddleware(s.handleGetPendingEmployees)))
+	http.HandleFunc("POST /employees/{id}/approve", makeHandler(s.jwtMiddleware(s.handleApproveEmployee)))
+	http.HandleFunc("POST /employees/{id}/reject", makeHandler(s.jwtMiddleware(s.handleRejectEmployee)))
+	http.HandleFunc("POST /employees/{id}/deactivate", makeHandler(s.jwtMiddleware(s.handleDeactivateEmployee)))
+	http.HandleFunc("POST /employees/{id}/reactivate", makeHandler(s.jwtMiddleware(s.handleReactivateEmployee)))
+	http.HandleFunc("PUT /employees/{id}/facilities", makeHandler(s.jwtMiddleware(s.handleSetEmployeeFacilities)))
+	http.HandleFunc("POST /employees/{id}/registration/verify", makeHandler(s.jwtMiddleware(s.handleVerifyRegistration)))
+
+	http.HandleFunc("GET /facilities", makeHandler(s.jwtMiddleware(s.handleGetFacilities)))
+	http.HandleFunc("POST /facilities", makeHandler(s.jwtMiddleware(s.handleCreateFacility)))
+	http.HandleFunc("PUT /facilities/{id}", makeHandler(s.jwtMiddleware(s.handleUpdateFacility)))
+
+	http.HandleFunc("GET /invitations", makeHandler(s.jwtMiddleware(s.handleGetInvitations)))
+	http.HandleFunc("POST /invitations", makeHandler(s.jwtMiddleware(s.handleCreateInvitation)))
+	http.HandleFunc("DELETE /invitations/{id}", makeHandler(s.jwtMiddleware(s.handleRevokeInvitation)))
+
+	http.HandleFunc("GET /me", makeHandler(s.jwtMiddleware(s.handleGetMe)))
+	http.HandleFunc("PATCH /me", makeHandler(s.jwtMiddleware(s.handlePatchMe)))
+	http.HandleFunc("POST /me/password", makeHandler(s.jwtMiddleware(s.handleChangePassword)))
+	http.HandleFunc("POST /me/mfa", makeHandler(s.mfaEnrollmentMiddleware(s.handleStartMFAEnrollment)))
+	http.HandleFunc("POST /me/mfa/confirm", makeHandler(s.mfaEnrollmentMiddleware(s.handleConfirmMFAEnrollment)))
+	http.HandleFunc("POST /me/mfa/recovery-codes", makeHandler(s.jwtMiddleware(s.handleRegenerateRecoveryCodes)))
+	http.HandleFunc("DELETE /me/mfa", makeHandler(s.jwtMiddleware(s.handleDisableMFA)))
 
 	http.HandleFunc("GET /roles", makeHandler(s.jwtMiddleware(s.handleGetRoles)))
 	http.HandleFunc("GET /roles/{id}", makeHandler(s.jwtMiddleware(s.handleGetRoleById)))
 
-	http.HandleFunc("POST /login", makeHandler(s.handleLogin))
-	http.HandleFunc("POST /register", makeHandler(s.handleRegister))
+	http.HandleFunc("GET /questionnaires", makeHandler(s.jwtMiddleware(s.handleGetQuestionnaires)))
+	http.HandleFunc("GET /questionnaires/{id}", makeHandler(s.jwtMiddleware(s.handleGetQuestionnaireById)))
+	http.HandleFunc("GET /questionnaires/{id}/versions", makeHandler(s.jwtMiddleware(s.handleGetQuestionnaireVersions)))
+	http.HandleFunc("GET /questionnaires/{id}/versions/{version}", makeHandler(s.jwtMiddleware(s.handleGetQuestionnaireVersion)))
+	http.HandleFunc("POST /questionnaires", makeHandler(s.jwtMiddleware(s.handleCreateQuestionnaire)))
+	http.HandleFunc("PUT /questionnaires/{id}", makeHandler(s.jwtMiddleware(s.handleUpdateQuestionnaire)))
+
+	http.HandleFunc("GET /red-flag-rules", makeHandler(s.jwtMiddleware(s.handleGetRedFlagRules)))
+	http.HandleFunc("POST /red-flag-rules", makeHandler(s.jwtMiddleware(s.handleCreateRedFlagRule)))
+	http.HandleFunc("PUT /red-flag-rules/{id}", makeHandler(s.jwtMiddleware(s.handleUpdateRedFlagRule)))
+	http.HandleFunc("GET /red-flag-alerts", makeHandler(s.jwtMiddleware(s.handleGetRedFlagAlerts)))
+	http.HandleFunc("POST /red-flag-alerts/{id}/acknowledge", makeHandler(s.jwtMiddleware(s.handleAcknowledgeRedFlagAlert)))
+
+	http.HandleFunc("POST /interviews", makeHandler(s.limitReports(s.optionalJWTMiddleware(s.handleStartInterview))))
+	http.HandleFunc("GET /interviews/{sessionId}", makeHandler(s.handleGetInterview))
+	http.HandleFunc("POST /interviews/{sessionId}/answers", makeHandler(s.handleAnswerInterview))
+	http.HandleFunc("POST /interviews/{sessionId}/recordings", makeHandler(s.kioskMiddleware(s.handleUploadRecording)))
+
+	http.HandleFunc("GET /recordings/{id}/audio", makeHandler(s.jwtMiddleware(s.handleGetRecordingAudio)))
+
+	http.HandleFunc("GET /ws/stt", makeHandler(s.kioskMiddleware(s.handleAudioStream(AUDIO_STT))))
+	http.HandleFunc("GET /ws/tts", makeHandler(s.kioskMiddleware(s.handleAudioStream(AUDIO_TTS))))
+
+	http.HandleFunc("GET /kiosks", makeHandler(s.jwtMiddleware(s.handleGetKiosks)))
+	http.HandleFunc("POST /kiosks", makeHandler(s.jwtMiddleware(s.handleCreateKiosk)))
+	http.HandleFunc("DELETE /kiosks/{id}", makeHandler(s.jwtMiddleware(s.handleRevokeKiosk)))
+
+	http.HandleFunc("GET /display", makeHandler(s.handleGetDisplay))
+
+	http.HandleFunc("GET /stats", makeHandler(s.jwtMiddleware(s.handleGetStats)))
+
+	http.HandleFunc("GET /surveillance", makeHandler(s.jwtMiddleware(s.handleGetSurveillance)))
+	http.HandleFunc("GET /surveillance/export", makeHandler(s.jwtMiddleware(s.handleExportSurveillance)))
+	http.HandleFunc("GET /surveillance/alerts", makeHandler(s.jwtMiddleware(s.handleGetSurveillanceAlerts)))
+	http.HandleFunc("GET /surveillance/syndromes", makeHandler(s.jwtMiddleware(s.handleGetSyndromes)))
+	http.HandleFunc("POST /surveillance/syndromes", makeHandler(s.jwtMiddleware(s.handleCreateSyndrome)))
+	http.HandleFunc("PUT /surveillance/syndromes/{id}", makeHandler(s.jwtMiddleware(s.handleUpdateSyndrome)))
+
+	http.HandleFunc("GET /retention/dry-run", makeHandler(s.jwtMiddleware(s.handleRetentionDryRun)))
+
+	http.HandleFunc("POST /login", makeHandler(s.limitAuth(s.handleLogin)))
+	http.HandleFunc("POST /login/mfa", makeHandler(s.limitAuth(s.handleLoginMFA)))
+	http.HandleFunc("GET /auth/oidc/login", makeHandler(s.limitAuth(s.handleOIDCLogin)))
+	http.HandleFunc("GET /auth/oidc/callback", makeHandler(s.limitAuth(s.handleOIDCCallback)))
+	http.HandleFunc("POST /register", makeHandler(s.limitAuth(s.handleRegister)))
+	http.HandleFunc("POST /password-reset", makeHandler(s.limitAuth(s.handleRequestPasswordReset)))
+	http.HandleFunc("POST /password-reset/confirm", makeHandler(s.limitAuth(s.handleConfirmPasswordReset)))
 
 	return s
 }
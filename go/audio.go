@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	AUDIO_STT = "stt"
+	AUDIO_TTS = "tts"
+
+	AUDIO_DEFAULT_MAX_MESSAGE_BYTES = 64 << 10
+	AUDIO_DEFAULT_MAX_SESSION_BYTES = 16 << 20
+	AUDIO_DEFAULT_MAX_DURATION      = 10 * time.Minute
+	AUDIO_DEFAULT_RECONNECT_GRACE   = 30 * time.Second
+	AUDIO_WRITE_TIMEOUT             = 10 * time.Second
+)
+
+var errAudioStreamInUse = errors.New("audio stream belongs to another kiosk")
+
+// Limits apply to what the kiosk sends and are counted per interview session,
+// reconnecting does not reset them
+type AudioLimits struct {
+	MaxMessageBytes int64
+	MaxSessionBytes int64
+	MaxDuration     time.Duration
+	// how long the speech service connection is kept after the kiosk drops
+	ReconnectGrace time.Duration
+}
+
+type audioMessage struct {
+	kind int
+	data []byte
+}
+
+// audioGateway connects the kiosk audio streams to the speech provider. The
+// provider side outlives kiosk reconnects so the recognizer keeps the
+// sentence it was building, and transcripts produced while the kiosk was away
+// are delivered once it comes back
+type audioGateway struct {
+	speech  SpeechProvider
+	limits  AudioLimits
+	upgrade websocket.Upgrader
+
+	mu      sync.Mutex
+	streams map[string]*audioStream
+}
+
+type audioStream struct {
+	gw      *audioGateway
+	key     string
+	kioskId int
+	link    speechLink
+	// keeps kiosk messages in order when a reconnect overlaps the old connection
+	linkMu sync.Mutex
+
+	mu       sync.Mutex
+	client   *websocket.Conn
+	pending  []audioMessage
+	received int64
+	closed   bool
+	grace    *time.Timer
+	deadline *time.Timer
+}
+
+// speechLink is the provider side of an audio stream
+type speechLink interface {
+	send(m audioMessage) error
+	// receive blocks until there is something for the kiosk
+	receive() (audioMessage, error)
+	close()
+}
+
+// sttLink forwards audio chunks and answers with the final transcripts, as
+// JSON text messages so the kiosk gets the confidence to upload with the
+// recording
+type sttLink struct {
+	stream TranscriptionStream
+}
+
+func (l *sttLink) send(m audioMessage) error {
+	if m.kind != websocket.BinaryMessage {
+		return nil
+	}
+	return l.stream.Send(m.data)
+}
+
+func (l *sttLink) receive() (audioMessage, error) {
+	t, ok := <-l.stream.Transcripts()
+	if !ok {
+		return audioMessage{}, errSpeechStreamClosed
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return audioMessage{}, err
+	}
+	return audioMessage{kind: websocket.TextMessage, data: data}, nil
+}
+
+func (l *sttLink) close() {
+	l.stream.Close()
+}
+
+// ttsLink answers every text message with its audio
+type ttsLink struct {
+	speech SpeechProvider
+	lang   Language
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan audioMessage
+}
+
+func (l *ttsLink) send(m audioMessage) error {
+	if m.kind != websocket.TextMessage {
+		return nil
+	}
+
+	audio, err := l.speech.Synthesize(l.ctx, l.lang, string(m.data))
+	if err != nil {
+		return err
+	}
+
+	select {
+	case l.out <- audioMessage{kind: websocket.BinaryMessage, data: audio}:
+		return nil
+	case <-l.ctx.Done():
+		return errSpeechStreamClosed
+	}
+}
+
+func (l *ttsLink) receive() (audioMessage, error) {
+	select {
+	case m := <-l.out:
+		return m, nil
+	case <-l.ctx.Done():
+		return audioMessage{}, errSpeechStreamClosed
+	}
+}
+
+func (l *ttsLink) close() {
+	l.cancel()
+}
+
+func (gw *audioGateway) openLink(kind string, lang Language) (speechLink, error) {
+	if kind == AUDIO_STT {
+		stream, err := gw.speech.Transcribe(context.Background(), lang)
+		if err != nil {
+			return nil, err
+		}
+		return &sttLink{stream: stream}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ttsLink{speech: gw.speech, lang: lang, ctx: ctx, cancel: cancel, out: make(chan audioMessage, 1)}, nil
+}
+
+func (s *Server) initAudioGateway() {
+	limits := AudioLimits{
+		MaxMessageBytes: AUDIO_DEFAULT_MAX_MESSAGE_BYTES,
+		MaxSessionBytes: AUDIO_DEFAULT_MAX_SESSION_BYTES,
+		MaxDuration:     envDuration("AUDIO_MAX_DURATION", AUDIO_DEFAULT_MAX_DURATION),
+		ReconnectGrace:  envDuration("AUDIO_RECONNECT_GRACE", AUDIO_DEFAULT_RECONNECT_GRACE),
+	}
+	if n := envInt("AUDIO_MAX_MESSAGE_BYTES"); n > 0 {
+		limits.MaxMessageBytes = int64(n)
+	}
+	if n := envInt("AUDIO_MAX_SESSION_BYTES"); n > 0 {
+		limits.MaxSessionBytes = int64(n)
+	}
+
+	s.audio = &audioGateway{
+		speech: s.speech,
+		limits: limits,
+		upgrade: websocket.Upgrader{
+			// kiosks authenticate with their device token, not with cookies,
+			// so the origin check adds nothing
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		streams: make(map[string]*audioStream),
+	}
+}
+
+func (s *Server) handleAudioStream(kind string) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		kioskId, err := getKioskId(r)
+		if err != nil {
+			return NewAPIError(http.StatusUnauthorized, "missing kiosk token")
+		}
+
+		sessionId := r.URL.Query().Get("sessionId")
+		if sessionId == "" {
+			return NewAPIError(http.StatusBadRequest, "missing interview session id")
+		}
+
+		session, err := s.getInterviewSession(sessionId)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return NewAPIError(http.StatusNotFound, "interview session does not exist")
+			}
+			return err
+		}
+
+		if session.expired() {
+			return NewAPIError(http.StatusGone, "interview session expired")
+		}
+
+		if session.Status != InterviewInProgress {
+			return NewAPIError(http.StatusConflict, "interview already finished")
+		}
+
+		st, err := s.audio.stream(kind, session, kioskId)
+		if err != nil {
+			if errors.Is(err, errAudioStreamInUse) {
+				return NewAPIError(http.StatusConflict, "interview session is streaming from another kiosk")
+			}
+			fmt.Println("speech service error:", err)
+			return NewAPIError(http.StatusBadGateway, "speech service unavailable")
+		}
+
+		conn, err := s.audio.upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader already replied with an http error
+			return nil
+		}
+
+		st.serve(conn)
+		return nil
+	}
+}
+
+// existing returns the open stream of key, gw.mu must be held
+func (gw *audioGateway) existing(key string, kioskId int) (*audioStream, error) {
+	st, ok := gw.streams[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if st.kioskId != kioskId {
+		return nil, errAudioStreamInUse
+	}
+	return st, nil
+}
+
+// stream returns the open stream of the interview session or opens a new
+// one on the speech provider, in the language of the session. The provider
+// is dialed without holding gw.mu, a slow provider must not hold up every
+// other kiosk.
+func (gw *audioGateway) stream(kind string, session InterviewSession, kioskId int) (*audioStream, error) {
+	key := kind + ":" + session.Id
+
+	gw.mu.Lock()
+	st, err := gw.existing(key, kioskId)
+	gw.mu.Unlock()
+	if st != nil || err != nil {
+		return st, err
+	}
+
+	link, err := gw.openLink(kind, session.Language.orDefault())
+	if err != nil {
+		return nil, err
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	// another connection of the session may have opened it meanwhile
+	if st, err := gw.existing(key, kioskId); st != nil || err != nil {
+		link.close()
+		return st, err
+	}
+
+	st = &audioStream{
+		gw:      gw,
+		key:     key,
+		kioskId: kioskId,
+		link:    link,
+	}
+
+	// starts detached, the kiosk may never finish the upgrade
+	st.grace = time.AfterFunc(gw.limits.ReconnectGrace, st.expire)
+	st.deadline = time.AfterFunc(gw.limits.MaxDuration, func() {
+		st.close(websocket.ClosePolicyViolation, "audio session time limit reached")
+	})
+
+	gw.streams[key] = st
+	go st.readSpeech()
+
+	return st, nil
+}
+
+func (gw *audioGateway) remove(st *audioStream) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	if gw.streams[st.key] == st {
+		delete(gw.streams, st.key)
+	}
+}
+
+// closeKiosk ends every stream of a revoked kiosk
+func (gw *audioGateway) closeKiosk(kioskId int) {
+	gw.mu.Lock()
+	streams := make([]*audioStream, 0)
+	for _, st := range gw.streams {
+		if st.kioskId == kioskId {
+			streams = append(streams, st)
+		}
+	}
+	gw.mu.Unlock()
+
+	for _, st := range streams {
+		st.close(websocket.ClosePolicyViolation, "kiosk revoked")
+	}
+}
+
+func (st *audioStream) serve(conn *websocket.Conn) {
+	conn.SetReadLimit(st.gw.limits.MaxMessageBytes)
+
+	if !st.attach(conn) {
+		closeConn(conn, websocket.CloseTryAgainLater, "audio session ended, try again")
+		return
+	}
+
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			if errors.Is(err, websocket.ErrReadLimit) {
+				st.close(websocket.CloseMessageTooBig, "audio message too big")
+				return
+			}
+
+			st.detach(conn)
+			return
+		}
+
+		if !st.count(len(data)) {
+			st.close(websocket.ClosePolicyViolation, "audio session size limit reached")
+			return
+		}
+
+		if err := st.forward(audioMessage{kind: kind, data: data}); err != nil {
+			fmt.Println("speech service error:", err)
+			st.close(websocket.CloseTryAgainLater, "speech service unavailable")
+			return
+		}
+	}
+}
+
+// attach makes conn the kiosk side of the stream and flushes what arrived
+// while no kiosk was connected
+func (st *audioStream) attach(conn *websocket.Conn) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return false
+	}
+
+	st.grace.Stop()
+	if st.client != nil {
+		closeConn(st.client, websocket.CloseNormalClosure, "replaced by a new connection")
+	}
+	st.client = conn
+
+	pending := st.pending
+	st.pending = nil
+	for _, m := range pending {
+		st.writeClient(m)
+	}
+
+	return true
+}
+
+func (st *audioStream) detach(conn *websocket.Conn) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.client == conn {
+		st.dropClient()
+	}
+}
+
+// dropClient expects st.mu to be held
+func (st *audioStream) dropClient() {
+	st.client.Close()
+	st.client = nil
+	if !st.closed {
+		st.grace.Reset(st.gw.limits.ReconnectGrace)
+	}
+}
+
+// writeClient expects st.mu to be held, undelivered messages are kept for
+// the next connection
+func (st *audioStream) writeClient(m audioMessage) {
+	if st.client == nil {
+		st.pending = append(st.pending, m)
+		return
+	}
+
+	st.client.SetWriteDeadline(time.Now().Add(AUDIO_WRITE_TIMEOUT))
+	if err := st.client.WriteMessage(m.kind, m.data); err != nil {
+		st.pending = append(st.pending, m)
+		st.dropClient()
+	}
+}
+
+func (st *audioStream) count(n int) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.received += int64(n)
+	return st.received <= st.gw.limits.MaxSessionBytes
+}
+
+func (st *audioStream) forward(m audioMessage) error {
+	st.linkMu.Lock()
+	defer st.linkMu.Unlock()
+
+	return st.link.send(m)
+}
+
+func (st *audioStream) readSpeech() {
+	for {
+		m, err := st.link.receive()
+		if err != nil {
+			st.close(websocket.CloseGoingAway, "speech service closed the stream")
+			return
+		}
+
+		st.mu.Lock()
+		st.writeClient(m)
+		st.mu.Unlock()
+	}
+}
+
+// expire ends the stream when the kiosk did not come back in time
+func (st *audioStream) expire() {
+	st.mu.Lock()
+	attached := st.client != nil
+	st.mu.Unlock()
+
+	if !attached {
+		st.close(websocket.CloseNormalClosure, "")
+	}
+}
+
+func (st *audioStream) close(code int, reason string) {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return
+	}
+
+	st.closed = true
+	st.grace.Stop()
+	st.deadline.Stop()
+	if st.client != nil {
+		closeConn(st.client, code, reason)
+		st.client = nil
+	}
+	st.mu.Unlock()
+
+	st.link.close()
+
+	st.gw.remove(st)
+}
+
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
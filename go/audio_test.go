@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestAudioGateway(limits AudioLimits) *audioGateway {
+	if limits.MaxMessageBytes == 0 {
+		limits.MaxMessageBytes = AUDIO_DEFAULT_MAX_MESSAGE_BYTES
+	}
+	if limits.MaxSessionBytes == 0 {
+		limits.MaxSessionBytes = AUDIO_DEFAULT_MAX_SESSION_BYTES
+	}
+	if limits.MaxDuration == 0 {
+		limits.MaxDuration = time.Minute
+	}
+	if limits.ReconnectGrace == 0 {
+		limits.ReconnectGrace = time.Minute
+	}
+
+	return &audioGateway{
+		speech:  NewFakeSpeechProvider(),
+		limits:  limits,
+		streams: make(map[string]*audioStream),
+	}
+}
+
+// serveAudio stands in for handleAudioStream without the database, the
+// session id and kiosk id come from the query
+func serveAudio(t *testing.T, gw *audioGateway, kind string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kioskId, _ := strconv.Atoi(r.URL.Query().Get("kioskId"))
+		session := InterviewSession{Id: r.URL.Query().Get("sessionId")}
+
+		st, err := gw.stream(kind, session, kioskId)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		conn, err := gw.upgrade.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		st.serve(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func dialAudio(t *testing.T, server *httptest.Server, sessionId string, kioskId int) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") +
+		"?sessionId=" + sessionId + "&kioskId=" + strconv.Itoa(kioskId)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func readAudio(t *testing.T, conn *websocket.Conn) (int, []byte) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kind, data
+}
+
+// readTranscript expects the JSON text message of a transcript
+func readTranscript(t *testing.T, conn *websocket.Conn) Transcript {
+	t.Helper()
+
+	kind, data := readAudio(t, conn)
+	if kind != websocket.TextMessage {
+		t.Fatalf("message kind = %d, want text", kind)
+	}
+
+	var tr Transcript
+	if err := json.Unmarshal(data, &tr); err != nil {
+		t.Fatalf("transcript %q: %v", data, err)
+	}
+	return tr
+}
+
+func TestAudioTranscription(t *testing.T) {
+	gw := newTestAudioGateway(AudioLimits{})
+	conn := dialAudio(t, serveAudio(t, gw, AUDIO_STT), "s1", 1)
+
+	for _, text := range []string{"dor no peito", "há dois dias"} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+
+		if tr := readTranscript(t, conn); tr.Text != text || tr.Confidence == nil || *tr.Confidence != 1 {
+			t.Errorf("transcript = %+v, want %q with confidence 1", tr, text)
+		}
+	}
+}
+
+func TestAudioSynthesis(t *testing.T) {
+	gw := newTestAudioGateway(AudioLimits{})
+	conn := dialAudio(t, serveAudio(t, gw, AUDIO_TTS), "s1", 1)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("Onde dói?")); err != nil {
+		t.Fatal(err)
+	}
+
+	kind, data := readAudio(t, conn)
+	if kind != websocket.BinaryMessage {
+		t.Fatalf("message kind = %d, want binary", kind)
+	}
+
+	samples := len([]rune("Onde dói?")) * FAKE_SPEECH_SAMPLE_RATE * FAKE_SPEECH_MS_PER_CHAR / 1000
+	if !bytes.Equal(data, wavSilence(samples)) {
+		t.Errorf("audio is %d bytes, want a WAV of %d samples", len(data), samples)
+	}
+}
+
+func TestAudioStreamOtherKiosk(t *testing.T) {
+	gw := newTestAudioGateway(AudioLimits{})
+
+	if _, err := gw.stream(AUDIO_STT, InterviewSession{Id: "s1"}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gw.stream(AUDIO_STT, InterviewSession{Id: "s1"}, 2); !errors.Is(err, errAudioStreamInUse) {
+		t.Errorf("second kiosk got %v, want %v", err, errAudioStreamInUse)
+	}
+
+	// the other direction of the session is a stream of its own
+	if _, err := gw.stream(AUDIO_TTS, InterviewSession{Id: "s1"}, 2); err != nil {
+		t.Errorf("synthesis stream of another kiosk: %v", err)
+	}
+}
+
+func TestAudioPendingDelivery(t *testing.T) {
+	gw := newTestAudioGateway(AudioLimits{})
+	server := serveAudio(t, gw, AUDIO_STT)
+
+	// the transcript is produced before any kiosk is attached
+	st, err := gw.stream(AUDIO_STT, InterviewSession{Id: "s1"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.forward(audioMessage{kind: websocket.BinaryMessage, data: []byte("febre")}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dialAudio(t, server, "s1", 1)
+	if tr := readTranscript(t, conn); tr.Text != "febre" {
+		t.Errorf("transcript = %q, want %q", tr.Text, "febre")
+	}
+}
+
+func TestAudioSessionLimit(t *testing.T) {
+	gw := newTestAudioGateway(AudioLimits{MaxSessionBytes: 8})
+	conn := dialAudio(t, serveAudio(t, gw, AUDIO_STT), "s1", 1)
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("tosse seca")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("read error = %v, want a policy violation close", err)
+	}
+}
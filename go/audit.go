@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type AuditAction string
+
+const (
+	AuditViewPatient        AuditAction = "view_patient"
+	AuditViewPatientReports AuditAction = "view_patient_reports"
+	AuditViewReport         AuditAction = "view_report"
+	AuditExportPatientData  AuditAction = "export_patient_data"
+	AuditAnonymizePatient   AuditAction = "anonymize_patient"
+	AuditViewRecordings     AuditAction = "view_recordings"
+	AuditListenRecording    AuditAction = "listen_recording"
+	AuditExportReports      AuditAction = "export_reports"
+	AuditImportPatients     AuditAction = "import_patients"
+	AuditImportReports      AuditAction = "import_reports"
+)
+
+type AuditEntry struct {
+	Id         int         `json:"id"`
+	EmployeeId *int        `json:"employeeId"`
+	Action     AuditAction `json:"action"`
+	PatientId  *int        `json:"patientId"`
+	ReportId   *int        `json:"reportId"`
+	CreatedAt  time.Time   `json:"createdAt"`
+}
+
+func (s *Server) audit(employeeId *int, action AuditAction, patientId *int, reportId *int) error {
+	q := `INSERT INTO audit_log(employee_id, action, patient_id, report_id, created_at)
+	VALUES($1, $2, $3, $4, $5)`
+
+	_, err := s.db.Exec(context.Background(), q, employeeId, action, patientId, reportId, time.Now())
+	return err
+}
+
+// auditRequest records access done by the authenticated employee, failures
+// are only logged so that reads are not blocked by the audit log
+func (s *Server) auditRequest(r *http.Request, action AuditAction, patientId *int, reportId *int) {
+	var employeeId *int
+	if id, err := getIdFromToken(r); err == nil {
+		employeeId = &id
+	}
+
+	if err := s.audit(employeeId, action, patientId, reportId); err != nil {
+		fmt.Println("audit error:", err.Error())
+	}
+}
+
+func (s *Server) getPatientAuditLog(patientId int) ([]AuditEntry, error) {
+	q := `SELECT a.audit_id, a.employee_id, a.action, a.patient_id, a.report_id, a.created_at
+	FROM audit_log a WHERE a.patient_id = $1 ORDER BY a.created_at`
+
+	rows, err := s.db.Query(context.Background(), q, patientId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		err := rows.Scan(&e.Id, &e.EmployeeId, &e.Action, &e.PatientId, &e.ReportId, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Council is the professional council a clinician is registered at, the
+// registration is valid in one state
+type Council string
+
+const (
+	// Conselho Regional de Medicina, doctors
+	CouncilCRM Council = "CRM"
+	// Conselho Regional de Enfermagem, nurses and nursing technicians
+	CouncilCOREN Council = "COREN"
+)
+
+const (
+	MAX_SPECIALTIES       = 10
+	MAX_SPECIALTY_LENGTH  = 100
+	MAX_DISPLAY_NAME      = 100
+	MAX_REGISTRATION_SIZE = 8
+)
+
+var brazilianStates = []string{
+	"AC", "AL", "AP", "AM", "BA", "CE", "DF", "ES", "GO", "MA", "MT", "MS", "MG", "PA",
+	"PB", "PR", "PE", "PI", "RJ", "RN", "RS", "RO", "RR", "SC", "SP", "SE", "TO",
+}
+
+// Registrations given by the employees themselves are unverified until
+// someone with manage_employees checks them with the council, documents
+// leave them out until then.
+type ProfessionalRegistration struct {
+	Council Council `json:"council"`
+	// digits only
+	Number string `json:"number"`
+	State  string `json:"state"`
+	// ignored in requests
+	Verified bool `json:"verified"`
+}
+
+// String is the way registrations are printed on documents, e.g. CRM/SP 123456
+func (p ProfessionalRegistration) String() string {
+	return fmt.Sprintf("%s/%s %s", p.Council, p.State, p.Number)
+}
+
+// scannedRegistration builds the registration from its nullable columns
+func scannedRegistration(council, number, state *string, verified bool) *ProfessionalRegistration {
+	if council == nil || number == nil || state == nil {
+		return nil
+	}
+
+	return &ProfessionalRegistration{Council: Council(*council), Number: *number, State: *state, Verified: verified}
+}
+
+func (p ProfessionalRegistration) empty() bool {
+	return p.Council == "" && p.Number == "" && p.State == ""
+}
+
+// normalized accepts the number with the usual dots and dashes and any case
+// for the council and state
+func (p ProfessionalRegistration) normalized() ProfessionalRegistration {
+	p.Council = Council(strings.ToUpper(strings.TrimSpace(string(p.Council))))
+	p.State = strings.ToUpper(strings.TrimSpace(p.State))
+	p.Number = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, p.Number)
+	// leading zeros are not part of the number, 012345 and 12345 are the same
+	p.Number = strings.TrimLeft(p.Number, "0")
+	p.Verified = false
+
+	return p
+}
+
+func (p ProfessionalRegistration) validate() []string {
+	errs := make([]string, 0)
+
+	if p.Council != CouncilCRM && p.Council != CouncilCOREN {
+		errs = append(errs, fmt.Sprintf("council must be %s or %s", CouncilCRM, CouncilCOREN))
+	}
+
+	if len(p.Number) == 0 || len(p.Number) > MAX_REGISTRATION_SIZE ||
+		strings.IndexFunc(p.Number, func(r rune) bool { return !unicode.IsDigit(r) }) >= 0 {
+		errs = append(errs, fmt.Sprintf("number must have 1 to %d digits", MAX_REGISTRATION_SIZE))
+	}
+
+	if !slices.Contains(brazilianStates, p.State) {
+		errs = append(errs, "state must be a Brazilian state abbreviation, e.g. SP")
+	}
+
+	return errs
+}
+
+func normalizeSpecialties(specialties []string) []string {
+	out := make([]string, 0, len(specialties))
+	for _, s := range specialties {
+		s = strings.Join(strings.Fields(s), " ")
+		if s != "" && !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+func validateSpecialties(specialties []string) []string {
+	errs := make([]string, 0)
+
+	if len(specialties) > MAX_SPECIALTIES {
+		errs = append(errs, fmt.Sprintf("at most %d specialties", MAX_SPECIALTIES))
+	}
+
+	for _, s := range specialties {
+		if len(s) > MAX_SPECIALTY_LENGTH {
+			errs = append(errs, fmt.Sprintf("specialties must not exceed %d characters", MAX_SPECIALTY_LENGTH))
+			break
+		}
+	}
+
+	return errs
+}
+
+// updateCredentials saves the professional fields of the request that were
+// given. A registration that changes loses its verification.
+func updateCredentials(ctx context.Context, tx pgx.Tx, employeeId int, req PatchProfileRequest) error {
+	if req.DisplayName != nil {
+		q := `UPDATE employee SET display_name = NULLIF($1, '') WHERE employee_id = $2`
+		if _, err := tx.Exec(ctx, q, *req.DisplayName, employeeId); err != nil {
+			return err
+		}
+	}
+
+	if req.Specialties != nil {
+		q := `UPDATE employee SET specialties = $1 WHERE employee_id = $2`
+		if _, err := tx.Exec(ctx, q, *req.Specialties, employeeId); err != nil {
+			return err
+		}
+	}
+
+	if req.Registration != nil {
+		var council, number, state *string
+		if !req.Registration.empty() {
+			c := string(req.Registration.Council)
+			council, number, state = &c, &req.Registration.Number, &req.Registration.State
+		}
+
+		q := `UPDATE employee SET council = $1, council_number = $2, council_state = $3,
+		council_verified_at = CASE WHEN (council, council_number, council_state) IS NOT DISTINCT FROM ($1, $2, $3)
+			THEN council_verified_at END,
+		council_verified_by = CASE WHEN (council, council_number, council_state) IS NOT DISTINCT FROM ($1, $2, $3)
+			THEN council_verified_by END
+		WHERE employee_id = $4`
+		if _, err := tx.Exec(ctx, q, council, number, state, employeeId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleVerifyRegistration marks the employee's registration as checked with
+// the council, from then on it is printed on documents
+func (s *Server) handleVerifyRegistration(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	requesterId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	if employeeId == requesterId {
+		return NewAPIError(http.StatusConflict, "employees can't verify their own registration")
+	}
+
+	if err := s.requireEmployeeFacility(r, employeeId); err != nil {
+		return err
+	}
+
+	q := `UPDATE employee SET council_verified_at = $1, council_verified_by = $2
+	WHERE employee_id = $3 AND council IS NOT NULL AND council_verified_at IS NULL`
+
+	tag, err := s.db.Exec(context.Background(), q, time.Now(), requesterId, employeeId)
+	if err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		if emp.Registration == nil {
+			return NewAPIError(http.StatusConflict, "employee has no registration")
+		}
+		return NewAPIError(http.StatusConflict, "registration already verified")
+	}
+
+	return writeJSON(w, http.StatusOK, emp)
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SEALED_PREFIX = "enc:v2:"
+	// values sealed before they were bound to their column, they are still
+	// opened until the rotation job seals them again
+	SEALED_PREFIX_V1          = "enc:v1:"
+	KEY_ROTATION_INTERVAL     = time.Hour
+	KEY_ROTATION_BATCH        = 200
+	FIELD_ENCRYPTION_KEY_SIZE = 32
+)
+
+// KeyProvider hands out the key encryption keys (KEKs). Values are always
+// sealed with the current key, older keys are kept around so existing values
+// can still be opened until the rotation job re-encrypts them.
+type KeyProvider interface {
+	CurrentKey() (id string, key []byte, err error)
+	Key(id string) ([]byte, error)
+}
+
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.current)
+	return p.current, key, err
+}
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+func newStaticKeyProvider(current string, encodedKeys map[string]string) (*staticKeyProvider, error) {
+	p := &staticKeyProvider{
+		current: current,
+		keys:    make(map[string][]byte),
+	}
+
+	for id, encoded := range encodedKeys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid encryption key id %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q is not valid base64", id)
+		}
+
+		if len(key) != FIELD_ENCRYPTION_KEY_SIZE {
+			return nil, fmt.Errorf("encryption key %q must be %d bytes long", id, FIELD_ENCRYPTION_KEY_SIZE)
+		}
+
+		p.keys[id] = key
+	}
+
+	if _, ok := p.keys[current]; !ok {
+		return nil, fmt.Errorf("current encryption key %q is not configured", current)
+	}
+
+	return p, nil
+}
+
+// NewEnvKeyProvider reads keys from FIELD_ENCRYPTION_KEYS ("id:base64,id:base64")
+// and the id of the current one from FIELD_ENCRYPTION_KEY_ID
+func NewEnvKeyProvider() (KeyProvider, error) {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("FIELD_ENCRYPTION_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("FIELD_ENCRYPTION_KEYS entries must look like id:base64key")
+		}
+		keys[id] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no field encryption keys configured")
+	}
+
+	return newStaticKeyProvider(os.Getenv("FIELD_ENCRYPTION_KEY_ID"), keys)
+}
+
+// NewFileKeyProvider reads a JSON file like {"current": "k2", "keys": {"k1": "base64", "k2": "base64"}}
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("error parsing key file: %w", err)
+	}
+
+	return newStaticKeyProvider(file.Current, file.Keys)
+}
+
+// FieldCipher does envelope encryption of single column values: every value
+// gets its own data key, which is stored next to it wrapped by the current KEK.
+// The ciphertext is bound to the column it is stored in ("table.column" as
+// additional data), a value copied into another column does not open.
+//
+// Sealed format: enc:v2:<key id>:<base64 wrapped data key>:<base64 ciphertext>
+type FieldCipher struct {
+	keys     KeyProvider
+	indexKey []byte
+}
+
+var fieldCipher *FieldCipher
+
+func initFieldEncryption() {
+	var keys KeyProvider
+	var err error
+	if path := os.Getenv("FIELD_ENCRYPTION_KEY_FILE"); path != "" {
+		keys, err = NewFileKeyProvider(path)
+	} else {
+		keys, err = NewEnvKeyProvider()
+	}
+	if err != nil {
+		log.Fatal("error loading field encryption keys: ", err)
+	}
+
+	indexKey, err := base64.StdEncoding.DecodeString(os.Getenv("BLIND_INDEX_KEY"))
+	if err != nil || len(indexKey) < FIELD_ENCRYPTION_KEY_SIZE {
+		log.Fatal("BLIND_INDEX_KEY must be a base64 encoded key of at least 32 bytes")
+	}
+
+	fieldCipher = &FieldCipher{keys: keys, indexKey: indexKey}
+}
+
+func gcmSeal(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func gcmOpen(key, sealed, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// Sealed columns, passed to Seal and Open as the additional data
+const (
+	SEALED_PATIENT_CPF               = "patient.cpf"
+	SEALED_EMPLOYEE_CPF              = "employee.cpf"
+	SEALED_EMPLOYEE_TOTP_SECRET      = "employee.totp_secret"
+	SEALED_REPORT_INTERVIEW          = "report.interview"
+	SEALED_REPORT_DISEASES           = "report.diseases"
+	SEALED_REPORT_RED_FLAGS          = "report.red_flags"
+	SEALED_REPORT_ARCHIVE_DATA       = "report_archive.data"
+	SEALED_INTERVIEW_SESSION_ANSWERS = "interview_session.answers"
+	SEALED_RECORDING_AUDIO           = "interview_recording.audio"
+	SEALED_RECORDING_TRANSCRIPT      = "interview_recording.transcript"
+	SEALED_OIDC_CODE_VERIFIER        = "oidc_login.code_verifier"
+)
+
+func (c *FieldCipher) Seal(plaintext []byte, column string) (string, error) {
+	keyId, kek, err := c.keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+
+	dek := make([]byte, FIELD_ENCRYPTION_KEY_SIZE)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+
+	wrapped, err := gcmSeal(kek, dek, []byte(keyId))
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := gcmSeal(dek, plaintext, []byte(column))
+	if err != nil {
+		return "", err
+	}
+
+	return SEALED_PREFIX + keyId + ":" +
+		base64.StdEncoding.EncodeToString(wrapped) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Open returns values written before encryption was enabled unchanged
+func (c *FieldCipher) Open(value string, column string) ([]byte, error) {
+	additionalData := []byte(column)
+	prefix := SEALED_PREFIX
+	if strings.HasPrefix(value, SEALED_PREFIX_V1) {
+		additionalData = nil
+		prefix = SEALED_PREFIX_V1
+	} else if !strings.HasPrefix(value, SEALED_PREFIX) {
+		return []byte(value), nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed sealed value")
+	}
+
+	kek, err := c.keys.Key(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := gcmOpen(kek, wrapped, []byte(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	return gcmOpen(dek, ciphertext, additionalData)
+}
+
+// needsRotation is true for plaintext values, values sealed with an old key
+// and values not bound to their column yet
+func (c *FieldCipher) needsRotation(value string) bool {
+	keyId, _, err := c.keys.CurrentKey()
+	if err != nil {
+		return false
+	}
+
+	return !strings.HasPrefix(value, SEALED_PREFIX+keyId+":")
+}
+
+// BlindIndex is a keyed hash of the value, used to look up sealed columns by
+// equality without decrypting every row
+func (c *FieldCipher) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sealedValue is passed as a query argument in place of the value to be
+// stored in column. Strings and byte slices are sealed as is, anything else
+// is sealed as JSON. Empty strings and nil values are stored as NULL.
+type sealedValue struct {
+	column string
+	v      any
+}
+
+func sealed(column string, v any) sealedValue {
+	return sealedValue{column: column, v: v}
+}
+
+func (s sealedValue) Value() (driver.Value, error) {
+	var plaintext []byte
+	switch v := s.v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if v == "" {
+			return nil, nil
+		}
+		plaintext = []byte(v)
+	case *string:
+		if v == nil || *v == "" {
+			return nil, nil
+		}
+		plaintext = []byte(*v)
+	case []byte:
+		if len(v) == 0 {
+			return nil, nil
+		}
+		plaintext = v
+	default:
+		var err error
+		plaintext, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fieldCipher.Seal(plaintext, s.column)
+}
+
+// sealedScanner opens a sealed column into dst. *string, **string and
+// *[]byte get the plaintext, any other destination is decoded from JSON.
+type sealedScanner struct {
+	column string
+	dst    any
+}
+
+func unseal(column string, dst any) *sealedScanner {
+	return &sealedScanner{column: column, dst: dst}
+}
+
+func (s *sealedScanner) Scan(src any) error {
+	if src == nil {
+		switch dst := s.dst.(type) {
+		case **string:
+			*dst = nil
+		case *string:
+			*dst = ""
+		}
+		return nil
+	}
+
+	var value string
+	switch src := src.(type) {
+	case string:
+		value = src
+	case []byte:
+		value = string(src)
+	default:
+		return fmt.Errorf("cannot unseal value of type %T", src)
+	}
+
+	plaintext, err := fieldCipher.Open(value, s.column)
+	if err != nil {
+		return err
+	}
+
+	switch dst := s.dst.(type) {
+	case *string:
+		*dst = string(plaintext)
+	case **string:
+		str := string(plaintext)
+		*dst = &str
+	case *[]byte:
+		*dst = plaintext
+	default:
+		return json.Unmarshal(plaintext, dst)
+	}
+
+	return nil
+}
+
+// blindIndex returns nil for empty values so that the hash column stays NULL
+func blindIndex(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	hash := fieldCipher.BlindIndex(value)
+	return &hash
+}
+
+type sealedColumn struct {
+	table      string
+	pk         string
+	textPk     bool
+	column     string
+	hashColumn string
+}
+
+// name is the additional data values of the column are sealed with
+func (col sealedColumn) name() string {
+	return col.table + "." + col.column
+}
+
+// oidc_login is left out, its rows expire within minutes
+var sealedColumns = []sealedColumn{
+	{table: "patient", pk: "patient_id", column: "cpf", hashColumn: "cpf_hash"},
+	{table: "employee", pk: "employee_id", column: "cpf", hashColumn: "cpf_hash"},
+	{table: "employee", pk: "employee_id", column: "totp_secret"},
+	{table: "report", pk: "report_id", column: "interview"},
+	{table: "report", pk: "report_id", column: "diseases"},
+	{table: "report", pk: "report_id", column: "red_flags"},
+	{table: "report_archive", pk: "report_id", column: "data"},
+	{table: "interview_session", pk: "session_id", textPk: true, column: "answers"},
+	{table: "interview_recording", pk: "recording_id", column: "audio"},
+	{table: "interview_recording", pk: "recording_id", column: "transcript"},
+}
+
+// runKeyRotation periodically re-encrypts values sealed with an old key, as
+// well as plaintext values left from before encryption was enabled
+func (s *Server) runKeyRotation() {
+	for {
+		for _, col := range sealedColumns {
+			n, err := s.rotateColumn(col)
+			if err != nil {
+				fmt.Printf("key rotation error on %s.%s: %s\n", col.table, col.column, err)
+				continue
+			}
+
+			if n > 0 {
+				fmt.Printf("key rotation: re-encrypted %d values of %s.%s\n", n, col.table, col.column)
+			}
+		}
+
+		time.Sleep(KEY_ROTATION_INTERVAL)
+	}
+}
+
+func (s *Server) rotateColumn(col sealedColumn) (int, error) {
+	keyId, _, err := fieldCipher.keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	// matches neither plaintext nor values sealed before column binding
+	current := SEALED_PREFIX + keyId + ":%"
+	selectQuery := fmt.Sprintf(`SELECT %[1]s, %[2]s FROM %[3]s
+	WHERE %[2]s IS NOT NULL AND %[2]s NOT LIKE $1 AND %[1]s > $2
+	ORDER BY %[1]s LIMIT $3`, col.pk, col.column, col.table)
+
+	// the old value is part of the condition so rows changed in the meantime are left alone
+	updateQuery := fmt.Sprintf(`UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3`,
+		col.table, col.column, col.pk, col.column)
+	if col.hashColumn != "" {
+		updateQuery = fmt.Sprintf(`UPDATE %s SET %s = $1, %s = $4 WHERE %s = $2 AND %s = $3`,
+			col.table, col.column, col.hashColumn, col.pk, col.column)
+	}
+
+	total := 0
+	var lastId any = 0
+	if col.textPk {
+		lastId = ""
+	}
+	for {
+		rows, err := s.db.Query(context.Background(), selectQuery, current, lastId, KEY_ROTATION_BATCH)
+		if err != nil {
+			return total, err
+		}
+
+		type entry struct {
+			id    any
+			value string
+		}
+		batch := make([]entry, 0, KEY_ROTATION_BATCH)
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.id, &e.value); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+
+		if len(batch) == 0 {
+			return total, nil
+		}
+
+		for _, e := range batch {
+			lastId = e.id
+			if !fieldCipher.needsRotation(e.value) {
+				continue
+			}
+
+			plaintext, err := fieldCipher.Open(e.value, col.name())
+			if err != nil {
+				return total, fmt.Errorf("row %v: %w", e.id, err)
+			}
+
+			resealed, err := fieldCipher.Seal(plaintext, col.name())
+			if err != nil {
+				return total, err
+			}
+
+			args := []any{resealed, e.id, e.value}
+			if col.hashColumn != "" {
+				args = append(args, blindIndex(NormalizeCPF(string(plaintext))))
+			}
+
+			// a row changed since it was read is not counted, it was sealed
+			// with the current key by whoever changed it
+			tag, err := s.db.Exec(context.Background(), updateQuery, args...)
+			if err != nil {
+				return total, err
+			}
+			total += int(tag.RowsAffected())
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testKeys(t *testing.T, ids ...string) map[string]string {
+	t.Helper()
+
+	keys := make(map[string]string)
+	for _, id := range ids {
+		key := make([]byte, FIELD_ENCRYPTION_KEY_SIZE)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	return keys
+}
+
+func testCipher(t *testing.T, current string, keys map[string]string) *FieldCipher {
+	t.Helper()
+
+	provider, err := newStaticKeyProvider(current, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FieldCipher{keys: provider, indexKey: make([]byte, FIELD_ENCRYPTION_KEY_SIZE)}
+}
+
+// useCipher replaces the cipher sealed and unseal use for the test
+func useCipher(t *testing.T, c *FieldCipher) {
+	previous := fieldCipher
+	fieldCipher = c
+	t.Cleanup(func() { fieldCipher = previous })
+}
+
+func TestSealOpen(t *testing.T) {
+	c := testCipher(t, "k1", testKeys(t, "k1"))
+
+	value, err := c.Seal([]byte("529.982.247-25"), SEALED_PATIENT_CPF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(value, SEALED_PREFIX+"k1:") {
+		t.Errorf("sealed value %q does not name its key", value)
+	}
+	if strings.Contains(value, "529") {
+		t.Errorf("sealed value %q contains the plaintext", value)
+	}
+
+	plaintext, err := c.Open(value, SEALED_PATIENT_CPF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "529.982.247-25" {
+		t.Errorf("opened %q", plaintext)
+	}
+
+	again, err := c.Seal([]byte("529.982.247-25"), SEALED_PATIENT_CPF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == value {
+		t.Error("sealing the same value twice gave the same output")
+	}
+
+	// a value copied into another column, e.g. a patient CPF into an employee
+	if _, err := c.Open(value, SEALED_EMPLOYEE_CPF); err == nil {
+		t.Error("value opened as another column")
+	}
+
+	parts := strings.Split(value, ":")
+	ciphertext, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+	ciphertext[len(ciphertext)-1] ^= 1
+	parts[len(parts)-1] = base64.StdEncoding.EncodeToString(ciphertext)
+	if _, err := c.Open(strings.Join(parts, ":"), SEALED_PATIENT_CPF); err == nil {
+		t.Error("tampered value opened")
+	}
+
+	if _, err := c.Open(SEALED_PREFIX+"k1:abc", SEALED_PATIENT_CPF); err == nil {
+		t.Error("malformed value opened")
+	}
+
+	// written before encryption was enabled
+	plaintext, err = c.Open("52998224725", SEALED_PATIENT_CPF)
+	if err != nil || string(plaintext) != "52998224725" {
+		t.Errorf("plaintext value opened as %q, %v", plaintext, err)
+	}
+	if !c.needsRotation("52998224725") {
+		t.Error("plaintext value does not need rotation")
+	}
+}
+
+func TestOpenUnboundValue(t *testing.T) {
+	keys := testKeys(t, "k1")
+	c := testCipher(t, "k1", keys)
+
+	// sealed like before values were bound to their column
+	kek, _ := base64.StdEncoding.DecodeString(keys["k1"])
+	dek := make([]byte, FIELD_ENCRYPTION_KEY_SIZE)
+	rand.Read(dek)
+	wrapped, err := gcmSeal(kek, dek, []byte("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := gcmSeal(dek, []byte("dor no peito"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := SEALED_PREFIX_V1 + "k1:" + base64.StdEncoding.EncodeToString(wrapped) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext)
+
+	plaintext, err := c.Open(value, SEALED_REPORT_INTERVIEW)
+	if err != nil || string(plaintext) != "dor no peito" {
+		t.Errorf("unbound value opened as %q, %v", plaintext, err)
+	}
+
+	if !c.needsRotation(value) {
+		t.Error("unbound value sealed with the current key does not need rotation")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	keys := testKeys(t, "k1", "k2")
+
+	old, err := testCipher(t, "k1", keys).Seal([]byte(`["asma"]`), SEALED_REPORT_DISEASES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// k2 becomes the current key, k1 stays around until rotation is done
+	c := testCipher(t, "k2", keys)
+	if !c.needsRotation(old) {
+		t.Fatal("value sealed with the old key does not need rotation")
+	}
+
+	plaintext, err := c.Open(old, SEALED_REPORT_DISEASES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resealed, err := c.Seal(plaintext, SEALED_REPORT_DISEASES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resealed, SEALED_PREFIX+"k2:") || c.needsRotation(resealed) {
+		t.Errorf("resealed value %q is not sealed with the current key", resealed)
+	}
+
+	// once k1 is retired only rotated values open
+	retired := testCipher(t, "k2", map[string]string{"k2": keys["k2"]})
+	if _, err := retired.Open(old, SEALED_REPORT_DISEASES); err == nil {
+		t.Error("value of a retired key opened")
+	}
+	plaintext, err = retired.Open(resealed, SEALED_REPORT_DISEASES)
+	if err != nil || string(plaintext) != `["asma"]` {
+		t.Errorf("rotated value opened as %q, %v", plaintext, err)
+	}
+}
+
+func TestSealedValueScan(t *testing.T) {
+	useCipher(t, testCipher(t, "k1", testKeys(t, "k1")))
+
+	answers := []QA{{QuestionId: "pain", Question: "Onde dói?", Answer: "no peito"}}
+	value, err := sealed(SEALED_INTERVIEW_SESSION_ANSWERS, answers).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []QA
+	if err := unseal(SEALED_INTERVIEW_SESSION_ANSWERS, &got).Scan(value); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, answers) {
+		t.Errorf("scanned %+v, want %+v", got, answers)
+	}
+
+	if err := unseal(SEALED_REPORT_INTERVIEW, &got).Scan(value); err == nil {
+		t.Error("answers of an interview session scanned as a report interview")
+	}
+
+	for _, v := range []any{"", (*string)(nil), []byte{}, nil} {
+		if value, err := sealed(SEALED_PATIENT_CPF, v).Value(); value != nil || err != nil {
+			t.Errorf("%#v sealed as %v, %v, want NULL", v, value, err)
+		}
+	}
+
+	cpf := "stale"
+	if err := unseal(SEALED_PATIENT_CPF, &cpf).Scan(nil); err != nil || cpf != "" {
+		t.Errorf("NULL scanned as %q, %v", cpf, err)
+	}
+}
+
+func TestRotateColumn(t *testing.T) {
+	s := &Server{db: testDatabase(t)}
+	ctx := context.Background()
+	keys := testKeys(t, "k1", "k2")
+
+	useCipher(t, testCipher(t, "k1", keys))
+	q := `INSERT INTO patient(name, cpf, sex) VALUES('Ana Souza', $1, 'F'), ('João Lima', '11144477735', 'M')`
+	if _, err := s.db.Exec(ctx, q, sealed(SEALED_PATIENT_CPF, "52998224725")); err != nil {
+		t.Fatal(err)
+	}
+
+	useCipher(t, testCipher(t, "k2", keys))
+	col := sealedColumns[slices.IndexFunc(sealedColumns, func(c sealedColumn) bool {
+		return c.name() == SEALED_PATIENT_CPF
+	})]
+
+	n, err := s.rotateColumn(col)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("rotated %d values, want 2", n)
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT cpf, cpf_hash FROM patient`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var value, hash string
+		if err := rows.Scan(&value, &hash); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(value, SEALED_PREFIX+"k2:") {
+			t.Errorf("value %q not sealed with the current key", value)
+		}
+
+		cpf, err := fieldCipher.Open(value, SEALED_PATIENT_CPF)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != fieldCipher.BlindIndex(NormalizeCPF(string(cpf))) {
+			t.Errorf("blind index of %s not updated", cpf)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.rotateColumn(col); err != nil || n != 0 {
+		t.Errorf("second run rotated %d values, %v", n, err)
+	}
+}
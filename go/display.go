@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// how long a call stays on the waiting room screen
+	DISPLAY_CALL_WINDOW = 15 * time.Minute
+	DISPLAY_MAX_CALLED  = 5
+	DISPLAY_MAX_WAITING = 30
+)
+
+// The display feed is public, so it must only ever carry ticket codes and
+// never anything taken from PatientOutput.
+type DisplayTicket struct {
+	Ticket   string    `json:"ticket"`
+	Urgency  Urgency   `json:"urgency"`
+	IssuedAt time.Time `json:"issuedAt"`
+}
+
+type DisplayCall struct {
+	Ticket       string    `json:"ticket"`
+	Urgency      Urgency   `json:"urgency"`
+	Room         string    `json:"room"`
+	CalledAt     time.Time `json:"calledAt"`
+	Announcement string    `json:"announcement"`
+}
+
+type DisplayFeed struct {
+	Called    []DisplayCall   `json:"called"`
+	Waiting   []DisplayTicket `json:"waiting"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// handleGetDisplay takes the facility of the waiting room on the facilityId
+// query parameter, without it the feed covers every facility
+func (s *Server) handleGetDisplay(w http.ResponseWriter, r *http.Request) error {
+	var facilityId *int
+	if v := r.URL.Query().Get("facilityId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return BadRequest()
+		}
+		facilityId = &id
+	}
+
+	now := time.Now()
+	feed := DisplayFeed{
+		Called:    make([]DisplayCall, 0),
+		Waiting:   make([]DisplayTicket, 0),
+		UpdatedAt: now,
+	}
+
+	q := `SELECT r.ticket, r.urgency, r.called_room, r.called_at
+	FROM report r
+	WHERE r.called_at >= $1 AND NOT r.imported AND ($3::INTEGER IS NULL OR r.facility_id = $3)
+	ORDER BY r.called_at DESC
+	LIMIT $2`
+
+	rows, err := s.db.Query(context.Background(), q, now.Add(-DISPLAY_CALL_WINDOW), DISPLAY_MAX_CALLED, facilityId)
+	if err != nil {
+		fmt.Println("db error:", err.Error())
+		return InternalError()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c DisplayCall
+		err := rows.Scan(&c.Ticket, &c.Urgency, &c.Room, &c.CalledAt)
+		if err != nil {
+			fmt.Println("scan error:", err.Error())
+			return InternalError()
+		}
+
+		// text meant to be sent as is to the TTS service
+		c.Announcement = fmt.Sprintf("Ticket %s, please go to room %s", c.Ticket, c.Room)
+		feed.Called = append(feed.Called, c)
+	}
+
+	// urgency enum is declared from least to most urgent, so DESC puts red first
+	q = `SELECT r.ticket, r.urgency, r.issued_at
+	FROM report r LEFT JOIN consultation c on r.report_id = c.report_id
+	WHERE c.report_id IS NULL AND r.called_at IS NULL AND r.issued_at >= $1 AND NOT r.imported
+	AND ($3::INTEGER IS NULL OR r.facility_id = $3)
+	ORDER BY r.urgency DESC, r.issued_at
+	LIMIT $2`
+
+	rows, err = s.db.Query(context.Background(), q, now.Add(-24*time.Hour), DISPLAY_MAX_WAITING, facilityId)
+	if err != nil {
+		fmt.Println("db error:", err.Error())
+		return InternalError()
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t DisplayTicket
+		err := rows.Scan(&t.Ticket, &t.Urgency, &t.IssuedAt)
+		if err != nil {
+			fmt.Println("scan error:", err.Error())
+			return InternalError()
+		}
+
+		feed.Waiting = append(feed.Waiting, t)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, http.StatusOK, feed)
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/mail"
 	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
@@ -36,10 +37,21 @@ type EmployeeOutput struct {
 	Email string `json:"email"`
 	CPF   string `json:"cpf"`
 	Role  Role   `json:"role"`
+	MFAEnabled bool `json:"mfaEnabled"`
+	Status EmployeeStatus `json:"status"`
+	// name shown to patients and on documents, the name when not set
+	DisplayName string `json:"displayName"`
+	// council registration of clinical staff
+	Registration *ProfessionalRegistration `json:"registration"`
+	Specialties []string `json:"specialties"`
+	// facilities the employee works at, network-wide roles see every one
+	FacilityIds []int `json:"facilityIds"`
 }
 
 type RegisterResponse struct {
-	Token string     `json:"token"`
+	// only set when the account can be used right away, self registered
+	// employees wait for approval first
+	Token string     `json:"token,omitempty"`
 	Employee  EmployeeOutput `json:"employee"`
 }
 
@@ -48,39 +60,55 @@ type EmployeeLoginResponse struct {
 	Employee  EmployeeOutput `json:"employee"`
 }
 
-type RegisterRequest struct {
-	EmployeeInput
-}
+// bcrypt ignores anything past 72 bytes
+const MAX_PASSWORD_LENGTH = 72
 
-func (r RegisterRequest) validate() map[string][]string {
-	errs := make(map[string][]string)
+// validatePassword checks a new password against the password policy
+func validatePassword(password string) []string {
+	errs := make([]string, 0)
 
-	if len(r.Name) < 3 {
-		errs["name"] = append(errs["name"], "name must be at least 3 characters long")
+	if len(password) > MAX_PASSWORD_LENGTH {
+		errs = append(errs, "password must not exceed 72 characters")
 	}
 
-	if len(r.Password) > 72 {
-		errs["password"] = append(errs["password"], "password must not exceed 72 characters")
+	if len(password) < 12 {
+		errs = append(errs, "password must be at least 12 characters long")
+	}
+
+	if !ContainsNumber(password) {
+		errs = append(errs, "password must contain a number")
 	}
 
-	if len(r.Password) < 12 {
-		errs["password"] = append(errs["password"], "password must be at least 12 characters long")
+	if !ContainsLowerCaseLetter(password) {
+		errs = append(errs, "password must contain a lower case letter")
 	}
 
-	if !ContainsNumber(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain a number")
+	if !ContainsUpperCaseLetter(password) {
+		errs = append(errs, "password must contain an upper case letter")
 	}
 
-	if !ContainsLowerCaseLetter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain a lower case letter")
+	if !ContainsSpecialCharacter(password) {
+		errs = append(errs, "password must contain at least 1 special character")
 	}
 
-	if !ContainsUpperCaseLetter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain an upper case letter")
+	return errs
+}
+
+type RegisterRequest struct {
+	EmployeeInput
+	// registers with the invited role without waiting for approval
+	InvitationToken string `json:"invitationToken"`
+}
+
+func (r RegisterRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Name) < 3 {
+		errs["name"] = append(errs["name"], "name must be at least 3 characters long")
 	}
 
-	if !ContainsSpecialCharacter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain at least 1 special character")
+	if pwErrs := validatePassword(r.Password); len(pwErrs) > 0 {
+		errs["password"] = pwErrs
 	}
 
 	_, err := mail.ParseAddress(r.Email)
@@ -103,28 +131,14 @@ type LoginRequest struct {
 func (r LoginRequest) validate() map[string][]string {
 	errs := make(map[string][]string)
 
-	if len(r.Password) > 72 {
-		errs["password"] = append(errs["password"], "password must not exceed 72 characters")
-	}
-
-	if len(r.Password) < 12 {
-		errs["password"] = append(errs["password"], "password must be at least 12 characters long")
-	}
-
-	if !ContainsNumber(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain a number")
-	}
-
-	if !ContainsLowerCaseLetter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain a lower case letter")
-	}
-
-	if !ContainsUpperCaseLetter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain an upper case letter")
+	// the policy only applies to new passwords, accounts created before it
+	// changed must still be able to log in
+	if len(r.Password) == 0 {
+		errs["password"] = append(errs["password"], "password missing")
 	}
 
-	if !ContainsSpecialCharacter(r.Password) {
-		errs["password"] = append(errs["password"], "password must contain at least 1 special character")
+	if len(r.Password) > MAX_PASSWORD_LENGTH {
+		errs["password"] = append(errs["password"], "password must not exceed 72 characters")
 	}
 
 	_, err := mail.ParseAddress(r.Email)
@@ -151,22 +165,45 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) error {
 		return NewAPIError(http.StatusUnprocessableEntity, errs)
 	}
 
-	q := `SELECT u.password_hash, u.employee_id FROM employee u WHERE u.email = $1`
+	// checked before bcrypt so a locked account costs nothing to refuse
+	if wait := s.logins.locked(req.Email); wait > 0 {
+		return TooManyRequests(wait)
+	}
+
+	// employees provisioned through single sign-on have no password
+	q := `SELECT COALESCE(u.password_hash, ''), u.employee_id, u.token_version FROM employee u WHERE u.email = $1`
 	row := s.db.QueryRow(context.Background(), q, req.Email)
 
 	var storedHash string
-	var id int
-	err = row.Scan(&storedHash, &id)
+	var id, tokenVersion int
+	err = row.Scan(&storedHash, &id, &tokenVersion)
 	if err != nil {
+		s.logins.fail(req.Email)
 		return NewAPIError(http.StatusUnauthorized, "authentication attempt failed")
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password))
 	if err != nil {
+		s.logins.fail(req.Email)
 		return NewAPIError(http.StatusUnauthorized, "authentication attempt failed")
 	}
+	s.logins.succeed(req.Email)
+
+	session, err := s.getEmployeeSession(id)
+	if err != nil {
+		return err
+	}
+
+	if err := employeeStatusError(session.Status); err != nil {
+		return err
+	}
+
+	// the JWT is only issued once the second factor is verified, see mfa.go
+	if session.MFAEnabled || session.RequireMFA {
+		return s.writeMFAChallenge(w, id, session)
+	}
 
-	jwt, err := createJWT(id)
+	jwt, err := createJWT(id, tokenVersion)
 	if err != nil {
 		return err
 	}
@@ -187,17 +224,27 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return RequestBodyParsingError(err)
 	}
+	req.CPF = NormalizeCPF(req.CPF)
 
 	errs := req.validate()
+	if req.InvitationToken == "" {
+		if !s.registration.SelfRegistration {
+			return NewAPIError(http.StatusForbidden, "self registration is disabled, an invitation is required")
+		}
+
+		if !s.registration.allowsEmail(req.Email) {
+			errs["email"] = append(errs["email"], "email domain is not allowed")
+		}
+	}
 	if len(errs) > 0 {
 		return NewAPIError(http.StatusUnprocessableEntity, errs)
 	}
 
 	// Ensure email and cpf are not taken
 	q := `SELECT 1 FROM employee e
-	WHERE e.email = $1 OR e.cpf = $2 LIMIT 1`
+	WHERE e.email = $1 OR e.cpf_hash = $2 LIMIT 1`
 
-	row := s.db.QueryRow(context.Background(), q, req.Email, req.CPF)
+	row := s.db.QueryRow(context.Background(), q, req.Email, blindIndex(req.CPF))
 	err = row.Scan(nil)
 	if err == nil {
 		return NewAPIError(http.StatusConflict, "employee with this email or cpf already exists")
@@ -211,13 +258,30 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	hash := string(hashBytes)
-	
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	status := EmployeePending
+	var invitationId, roleId int
+	if req.InvitationToken != "" {
+		invitationId, roleId, err = acceptInvitation(ctx, tx, req.InvitationToken, req.Email)
+		if err != nil {
+			return err
+		}
+		status = EmployeeActive
+	}
+
 	q = `
-	INSERT INTO employee(name, email, cpf, password_hash)
-	VALUES($1, $2, $3, $4) RETURNING employee_id
+	INSERT INTO employee(name, email, cpf, cpf_hash, password_hash, status)
+	VALUES($1, $2, $3, $4, $5, $6) RETURNING employee_id
 	`
 
-	row = s.db.QueryRow(context.Background(), q, req.Name, req.Email, req.CPF, hash)
+	row = tx.QueryRow(ctx, q, req.Name, req.Email, sealed(SEALED_EMPLOYEE_CPF, req.CPF), blindIndex(req.CPF), hash, status)
 
 	var newEntryId int
 	err = row.Scan(&newEntryId)
@@ -225,27 +289,59 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	emp, err := s.getEmployee(newEntryId)
-	if err != nil {
+	if invitationId != 0 {
+		q = `UPDATE employee SET role_id = $1,
+	token_version = token_version + CASE WHEN role_id = $1 THEN 0 ELSE 1 END
+	WHERE employee_id = $2`
+		if _, err := tx.Exec(ctx, q, roleId, newEntryId); err != nil {
+			return err
+		}
+
+		q = `UPDATE employee_invitation SET employee_id = $1 WHERE invitation_id = $2`
+		if _, err := tx.Exec(ctx, q, newEntryId, invitationId); err != nil {
+			return err
+		}
+
+		q = `INSERT INTO employee_facility(employee_id, facility_id)
+		SELECT $1, unnest(facility_ids) FROM employee_invitation WHERE invitation_id = $2`
+		if _, err := tx.Exec(ctx, q, newEntryId, invitationId); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return err
 	}
 
-	jwt, err := createJWT(emp.Id)
+	emp, err := s.getEmployee(newEntryId)
 	if err != nil {
 		return err
 	}
 
 	response := RegisterResponse{
-		Token: jwt,
 		Employee: emp,
 	}
+
+	// roles requiring MFA enroll through the login instead
+	if emp.Status == EmployeeActive && !emp.Role.RequireMFA {
+		response.Token, err = createJWT(emp.Id, 0)
+		if err != nil {
+			return err
+		}
+	}
 	
 	return writeJSON(w, http.StatusCreated, response)
 }
 
 func (s *Server) handleGetEmployees(w http.ResponseWriter, r *http.Request) error {
-	q := `SELECT e.employee_id, e.name, e.email, e.cpf, r.role_id, r.name, r.access_allowed
-	FROM employee e JOIN employee_role r on e.role_id = r.role_id`
+	q := `SELECT ` + employeeColumns + ` FROM employee e JOIN employee_role r on e.role_id = r.role_id
+	WHERE ($1 OR EXISTS (SELECT 1 FROM employee_facility ef
+	WHERE ef.employee_id = e.employee_id AND ef.facility_id = ANY($2)))`
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
 
 	queryParams := r.URL.Query()
 	accessAllowedFilter, err := strconv.ParseBool(queryParams.Get("accessAllowed"))
@@ -253,14 +349,14 @@ func (s *Server) handleGetEmployees(w http.ResponseWriter, r *http.Request) erro
 	var rows pgx.Rows
 	// err means there is no filter applied
 	if err != nil {
-		rows, err = s.db.Query(context.Background(), q)
+		rows, err = s.db.Query(context.Background(), q, scope.all, scope.ids)
 		if err != nil {
 			fmt.Println("db error:", err.Error())
 			return InternalError()
 		}
 	} else {
-		q += " AND r.access_allowed = $1"
-		rows, err = s.db.Query(context.Background(), q, accessAllowedFilter)
+		q += " AND r.access_allowed = $3"
+		rows, err = s.db.Query(context.Background(), q, scope.all, scope.ids, accessAllowedFilter)
 		if err != nil {
 			fmt.Println("db error:", err.Error())
 			return InternalError()
@@ -271,7 +367,7 @@ func (s *Server) handleGetEmployees(w http.ResponseWriter, r *http.Request) erro
 
 	for rows.Next() {
 		var emp EmployeeOutput
-		err := rows.Scan(&emp.Id, &emp.Name, &emp.Email, &emp.CPF, &emp.Role.Id, &emp.Role.Name, &emp.Role.AccessAllowed)
+		err := scanEmployee(rows, &emp)
 	if err != nil {
 			fmt.Println("scan error:", err.Error())
 			return InternalError()
@@ -289,6 +385,10 @@ func (s *Server) handleGetEmployeeById(w http.ResponseWriter, r *http.Request) e
 		return BadRequest()
 	}
 
+	if err := s.requireEmployeeFacility(r, id); err != nil {
+		return err
+	}
+
 	emp, err := s.getEmployee(id)
 	if err != nil {
 		return NewAPIError(http.StatusNotFound, "employee does not exist")
@@ -297,12 +397,31 @@ func (s *Server) handleGetEmployeeById(w http.ResponseWriter, r *http.Request) e
 	return writeJSON(w, http.StatusOK, emp)
 }
 
+// handlePatchEmployeePermissions changes the role of an employee, their
+// sessions end when it actually changes so the new permissions apply at once
 func (s *Server) handlePatchEmployeePermissions(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
 	employeeId, err := getPathId("id", r)
 	if err != nil {
 		return BadRequest()
 	}
 
+	requesterId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	if employeeId == requesterId {
+		return NewAPIError(http.StatusConflict, "employees can't change their own role")
+	}
+
+	if err := s.requireEmployeeFacility(r, employeeId); err != nil {
+		return err
+	}
+
 	var req PatchEmployeeRequest
 	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -316,7 +435,17 @@ func (s *Server) handlePatchEmployeePermissions(w http.ResponseWriter, r *http.R
 		return NewAPIError(http.StatusBadRequest, "selected role does not exist")
 	}
 
-	q = `UPDATE employee SET role_id = $1 WHERE employee_id = $2`
+	assignable, err := s.canAssignRole(r, req.RoleId)
+	if err != nil {
+		return err
+	}
+	if !assignable {
+		return NewAPIError(http.StatusForbidden, "selected role has permissions you don't have")
+	}
+
+	q = `UPDATE employee SET role_id = $1,
+	token_version = token_version + CASE WHEN role_id = $1 THEN 0 ELSE 1 END
+	WHERE employee_id = $2`
 
 	_, err = s.db.Exec(context.Background(), q, req.RoleId, employeeId)
 	if err != nil {
@@ -331,9 +460,156 @@ func (s *Server) handlePatchEmployeePermissions(w http.ResponseWriter, r *http.R
 	return writeJSON(w, http.StatusOK, emp)
 }
 
+// handleDeactivateEmployee is the soft delete of employees, the row stays so
+// consultations still show who attended. Every session of the employee ends.
+func (s *Server) handleDeactivateEmployee(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	requesterId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	if employeeId == requesterId {
+		return NewAPIError(http.StatusConflict, "employees can't deactivate themselves")
+	}
+
+	if err := s.requireEmployeeFacility(r, employeeId); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE employee SET status = $1, deactivated_at = $2, token_version = token_version + 1
+	WHERE employee_id = $3 AND status = $4`
+
+	tag, err := tx.Exec(ctx, q, EmployeeDeactivated, time.Now(), employeeId, EmployeeActive)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return s.employeeStatusConflict(employeeId, "employee is not active")
+	}
+
+	q = `DELETE FROM password_reset WHERE employee_id = $1 AND used_at IS NULL`
+	if _, err := tx.Exec(ctx, q, employeeId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+func (s *Server) handleReactivateEmployee(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	if err := s.requireEmployeeFacility(r, employeeId); err != nil {
+		return err
+	}
+
+	q := `UPDATE employee SET status = $1, deactivated_at = NULL
+	WHERE employee_id = $2 AND status = $3`
+
+	tag, err := s.db.Exec(context.Background(), q, EmployeeActive, employeeId, EmployeeDeactivated)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return s.employeeStatusConflict(employeeId, "employee is not deactivated")
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+// employeeStatusConflict is the error of a status change that matched no
+// row, either the employee does not exist or is in another status
+func (s *Server) employeeStatusConflict(employeeId int, msg string) error {
+	q := `SELECT 1 FROM employee WHERE employee_id = $1`
+	err := s.db.QueryRow(context.Background(), q, employeeId).Scan(nil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NewAPIError(http.StatusNotFound, "employee does not exist")
+	}
+	if err != nil {
+		return err
+	}
+
+	return NewAPIError(http.StatusConflict, msg)
+}
+
+// employeeStatusError tells why an employee that authenticated can't log in
+func employeeStatusError(status EmployeeStatus) error {
+	switch status {
+	case EmployeePending:
+		return NewAPIError(http.StatusForbidden, "account is awaiting approval")
+	case EmployeeRejected:
+		return NewAPIError(http.StatusForbidden, "account registration was rejected")
+	case EmployeeDeactivated:
+		return NewAPIError(http.StatusForbidden, "account is deactivated")
+	}
+
+	return nil
+}
+
+type EmployeeSession struct {
+	AccessAllowed bool
+	// tokens must carry it, bumped whenever credentials change
+	TokenVersion int
+	RequireMFA   bool
+	MFAEnabled   bool
+	Status       EmployeeStatus
+}
+
+func (s *Server) getEmployeeSession(employeeId int) (EmployeeSession, error) {
+	q := `
+	SELECT r.access_allowed, e.token_version, r.require_mfa, e.totp_enabled_at IS NOT NULL, e.status
+	FROM employee e JOIN employee_role r ON e.role_id = r.role_id
+	WHERE e.employee_id = $1
+	`
+	row := s.db.QueryRow(context.Background(), q, employeeId)
+
+	var session EmployeeSession
+	err := row.Scan(&session.AccessAllowed, &session.TokenVersion, &session.RequireMFA, &session.MFAEnabled, &session.Status)
+
+	return session, err
+}
+
 func (s *Server) getEmployeeAccess(employeeId int) (bool, error) {
 	q := `
-	SELECT r.access_allowed FROM employee e
+	SELECT r.access_allowed AND e.status = 'active' FROM employee e
 	JOIN employee_role r ON e.role_id = r.role_id
 	WHERE e.employee_id = $1
 	`
@@ -348,15 +624,34 @@ func (s *Server) getEmployeeAccess(employeeId int) (bool, error) {
 	return accessAllowed, nil
 }
 
+// employeeColumns are read by scanEmployee, e is the employee and r its role
+const employeeColumns = `e.employee_id, e.name, e.email, e.cpf, r.role_id, r.name, r.access_allowed, r.permissions,
+	r.require_mfa, e.totp_enabled_at IS NOT NULL, e.status, COALESCE(e.display_name, e.name), e.specialties,
+	e.council, e.council_number, e.council_state, e.council_verified_at IS NOT NULL,
+	ARRAY(SELECT ef.facility_id FROM employee_facility ef WHERE ef.employee_id = e.employee_id ORDER BY ef.facility_id)`
+
+func scanEmployee(row pgx.Row, emp *EmployeeOutput) error {
+	var council, number, state *string
+	var verified bool
+	err := row.Scan(&emp.Id, &emp.Name, &emp.Email, unseal(SEALED_EMPLOYEE_CPF, &emp.CPF), &emp.Role.Id, &emp.Role.Name, &emp.Role.AccessAllowed, &emp.Role.Permissions,
+		&emp.Role.RequireMFA, &emp.MFAEnabled, &emp.Status, &emp.DisplayName, &emp.Specialties,
+		&council, &number, &state, &verified, &emp.FacilityIds)
+	if err != nil {
+		return err
+	}
+
+	emp.Registration = scannedRegistration(council, number, state, verified)
+	return nil
+}
+
 func (s *Server) getEmployee(id int) (EmployeeOutput, error) {
-	q := `SELECT e.employee_id, e.name, e.email, e.cpf, r.role_id, r.name, r.access_allowed
-	FROM employee e JOIN employee_role r on e.role_id = r.role_id
+	q := `SELECT ` + employeeColumns + ` FROM employee e JOIN employee_role r on e.role_id = r.role_id
 	WHERE e.employee_id = $1`
 
 	row := s.db.QueryRow(context.Background(), q, id)
 
 	var emp EmployeeOutput
-	err := row.Scan(&emp.Id, &emp.Name, &emp.Email, &emp.CPF, &emp.Role.Id, &emp.Role.Name, &emp.Role.AccessAllowed)
+	err := scanEmployee(row, &emp)
 	if err != nil {
 		fmt.Println(err)
 	}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type APIError struct {
 	StatusCode int `json:"-"`
 	Msg        any `json:"message"`
+	// extra response headers, like Retry-After
+	Headers map[string]string `json:"-"`
 }
 
 func (e APIError) Error() string {
@@ -70,6 +75,15 @@ func AccessNotAllowed() APIError {
 	}
 }
 
+func TooManyRequests(retryAfter time.Duration) APIError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	return APIError{
+		StatusCode: http.StatusTooManyRequests,
+		Msg: "too many requests, try again later",
+		Headers: map[string]string{"Retry-After": strconv.Itoa(max(seconds, 1))},
+	}
+}
+
 func NotImplemented() APIError {
 	return APIError{
 		StatusCode: http.StatusNotImplemented,
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	ExportCSV  ExportFormat = "csv"
+	ExportXLSX ExportFormat = "xlsx"
+)
+
+// tableWriter writes a spreadsheet one row at a time. Cells are nil, strings,
+// ints, float64s or times.
+type tableWriter interface {
+	writeRow(cells []any) error
+	close() error
+}
+
+// escapeFormula keeps spreadsheets from running text as a formula, e.g. a
+// patient named =HYPERLINK(...), by prefixing it with a quote
+func escapeFormula(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+
+	return v
+}
+
+func formatCell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return escapeFormula(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		// read as a date by spreadsheets, unlike RFC 3339
+		return v.Local().Format(time.DateTime)
+	}
+
+	return escapeFormula(fmt.Sprint(v))
+}
+
+type csvTableWriter struct {
+	w *csv.Writer
+}
+
+func (t csvTableWriter) writeRow(cells []any) error {
+	record := make([]string, len(cells))
+	for i, c := range cells {
+		record[i] = formatCell(c)
+	}
+
+	return t.w.Write(record)
+}
+
+func (t csvTableWriter) close() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`</Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+	`<sheets><sheet name="%s" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`</Relationships>`
+
+const xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+
+const xlsxSheetEnd = `</sheetData></worksheet>`
+
+// xlsxTableWriter streams a single sheet workbook. The zip entries are
+// written as they go, so memory stays constant however many rows there are.
+// Strings are written inline instead of to a shared string table, which
+// would have to be kept until the end.
+type xlsxTableWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+}
+
+func newXLSXTableWriter(w io.Writer, sheetName string) (*xlsxTableWriter, error) {
+	z := zip.NewWriter(w)
+
+	var name strings.Builder
+	xml.EscapeText(&name, []byte(sheetName))
+
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, name.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, p := range parts {
+		f, err := z.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, p.content); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	t := &xlsxTableWriter{zip: z, sheet: bufio.NewWriter(f)}
+	_, err = t.sheet.WriteString(xlsxSheetStart)
+	return t, err
+}
+
+func (t *xlsxTableWriter) writeRow(cells []any) error {
+	t.sheet.WriteString("<row>")
+	for _, c := range cells {
+		switch v := c.(type) {
+		case nil:
+			t.sheet.WriteString("<c/>")
+		case int, float64:
+			t.sheet.WriteString("<c><v>" + formatCell(v) + "</v></c>")
+		default:
+			t.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			// invalid XML characters are replaced, not escaped
+			xml.EscapeText(t.sheet, []byte(formatCell(v)))
+			t.sheet.WriteString("</t></is></c>")
+		}
+	}
+	_, err := t.sheet.WriteString("</row>")
+
+	return err
+}
+
+func (t *xlsxTableWriter) close() error {
+	if _, err := t.sheet.WriteString(xlsxSheetEnd); err != nil {
+		return err
+	}
+	if err := t.sheet.Flush(); err != nil {
+		return err
+	}
+
+	return t.zip.Close()
+}
+
+// newTableWriter sets the headers of the download and picks the writer of
+// the format
+func newTableWriter(w http.ResponseWriter, format ExportFormat, name string) (tableWriter, error) {
+	switch format {
+	case ExportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		return csvTableWriter{w: csv.NewWriter(w)}, nil
+	case ExportXLSX:
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, name))
+		return newXLSXTableWriter(w, name)
+	}
+
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+var reportExportHeader = []any{
+	"report_id", "issued_at", "facility_id", "facility", "test",
+	"patient_id", "patient_name", "cpf", "alt_id_type", "alt_id", "sex", "date_of_birth",
+	"weight", "height", "heart_rate", "systolic_pressure", "diastolic_pressure",
+	"temperature", "oxygen_saturation",
+	"urgency", "suggested_urgency", "ticket", "called_at", "called_room",
+	"consultation_date", "doctor_id", "doctor_name",
+}
+
+// handleExportReports streams the reports of the listing, with the same
+// filters, as a spreadsheet. Interviews and diseases are left out, only the
+// patient, vitals, triage and consultation columns are exported.
+func (s *Server) handleExportReports(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermExportReports); err != nil {
+		return err
+	}
+
+	format := ExportFormat(r.URL.Query().Get("format"))
+	if format == "" {
+		format = ExportCSV
+	}
+	if format != ExportCSV && format != ExportXLSX {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"format": {fmt.Sprintf("format must be %s or %s", ExportCSV, ExportXLSX)},
+		})
+	}
+
+	filter, err := s.parseReportFilter(r)
+	if err != nil {
+		return err
+	}
+
+	maskIds := !s.requestHasPermission(r, PermViewIdentifiers)
+
+	q := `SELECT r.report_id, r.issued_at, r.facility_id, f.name, r.test,
+	p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth,
+	r.weight, r.height, r.heart_rate, r.systolic_pressure, r.diastolic_pressure,
+	r.temperature, r.oxygen_saturation,
+	r.urgency, r.suggested_urgency, r.ticket, r.called_at, r.called_room,
+	c.consultation_date, c.doctor_id, COALESCE(e.display_name, e.name)
+	FROM report r JOIN patient p ON r.patient_id = p.patient_id
+	JOIN facility f ON f.facility_id = r.facility_id
+	LEFT JOIN consultation c ON r.report_id = c.report_id
+	LEFT JOIN employee e ON e.employee_id = c.doctor_id
+	WHERE ` + reportFilterSQL + `
+	ORDER BY r.issued_at, r.report_id`
+
+	rows, err := s.db.Query(context.Background(), q, filter.args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.auditRequest(r, AuditExportReports, nil, nil)
+
+	out, err := newTableWriter(w, format, "reports")
+	if err != nil {
+		return err
+	}
+
+	// the status is sent with the first row, errors after it can only cut
+	// the download short so that it is not mistaken for a complete file
+	abort := func(err error) error {
+		fmt.Println("export error:", err.Error())
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := out.writeRow(reportExportHeader); err != nil {
+		return abort(err)
+	}
+
+	for rows.Next() {
+		var rep ReportOutput
+		var facility string
+		var test bool
+		var doctorId *int
+		var doctorName *string
+		var consultationDate *time.Time
+
+		err := rows.Scan(&rep.Id, &rep.IssuedAt, &rep.FacilityId, &facility, &test,
+			&rep.Patient.Id, &rep.Patient.Name, unseal(SEALED_PATIENT_CPF, &rep.Patient.CPF),
+			&rep.Patient.AltIdType, &rep.Patient.AltId, &rep.Patient.Sex, &rep.Patient.DateOfBirth,
+			&rep.Weight, &rep.Height, &rep.HeartRate, &rep.SystolicPressure, &rep.DiastolicPressure,
+			&rep.Temperature, &rep.OxygenSaturation,
+			&rep.Urgency, &rep.SuggestedUrgency, &rep.Ticket, &rep.CalledAt, &rep.CalledRoom,
+			&consultationDate, &doctorId, &doctorName)
+		if err != nil {
+			return abort(err)
+		}
+
+		if maskIds {
+			rep.Patient.maskIdentifiers()
+		}
+
+		var dateOfBirth any
+		if rep.Patient.DateOfBirth != nil {
+			dateOfBirth = rep.Patient.DateOfBirth.Format(time.DateOnly)
+		}
+
+		err = out.writeRow([]any{
+			rep.Id, rep.IssuedAt, rep.FacilityId, facility, strconv.FormatBool(test),
+			rep.Patient.Id, rep.Patient.Name, cell(rep.Patient.CPF), cell(rep.Patient.AltIdType),
+			cell(rep.Patient.AltId), cell(rep.Patient.Sex), dateOfBirth,
+			cell(rep.Weight), cell(rep.Height), cell(rep.HeartRate), cell(rep.SystolicPressure),
+			cell(rep.DiastolicPressure), cell(rep.Temperature), cell(rep.OxygenSaturation),
+			string(rep.Urgency), string(rep.SuggestedUrgency), rep.Ticket, cell(rep.CalledAt), cell(rep.CalledRoom),
+			cell(consultationDate), cell(doctorId), cell(doctorName),
+		})
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return abort(err)
+	}
+
+	if err := out.close(); err != nil {
+		return abort(err)
+	}
+
+	return nil
+}
+
+// cell dereferences the nullable columns, float32 vitals are written with the
+// precision they were given in
+func cell[T any](v *T) any {
+	if v == nil {
+		return nil
+	}
+
+	switch v := any(*v).(type) {
+	case float32:
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'f', -1, 32), 64)
+		return f
+	case AltIdType:
+		return string(v)
+	case Sex:
+		return string(v)
+	}
+
+	return *v
+}
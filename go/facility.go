@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Facilities are the units of the network (hospitals, clinics, emergency
+// rooms). Reports and kiosks belong to one, employees to any number of them
+// and only see the reports, patients and colleagues of their own.
+type Facility struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type FacilityRequest struct {
+	Name string `json:"name"`
+}
+
+func (r FacilityRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Name) == 0 {
+		errs["name"] = append(errs["name"], "name missing")
+	}
+
+	if len(r.Name) > 100 {
+		errs["name"] = append(errs["name"], "name must not exceed 100 characters")
+	}
+
+	return errs
+}
+
+type SetEmployeeFacilitiesRequest struct {
+	FacilityIds []int `json:"facilityIds"`
+}
+
+// facilityScope is what a request may see, every facility for network-wide
+// roles and the employee's own ones otherwise. Queries take both fields as
+// ($1 OR x.facility_id = ANY($2)).
+type facilityScope struct {
+	all bool
+	ids []int
+}
+
+func (sc facilityScope) contains(facilityId int) bool {
+	return sc.all || slices.Contains(sc.ids, facilityId)
+}
+
+// requestFacilities is the scope of the authenticated employee, narrowed to a
+// single facility by the facilityId query parameter
+func (s *Server) requestFacilities(r *http.Request) (facilityScope, error) {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return facilityScope{}, InvalidToken()
+	}
+
+	scope := facilityScope{ids: make([]int, 0)}
+	if s.requestHasPermission(r, PermAllFacilities) {
+		scope.all = true
+	} else {
+		scope.ids, err = s.getEmployeeFacilities(employeeId)
+		if err != nil {
+			return scope, err
+		}
+	}
+
+	if v := r.URL.Query().Get("facilityId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return scope, BadRequest()
+		}
+
+		if !scope.contains(id) {
+			return scope, AccessNotAllowed()
+		}
+
+		return facilityScope{ids: []int{id}}, nil
+	}
+
+	return scope, nil
+}
+
+func (s *Server) getEmployeeFacilities(employeeId int) ([]int, error) {
+	q := `SELECT facility_id FROM employee_facility WHERE employee_id = $1 ORDER BY facility_id`
+
+	rows, err := s.db.Query(context.Background(), q, employeeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+// requireReportFacility hides reports of other facilities as if they did not
+// exist
+func (s *Server) requireReportFacility(r *http.Request, reportId int) error {
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT 1 FROM report r WHERE r.report_id = $1 AND ($2 OR r.facility_id = ANY($3))`
+	err = s.db.QueryRow(context.Background(), q, reportId, scope.all, scope.ids).Scan(nil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NewAPIError(http.StatusNotFound, "report does not exist")
+	}
+
+	return err
+}
+
+// requirePatientFacility lets through patients with at least one report in
+// the facilities of the request
+func (s *Server) requirePatientFacility(r *http.Request, patientId int) error {
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT 1 FROM patient p WHERE p.patient_id = $1 AND ($2 OR EXISTS (
+		SELECT 1 FROM report r WHERE r.patient_id = p.patient_id AND r.facility_id = ANY($3)))`
+	err = s.db.QueryRow(context.Background(), q, patientId, scope.all, scope.ids).Scan(nil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NewAPIError(http.StatusNotFound, "patient does not exist")
+	}
+
+	return err
+}
+
+// requireEmployeeFacility lets through employees sharing a facility with the
+// request
+func (s *Server) requireEmployeeFacility(r *http.Request, employeeId int) error {
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT 1 FROM employee e WHERE e.employee_id = $1 AND ($2 OR EXISTS (
+		SELECT 1 FROM employee_facility ef WHERE ef.employee_id = e.employee_id AND ef.facility_id = ANY($3)))`
+	err = s.db.QueryRow(context.Background(), q, employeeId, scope.all, scope.ids).Scan(nil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return NewAPIError(http.StatusNotFound, "employee does not exist")
+	}
+
+	return err
+}
+
+// validateFacilities checks that every facility exists and can be handed out
+// by the request
+func (s *Server) validateFacilities(scope facilityScope, ids []int) []string {
+	errs := make([]string, 0)
+
+	for _, id := range ids {
+		if !scope.contains(id) {
+			errs = append(errs, "facilities must be among your own")
+			break
+		}
+	}
+
+	distinct := slices.Compact(slices.Sorted(slices.Values(ids)))
+
+	q := `SELECT COUNT(*) FROM facility WHERE facility_id = ANY($1)`
+	var found int
+	if err := s.db.QueryRow(context.Background(), q, distinct).Scan(&found); err != nil || found != len(distinct) {
+		errs = append(errs, "selected facility does not exist")
+	}
+
+	return errs
+}
+
+// defaultFacility is the facility of reports and interviews sent without
+// one, which only works while there is a single facility
+func (s *Server) defaultFacility() (int, bool) {
+	q := `SELECT MIN(facility_id), COUNT(*) FROM facility`
+
+	var id *int
+	var count int
+	if err := s.db.QueryRow(context.Background(), q).Scan(&id, &count); err != nil || count != 1 {
+		return 0, false
+	}
+
+	return *id, true
+}
+
+// intakeFacility is where a report or interview is taken: the facility of
+// the kiosk sending it, else the one requested by an employee of it, else the
+// only facility. Anonymous requests can't pick a facility, anyone could fill
+// the queue of any facility otherwise.
+func (s *Server) intakeFacility(r *http.Request, requested *int) (int, error) {
+	if token := r.Header.Get("X-Kiosk-Token"); token != "" {
+		_, facilityId, err := s.activeKiosk(token)
+		if err == nil {
+			return facilityId, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, err
+		}
+	}
+
+	defaultId, hasDefault := s.defaultFacility()
+
+	if requested != nil {
+		if _, err := getIdFromToken(r); err == nil {
+			scope, err := s.requestFacilities(r)
+			if err != nil {
+				return 0, err
+			}
+
+			if errs := s.validateFacilities(scope, []int{*requested}); len(errs) > 0 {
+				return 0, NewAPIError(http.StatusUnprocessableEntity, map[string][]string{"facilityId": errs})
+			}
+
+			return *requested, nil
+		}
+
+		if !hasDefault || *requested != defaultId {
+			return 0, NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+				"facilityId": {"only employees may choose the facility, kiosks send their token"},
+			})
+		}
+	}
+
+	if hasDefault {
+		return defaultId, nil
+	}
+
+	return 0, NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+		"facilityId": {"facility missing"},
+	})
+}
+
+func (s *Server) handleGetFacilities(w http.ResponseWriter, r *http.Request) error {
+	q := `SELECT facility_id, name, created_at FROM facility ORDER BY facility_id`
+
+	rows, err := s.db.Query(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	facilities := make([]Facility, 0)
+	for rows.Next() {
+		var f Facility
+		if err := rows.Scan(&f.Id, &f.Name, &f.CreatedAt); err != nil {
+			return err
+		}
+		facilities = append(facilities, f)
+	}
+
+	return writeJSON(w, http.StatusOK, facilities)
+}
+
+func (s *Server) handleCreateFacility(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageFacilities); err != nil {
+		return err
+	}
+
+	var req FacilityRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	f := Facility{Name: req.Name, CreatedAt: time.Now()}
+
+	q := `INSERT INTO facility(name, created_at) VALUES($1, $2) RETURNING facility_id`
+	err = s.db.QueryRow(context.Background(), q, f.Name, f.CreatedAt).Scan(&f.Id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, f)
+}
+
+func (s *Server) handleUpdateFacility(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageFacilities); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req FacilityRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	q := `UPDATE facility SET name = $1 WHERE facility_id = $2 RETURNING facility_id, name, created_at`
+
+	var f Facility
+	err = s.db.QueryRow(context.Background(), q, req.Name, id).Scan(&f.Id, &f.Name, &f.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "facility does not exist")
+		}
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, f)
+}
+
+// handleSetEmployeeFacilities replaces the facilities of the employee within
+// the scope of the request, memberships elsewhere are left alone
+func (s *Server) handleSetEmployeeFacilities(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req SetEmployeeFacilitiesRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	if errs := s.validateFacilities(scope, req.FacilityIds); len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{"facilityIds": errs})
+	}
+
+	// employees of other facilities, or of none yet, are only moved by
+	// network-wide roles
+	if !s.requestHasPermission(r, PermAllFacilities) {
+		if err := s.requireEmployeeFacility(r, employeeId); err != nil {
+			return err
+		}
+
+		current, err := s.getEmployeeFacilities(employeeId)
+		if err != nil {
+			return err
+		}
+		for _, id := range current {
+			if !scope.contains(id) {
+				return NewAPIError(http.StatusForbidden, "employee also works at facilities that are not yours")
+			}
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setEmployeeFacilities(ctx, tx, employeeId, scope, req.FacilityIds); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "employee does not exist")
+		}
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+// setEmployeeFacilities replaces the memberships of the employee that fall in
+// scope with ids
+func setEmployeeFacilities(ctx context.Context, tx pgx.Tx, employeeId int, scope facilityScope, ids []int) error {
+	q := `SELECT 1 FROM employee WHERE employee_id = $1`
+	if err := tx.QueryRow(ctx, q, employeeId).Scan(nil); err != nil {
+		return err
+	}
+
+	q = `DELETE FROM employee_facility WHERE employee_id = $1 AND ($2 OR facility_id = ANY($3))`
+	if _, err := tx.Exec(ctx, q, employeeId, scope.all, scope.ids); err != nil {
+		return err
+	}
+
+	q = `INSERT INTO employee_facility(employee_id, facility_id) SELECT $1, unnest($2::INTEGER[])
+	ON CONFLICT DO NOTHING`
+	_, err := tx.Exec(ctx, q, employeeId, ids)
+	return err
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// rows committed together, a failing batch loses no more than this
+	IMPORT_BATCH_SIZE = 500
+	// row errors listed in the result, the rest are only counted
+	IMPORT_MAX_ERRORS = 1000
+	// separates the items of medications, allergies and diseases
+	IMPORT_LIST_SEPARATOR = ";"
+	// ticket of imported reports, report_ticket_seq starts at 1 so it is
+	// never handed out to a patient waiting
+	IMPORT_TICKET = "000"
+)
+
+// importErrorColumns maps the keys of the request validation errors to the
+// columns of the file, keys missing here are the same in both
+var importErrorColumns = map[string]string{
+	"altIdType":         "alt_id_type",
+	"altId":             "alt_id",
+	"dateOfBirth":       "date_of_birth",
+	"heartRate":         "heart_rate",
+	"systolicPressure":  "systolic_pressure",
+	"diastolicPressure": "diastolic_pressure",
+	"saturation":        "oxygen_saturation",
+}
+
+var importPatientColumns = []string{"name", "cpf", "alt_id_type", "alt_id", "sex", "date_of_birth"}
+
+var importReportColumns = append(slices.Clone(importPatientColumns),
+	"issued_at", "facility_id", "weight", "height", "heart_rate", "systolic_pressure",
+	"diastolic_pressure", "temperature", "oxygen_saturation", "occupation",
+	"medications", "allergies", "diseases", "language", "urgency")
+
+type ImportRowError struct {
+	// number of the record in the file, the header being 1
+	Row    int                 `json:"row"`
+	Errors map[string][]string `json:"errors"`
+}
+
+type ImportResult struct {
+	DryRun          bool             `json:"dryRun"`
+	Rows            int              `json:"rows"`
+	Failed          int              `json:"failed"`
+	PatientsCreated int              `json:"patientsCreated"`
+	PatientsMatched int              `json:"patientsMatched"`
+	ReportsCreated  int              `json:"reportsCreated"`
+	Errors          []ImportRowError `json:"errors"`
+}
+
+// importOutcome is what an imported row added, counted once the row is saved
+type importOutcome struct {
+	patientCreated bool
+	reportCreated  bool
+}
+
+// importRow reads the cells of a record by column name, parse errors are
+// collected like validation errors
+type importRow struct {
+	cells map[string]string
+	errs  map[string][]string
+}
+
+func (r importRow) str(col string) string {
+	return strings.TrimSpace(r.cells[col])
+}
+
+func (r importRow) optional(col string) *string {
+	if v := r.str(col); v != "" {
+		return &v
+	}
+	return nil
+}
+
+func (r importRow) integer(col string) *int {
+	v := r.str(col)
+	if v == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		r.errs[col] = append(r.errs[col], col+" must be a whole number")
+		return nil
+	}
+	return &n
+}
+
+// decimal accepts decimal commas, as Brazilian spreadsheets write them
+func (r importRow) decimal(col string) *float32 {
+	v := strings.Replace(r.str(col), ",", ".", 1)
+	if v == "" {
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(v, 32)
+	if err != nil {
+		r.errs[col] = append(r.errs[col], col+" must be a number")
+		return nil
+	}
+	n := float32(f)
+	return &n
+}
+
+func (r importRow) date(col string) *time.Time {
+	v := r.str(col)
+	if v == "" {
+		return nil
+	}
+
+	t, err := time.ParseInLocation(time.DateOnly, v, time.Local)
+	if err != nil {
+		r.errs[col] = append(r.errs[col], col+" must be a date (2006-01-02)")
+		return nil
+	}
+	return &t
+}
+
+// timestamp also accepts the times written by the report export
+func (r importRow) timestamp(col string) *time.Time {
+	v := r.str(col)
+	if v == "" {
+		return nil
+	}
+
+	if t, err := time.ParseInLocation(time.DateTime, v, time.Local); err == nil {
+		return &t
+	}
+	if t, ok := parseQueryTime(v); ok {
+		return &t
+	}
+
+	r.errs[col] = append(r.errs[col], col+" must be a date (2006-01-02), a time (2006-01-02 15:04:05) or an RFC 3339 time")
+	return nil
+}
+
+func (r importRow) list(col string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(r.str(col), IMPORT_LIST_SEPARATOR) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (r importRow) patient() PatientInput {
+	p := PatientInput{
+		Name:        r.str("name"),
+		CPF:         NormalizeCPF(r.str("cpf")),
+		AltId:       r.optional("alt_id"),
+		DateOfBirth: r.date("date_of_birth"),
+	}
+
+	if v := r.str("alt_id_type"); v != "" {
+		t := AltIdType(v)
+		p.AltIdType = &t
+	}
+
+	if v := r.str("sex"); v != "" {
+		sex := Sex(strings.ToUpper(v))
+		p.Sex = &sex
+	}
+
+	return p
+}
+
+// mergeErrors adds validation errors to the row's, keyed by column
+func mergeErrors(dst map[string][]string, src map[string][]string) {
+	for k, v := range src {
+		if col, ok := importErrorColumns[k]; ok {
+			k = col
+		}
+		dst[k] = append(dst[k], v...)
+	}
+}
+
+// importPatient finds the patient by CPF or alternative identifier like new
+// reports do, and creates them otherwise. Existing patients are left as they
+// are.
+func importPatient(ctx context.Context, tx pgx.Tx, p PatientInput) (PatientOutput, bool, error) {
+	patient, err := lookupPatient(ctx, tx, p)
+	if err == nil {
+		return patient, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return patient, false, err
+	}
+
+	patient, err = insertPatient(ctx, tx, p)
+	return patient, err == nil, err
+}
+
+// runImport reads the CSV of the request body, with a header naming columns
+// among columns, and saves each record with save. Failing records are rolled
+// back on their own and reported, the others are committed in batches or,
+// on a dry run, all rolled back at the end. Imports that keep rows are
+// audited as action.
+func (s *Server) runImport(w http.ResponseWriter, r *http.Request, action AuditAction, columns []string, required []string,
+	save func(ctx context.Context, tx pgx.Tx, row importRow) (importOutcome, error)) error {
+	res := ImportResult{
+		DryRun: r.URL.Query().Get("dryRun") == "true",
+		Errors: make([]ImportRowError, 0),
+	}
+
+	in := csv.NewReader(r.Body)
+	in.FieldsPerRecord = -1
+
+	header, err := in.Read()
+	if err != nil {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"header": {"header row missing"},
+		})
+	}
+
+	errs := make([]string, 0)
+	for i, col := range header {
+		if i == 0 {
+			// spreadsheets often save UTF-8 with a byte order mark
+			col = strings.TrimPrefix(col, "\ufeff")
+		}
+		header[i] = strings.ToLower(strings.TrimSpace(col))
+
+		if !slices.Contains(columns, header[i]) {
+			errs = append(errs, fmt.Sprintf("unknown column %q", col))
+		} else if slices.Index(header, header[i]) < i {
+			errs = append(errs, fmt.Sprintf("duplicate column %q", col))
+		}
+	}
+	for _, col := range required {
+		if !slices.Contains(header, col) {
+			errs = append(errs, fmt.Sprintf("column %q missing", col))
+		}
+	}
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{"header": errs})
+	}
+
+	// before the first batch is committed, a failing import may still
+	// have kept some
+	if !res.DryRun {
+		s.auditRequest(r, action, nil, nil)
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback(ctx) }()
+
+	// rows saved since the last commit
+	pending := 0
+
+	fail := func(row int, errs map[string][]string) {
+		res.Failed++
+		if len(res.Errors) < IMPORT_MAX_ERRORS {
+			res.Errors = append(res.Errors, ImportRowError{Row: row, Errors: errs})
+		}
+	}
+
+	for line := 2; ; line++ {
+		record, err := in.Read()
+		if err == io.EOF {
+			break
+		}
+
+		res.Rows++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return err
+			}
+			fail(line, map[string][]string{"row": {parseErr.Err.Error()}})
+			continue
+		}
+
+		if len(record) != len(header) {
+			fail(line, map[string][]string{
+				"row": {fmt.Sprintf("row has %d cells, the header %d", len(record), len(header))},
+			})
+			continue
+		}
+
+		row := importRow{cells: make(map[string]string), errs: make(map[string][]string)}
+		for i, col := range header {
+			row.cells[col] = record[i]
+		}
+
+		// a savepoint, so that the failing row is the only one lost
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return err
+		}
+
+		outcome, err := save(ctx, sp, row)
+		if err == nil && len(row.errs) == 0 {
+			err = sp.Commit(ctx)
+		}
+		if err != nil || len(row.errs) > 0 {
+			if err := sp.Rollback(ctx); err != nil {
+				return err
+			}
+			if err != nil {
+				fmt.Printf("import error on row %d: %s\n", line, err.Error())
+				row.errs["row"] = append(row.errs["row"], "row could not be saved")
+			}
+			fail(line, row.errs)
+			continue
+		}
+
+		if outcome.patientCreated {
+			res.PatientsCreated++
+		} else {
+			res.PatientsMatched++
+		}
+		if outcome.reportCreated {
+			res.ReportsCreated++
+		}
+
+		// a dry run keeps a single transaction, so that patients of earlier
+		// rows are still found
+		pending++
+		if !res.DryRun && pending == IMPORT_BATCH_SIZE {
+			if err := tx.Commit(ctx); err != nil {
+				return err
+			}
+			if tx, err = s.db.Begin(ctx); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+
+	if !res.DryRun {
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	return writeJSON(w, http.StatusOK, res)
+}
+
+// handleImportPatients creates the patients of a CSV file, skipping the ones
+// already registered
+func (s *Server) handleImportPatients(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermImportData); err != nil {
+		return err
+	}
+
+	return s.runImport(w, r, AuditImportPatients, importPatientColumns, []string{"name"},
+		func(ctx context.Context, tx pgx.Tx, row importRow) (importOutcome, error) {
+			p := row.patient()
+			mergeErrors(row.errs, CreateReportRequest{Patient: p}.validate())
+			if len(row.errs) > 0 {
+				return importOutcome{}, nil
+			}
+
+			_, created, err := importPatient(ctx, tx, p)
+			return importOutcome{patientCreated: created}, err
+		})
+}
+
+// handleImportReports creates past reports from a CSV file, with their
+// patients. Imported reports keep their issue time and urgency, they are not
+// scanned for red flags nor counted for surveillance. They get IMPORT_TICKET
+// and are flagged, so that the waiting room display leaves them out.
+func (s *Server) handleImportReports(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermImportData); err != nil {
+		return err
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	defaultFacility, hasDefault := s.defaultFacility()
+
+	// facilities checked so far, reports only go to existing facilities of
+	// the request
+	facilities := make(map[int]bool)
+
+	return s.runImport(w, r, AuditImportReports, importReportColumns, []string{"name", "issued_at"},
+		func(ctx context.Context, tx pgx.Tx, row importRow) (importOutcome, error) {
+			req := CreateReportRequest{
+				Patient: row.patient(),
+				ReportBase: ReportBase{
+					Weight:            row.decimal("weight"),
+					Height:            row.integer("height"),
+					HeartRate:         row.integer("heart_rate"),
+					SystolicPressure:  row.integer("systolic_pressure"),
+					DiastolicPressure: row.integer("diastolic_pressure"),
+					Temperature:       row.decimal("temperature"),
+					OxygenSaturation:  row.integer("oxygen_saturation"),
+					Occupation:        row.str("occupation"),
+					Medications:       row.list("medications"),
+					Allergies:         row.list("allergies"),
+					Diseases:          row.list("diseases"),
+					Language:          Language(row.str("language")),
+				},
+			}
+			mergeErrors(row.errs, req.validate())
+			req.Language = req.Language.orDefault()
+
+			issuedAt := row.timestamp("issued_at")
+			if issuedAt == nil {
+				row.errs["issued_at"] = append(row.errs["issued_at"], "issued_at missing")
+			} else if !issuedAt.Before(time.Now()) {
+				row.errs["issued_at"] = append(row.errs["issued_at"], "issued_at must be in the past")
+			}
+
+			urgency := Undefined
+			if v := row.str("urgency"); v != "" {
+				urgency = Urgency(strings.ToLower(v))
+				mergeErrors(row.errs, ChangeUrgencyRequest{Urgency: urgency}.validate())
+			}
+
+			facilityId := row.integer("facility_id")
+			if row.str("facility_id") == "" && hasDefault {
+				facilityId = &defaultFacility
+			}
+			if facilityId == nil {
+				if row.str("facility_id") == "" {
+					row.errs["facility_id"] = append(row.errs["facility_id"], "facility missing")
+				}
+			} else if ok, checked := facilities[*facilityId]; !checked {
+				errs := s.validateFacilities(scope, []int{*facilityId})
+				facilities[*facilityId] = len(errs) == 0
+				if !facilities[*facilityId] {
+					row.errs["facility_id"] = append(row.errs["facility_id"], errs...)
+				}
+			} else if !ok {
+				row.errs["facility_id"] = append(row.errs["facility_id"], "facility does not exist or is not among your own")
+			}
+
+			if len(row.errs) > 0 {
+				return importOutcome{}, nil
+			}
+
+			patient, created, err := importPatient(ctx, tx, req.Patient)
+			if err != nil {
+				return importOutcome{}, err
+			}
+
+			q := `INSERT INTO report(patient_id, weight, height, heart_rate, systolic_pressure,
+			diastolic_pressure, temperature, oxygen_saturation, issued_at,
+			occupation, medications, allergies, diseases, language, urgency, facility_id,
+			ticket, imported)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, TRUE)`
+
+			_, err = tx.Exec(ctx, q,
+				patient.Id, req.Weight, req.Height, req.HeartRate,
+				req.SystolicPressure, req.DiastolicPressure, req.Temperature,
+				req.OxygenSaturation, *issuedAt,
+				req.Occupation, req.Medications, req.Allergies, sealed(SEALED_REPORT_DISEASES, req.Diseases),
+				req.Language, urgency, *facilityId, IMPORT_TICKET)
+
+			return importOutcome{patientCreated: created, reportCreated: true}, err
+		})
+}
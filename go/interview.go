@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type InterviewStatus string
+
+const (
+	InterviewInProgress InterviewStatus = "in_progress"
+	InterviewCompleted  InterviewStatus = "completed"
+	// the answers were attached to a report and the session can't be used anymore
+	InterviewSubmitted InterviewStatus = "submitted"
+)
+
+const INTERVIEW_SESSION_TTL = 2 * time.Hour
+
+// What the kiosk needs to ask a question, branching rules stay on the server
+type InterviewQuestion struct {
+	Id      string     `json:"id"`
+	Text    string     `json:"text"`
+	Type    AnswerType `json:"type"`
+	Options []string   `json:"options,omitempty"`
+}
+
+type InterviewSession struct {
+	Id              string `json:"sessionId"`
+	QuestionnaireId int    `json:"questionnaireId"`
+	// sessions stick to the version they started with
+	QuestionnaireVersion int `json:"questionnaireVersion"`
+	// the patient agreed to have answer audio and transcripts stored
+	AudioConsent    bool               `json:"audioConsent"`
+	Language        Language           `json:"language"`
+	FacilityId      int                `json:"facilityId"`
+	Status          InterviewStatus    `json:"status"`
+	Question        *InterviewQuestion `json:"question"`
+	Answers         []QA               `json:"answers"`
+	CreatedAt       time.Time          `json:"createdAt"`
+	currentQuestion *string
+}
+
+type StartInterviewRequest struct {
+	QuestionnaireId int      `json:"questionnaireId"`
+	AudioConsent    bool     `json:"audioConsent"`
+	Language        Language `json:"language"`
+	// ignored for kiosks, they have their own, and only taken from employees
+	FacilityId *int `json:"facilityId"`
+}
+
+type AnswerInterviewRequest struct {
+	QuestionId string `json:"questionId"`
+	// in the language of the session
+	Answer string `json:"answer"`
+	// optional translation of free text answers to the questionnaire language
+	Translation *string `json:"translation"`
+}
+
+func (s *InterviewSession) expired() bool {
+	return time.Since(s.CreatedAt) > INTERVIEW_SESSION_TTL
+}
+
+func (s *InterviewSession) setQuestion(qn QuestionnaireDefinition) {
+	s.Question = nil
+	if s.currentQuestion == nil {
+		return
+	}
+
+	if q, ok := qn.question(*s.currentQuestion); ok {
+		q = q.localized(s.Language)
+		s.Question = &InterviewQuestion{
+			Id:      q.Id,
+			Text:    q.Text,
+			Type:    q.Type,
+			Options: q.Options,
+		}
+	}
+}
+
+func (s *Server) handleStartInterview(w http.ResponseWriter, r *http.Request) error {
+	var req StartInterviewRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	req.Language = req.Language.orDefault()
+	if !req.Language.valid() {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"language": {"unsupported language"},
+		})
+	}
+
+	qn, err := s.getQuestionnaire(req.QuestionnaireId)
+	if err != nil || !qn.Active {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"questionnaireId": {"questionnaire does not exist or is not active"},
+		})
+	}
+
+	facilityId, err := s.intakeFacility(r, req.FacilityId)
+	if err != nil {
+		return err
+	}
+
+	id, err := randomToken(16)
+	if err != nil {
+		return err
+	}
+
+	session := InterviewSession{
+		Id:                   id,
+		QuestionnaireId:      qn.Id,
+		QuestionnaireVersion: qn.Version,
+		AudioConsent:         req.AudioConsent,
+		Language:             req.Language,
+		FacilityId:           facilityId,
+		Status:               InterviewInProgress,
+		Answers:              make([]QA, 0),
+		CreatedAt:            time.Now(),
+	}
+
+	first := qn.first()
+	if first == END_OF_INTERVIEW {
+		session.Status = InterviewCompleted
+	} else {
+		session.currentQuestion = &first
+	}
+
+	q := `INSERT INTO interview_session(session_id, questionnaire_id, questionnaire_version,
+	audio_consent, language, status, current_question, answers, created_at, facility_id)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err = s.db.Exec(context.Background(), q, session.Id, session.QuestionnaireId, session.QuestionnaireVersion,
+		session.AudioConsent, session.Language, session.Status, session.currentQuestion, sealed(SEALED_INTERVIEW_SESSION_ANSWERS, session.Answers), session.CreatedAt,
+		session.FacilityId)
+	if err != nil {
+		return err
+	}
+
+	session.setQuestion(qn.QuestionnaireDefinition)
+	return writeJSON(w, http.StatusCreated, session)
+}
+
+func (s *Server) handleGetInterview(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.getInterviewSession(r.PathValue("sessionId"))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "interview session does not exist")
+		}
+		return err
+	}
+
+	qn, err := s.getQuestionnaireVersion(session.QuestionnaireId, session.QuestionnaireVersion)
+	if err != nil {
+		return err
+	}
+
+	session.setQuestion(qn.QuestionnaireDefinition)
+	return writeJSON(w, http.StatusOK, session)
+}
+
+func (s *Server) handleAnswerInterview(w http.ResponseWriter, r *http.Request) error {
+	var req AnswerInterviewRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	session, err := s.getInterviewSession(r.PathValue("sessionId"))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "interview session does not exist")
+		}
+		return err
+	}
+
+	if session.expired() {
+		return NewAPIError(http.StatusGone, "interview session expired")
+	}
+
+	if session.Status != InterviewInProgress || session.currentQuestion == nil {
+		return NewAPIError(http.StatusConflict, "interview already finished")
+	}
+
+	// guards against answers sent twice or for a question that was not asked
+	if req.QuestionId != *session.currentQuestion {
+		return NewAPIError(http.StatusConflict, "question is not the current one")
+	}
+
+	qn, err := s.getQuestionnaireVersion(session.QuestionnaireId, session.QuestionnaireVersion)
+	if err != nil {
+		return err
+	}
+
+	question, ok := qn.question(req.QuestionId)
+	if !ok {
+		return InternalError()
+	}
+
+	asked := question.localized(session.Language)
+	if errs := asked.validateAnswer(req.Answer); len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{"answer": errs})
+	}
+
+	qa := QA{
+		QuestionId: question.Id,
+		Question:   asked.Text,
+		Answer:     strings.TrimSpace(req.Answer),
+	}
+
+	if session.Language != qn.Language.orDefault() {
+		translation := question.canonicalAnswer(session.Language, qa.Answer)
+		if question.Type == TextAnswer {
+			translation = ""
+			if req.Translation != nil {
+				translation = strings.TrimSpace(*req.Translation)
+			}
+		}
+
+		if translation != "" && translation != qa.Answer {
+			qa.Translation = &translation
+		}
+	}
+
+	session.Answers = append(session.Answers, qa)
+
+	previous := *session.currentQuestion
+	next := qn.next(previous, session.Answers)
+	if next == END_OF_INTERVIEW {
+		session.currentQuestion = nil
+		session.Status = InterviewCompleted
+	} else {
+		session.currentQuestion = &next
+	}
+
+	q := `UPDATE interview_session SET status = $1, current_question = $2, answers = $3
+	WHERE session_id = $4 AND current_question = $5`
+
+	tag, err := s.db.Exec(context.Background(), q, session.Status, session.currentQuestion,
+		sealed(SEALED_INTERVIEW_SESSION_ANSWERS, session.Answers), session.Id, previous)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusConflict, "question is not the current one")
+	}
+
+	session.setQuestion(qn.QuestionnaireDefinition)
+	return writeJSON(w, http.StatusOK, session)
+}
+
+func (s *Server) getInterviewSession(id string) (InterviewSession, error) {
+	q := `SELECT session_id, questionnaire_id, questionnaire_version, audio_consent, language,
+	status, current_question, answers, created_at, facility_id
+	FROM interview_session WHERE session_id = $1`
+
+	var session InterviewSession
+	err := s.db.QueryRow(context.Background(), q, id).Scan(
+		&session.Id, &session.QuestionnaireId, &session.QuestionnaireVersion, &session.AudioConsent,
+		&session.Language, &session.Status,
+		&session.currentQuestion, unseal(SEALED_INTERVIEW_SESSION_ANSWERS, &session.Answers), &session.CreatedAt, &session.FacilityId)
+
+	if session.Answers == nil {
+		session.Answers = make([]QA, 0)
+	}
+
+	return session, err
+}
+
+var errInterviewExpired = errors.New("interview session expired")
+
+// completedInterview returns a finished session that was not attached to a
+// report yet. Expired sessions are refused like they are for answers and
+// recordings.
+func (s *Server) completedInterview(sessionId string) (InterviewSession, error) {
+	session, err := s.getInterviewSession(sessionId)
+	if err != nil {
+		return session, err
+	}
+
+	if session.expired() {
+		return session, errInterviewExpired
+	}
+
+	if session.Status != InterviewCompleted {
+		return session, errors.New("interview session is not completed")
+	}
+
+	return session, nil
+}
+
+// markInterviewSubmitted links the session to the report created in tx, a
+// session submitted by a concurrent request is a conflict
+func markInterviewSubmitted(ctx context.Context, tx pgx.Tx, sessionId string, reportId int) error {
+	q := `UPDATE interview_session SET status = $1, report_id = $2
+	WHERE session_id = $3 AND status = $4`
+
+	tag, err := tx.Exec(ctx, q, InterviewSubmitted, reportId, sessionId, InterviewCompleted)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusConflict, "interview session already submitted")
+	}
+
+	// recordings follow the answers into the report
+	q = `UPDATE interview_recording SET report_id = $1 WHERE session_id = $2`
+	_, err = tx.Exec(ctx, q, reportId, sessionId)
+	return err
+}
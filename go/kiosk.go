@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const kioskIdClaim = TokenClaim("kioskId")
+
+// Kiosk devices authenticate with a long lived token, only its hash is stored
+// and the token itself is shown once on registration
+type Kiosk struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	FacilityId int        `json:"facilityId"`
+	Active     bool       `json:"active"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastSeenAt *time.Time `json:"lastSeenAt"`
+}
+
+type KioskCreated struct {
+	Kiosk
+	Token string `json:"token"`
+}
+
+type CreateKioskRequest struct {
+	Name       string `json:"name"`
+	FacilityId int    `json:"facilityId"`
+}
+
+func (r CreateKioskRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Name) == 0 {
+		errs["name"] = append(errs["name"], "name missing")
+	}
+
+	if len(r.Name) > 50 {
+		errs["name"] = append(errs["name"], "name must not exceed 50 characters")
+	}
+
+	return errs
+}
+
+// kioskMiddleware accepts the token on the X-Kiosk-Token header or, since
+// browsers can't set headers on websocket handshakes, on the token query
+// parameter
+func (s *Server) kioskMiddleware(handler APIFunc) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("X-Kiosk-Token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+
+		if token == "" {
+			return NewAPIError(http.StatusUnauthorized, "missing kiosk token")
+		}
+
+		q := `UPDATE kiosk_device SET last_seen_at = $1
+		WHERE token_hash = $2 AND active RETURNING kiosk_id`
+
+		var kioskId int
+		err := s.db.QueryRow(context.Background(), q, time.Now(), hashToken(token)).Scan(&kioskId)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return NewAPIError(http.StatusUnauthorized, "invalid kiosk token")
+			}
+			return err
+		}
+
+		ctx := context.WithValue(r.Context(), kioskIdClaim, kioskId)
+		return handler(w, r.WithContext(ctx))
+	}
+}
+
+// activeKiosk resolves a kiosk token, pgx.ErrNoRows when it belongs to no
+// active kiosk
+func (s *Server) activeKiosk(token string) (kioskId int, facilityId int, err error) {
+	q := `SELECT kiosk_id, facility_id FROM kiosk_device WHERE token_hash = $1 AND active`
+
+	err = s.db.QueryRow(context.Background(), q, hashToken(token)).Scan(&kioskId, &facilityId)
+	return kioskId, facilityId, err
+}
+
+func getKioskId(r *http.Request) (int, error) {
+	id, ok := r.Context().Value(kioskIdClaim).(int)
+	if !ok {
+		return 0, fmt.Errorf("unable to retrieve kiosk id from context")
+	}
+	return id, nil
+}
+
+func (s *Server) handleGetKiosks(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageKiosks); err != nil {
+		return err
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT kiosk_id, name, facility_id, active, created_at, last_seen_at FROM kiosk_device
+	WHERE $1 OR facility_id = ANY($2) ORDER BY kiosk_id`
+
+	rows, err := s.db.Query(context.Background(), q, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	kiosks := make([]Kiosk, 0)
+	for rows.Next() {
+		var k Kiosk
+		err := rows.Scan(&k.Id, &k.Name, &k.FacilityId, &k.Active, &k.CreatedAt, &k.LastSeenAt)
+		if err != nil {
+			return err
+		}
+		kiosks = append(kiosks, k)
+	}
+
+	return writeJSON(w, http.StatusOK, kiosks)
+}
+
+func (s *Server) handleCreateKiosk(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageKiosks); err != nil {
+		return err
+	}
+
+	var req CreateKioskRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	errs := req.validate()
+	if facilityErrs := s.validateFacilities(scope, []int{req.FacilityId}); len(facilityErrs) > 0 {
+		errs["facilityId"] = facilityErrs
+	}
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	k := KioskCreated{
+		Kiosk: Kiosk{
+			Name:       req.Name,
+			FacilityId: req.FacilityId,
+			Active:     true,
+			CreatedAt:  time.Now(),
+		},
+		Token: token,
+	}
+
+	q := `INSERT INTO kiosk_device(name, facility_id, token_hash, active, created_at)
+	VALUES($1, $2, $3, $4, $5) RETURNING kiosk_id`
+
+	err = s.db.QueryRow(context.Background(), q, k.Name, k.FacilityId, hashToken(token), k.Active, k.CreatedAt).Scan(&k.Id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, k)
+}
+
+// handleRevokeKiosk deactivates the device, its token stops working at once
+// and open audio streams are closed
+func (s *Server) handleRevokeKiosk(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageKiosks); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `UPDATE kiosk_device SET active = FALSE WHERE kiosk_id = $1 AND ($2 OR facility_id = ANY($3))`
+	tag, err := s.db.Exec(context.Background(), q, id, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusNotFound, "kiosk does not exist")
+	}
+
+	s.audio.closeKiosk(id)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+type Language string
+
+const (
+	Portuguese Language = "pt"
+	Spanish    Language = "es"
+	English    Language = "en"
+)
+
+// most patients speak Portuguese, questionnaires without a language are
+// assumed to be written in it
+const DEFAULT_LANGUAGE = Portuguese
+
+func (l Language) valid() bool {
+	return l == Portuguese || l == Spanish || l == English
+}
+
+func (l Language) orDefault() Language {
+	if l == "" {
+		return DEFAULT_LANGUAGE
+	}
+	return l
+}
+
+// requestLanguage picks the language of the lang query parameter or, failing
+// that, the first supported one of the Accept-Language header
+func requestLanguage(r *http.Request) Language {
+	if l := Language(r.URL.Query().Get("lang")); l.valid() {
+		return l
+	}
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.Split(part, ";")[0])
+		// pt-BR and es-419 are matched by their base language
+		base := Language(strings.ToLower(strings.Split(tag, "-")[0]))
+		if base.valid() {
+			return base
+		}
+	}
+
+	return DEFAULT_LANGUAGE
+}
+
+var pdfLabels = map[Language]map[string]string{
+	Portuguese: {
+		"dateOfBirth":      "Data de nascimento",
+		"issuedAt":         "Emitido em",
+		"sex":              "Sexo",
+		"height":           "Altura",
+		"weight":           "Peso",
+		"heartRate":        "Frequência cardíaca",
+		"oxygenSaturation": "Saturação de oxigênio",
+		"temperature":      "Temperatura",
+		"bloodPressure":    "Pressão arterial",
+		"interview":        "Entrevista",
+		"questionnaire":    "Questionário",
+		"version":          "versão",
+		"language":         "Idioma da entrevista",
+		"question":         "Pergunta",
+		"answer":           "Resposta",
+		"translation":      "Tradução",
+		"noInterview":      "Nenhuma pergunta na entrevista.",
+		"redFlags":         "Sinais de alerta",
+		"suggestedUrgency": "Urgência sugerida",
+		"diseases":         "Doenças",
+		"medications":      "Medicamentos",
+		"undefined":        "indefinida",
+		"green":            "verde",
+		"yellow":           "amarela",
+		"red":              "vermelha",
+		"consultation":     "Consulta",
+		"attendedBy":       "Atendido por",
+	},
+	Spanish: {
+		"dateOfBirth":      "Fecha de nacimiento",
+		"issuedAt":         "Emitido el",
+		"sex":              "Sexo",
+		"height":           "Altura",
+		"weight":           "Peso",
+		"heartRate":        "Frecuencia cardíaca",
+		"oxygenSaturation": "Saturación de oxígeno",
+		"temperature":      "Temperatura",
+		"bloodPressure":    "Presión arterial",
+		"interview":        "Entrevista",
+		"questionnaire":    "Cuestionario",
+		"version":          "versión",
+		"language":         "Idioma de la entrevista",
+		"question":         "Pregunta",
+		"answer":           "Respuesta",
+		"translation":      "Traducción",
+		"noInterview":      "Ninguna pregunta en la entrevista.",
+		"redFlags":         "Signos de alarma",
+		"suggestedUrgency": "Urgencia sugerida",
+		"diseases":         "Enfermedades",
+		"medications":      "Medicamentos",
+		"undefined":        "indefinida",
+		"green":            "verde",
+		"yellow":           "amarilla",
+		"red":              "roja",
+		"consultation":     "Consulta",
+		"attendedBy":       "Atendido por",
+	},
+	English: {
+		"dateOfBirth":      "Date of Birth",
+		"issuedAt":         "Issued at",
+		"sex":              "Sex",
+		"height":           "Height",
+		"weight":           "Weight",
+		"heartRate":        "Heart Rate",
+		"oxygenSaturation": "Oxygen Saturation",
+		"temperature":      "Temperature",
+		"bloodPressure":    "Blood pressure",
+		"interview":        "Interview",
+		"questionnaire":    "Questionnaire",
+		"version":          "version",
+		"language":         "Interview language",
+		"question":         "Question",
+		"answer":           "Answer",
+		"translation":      "Translation",
+		"noInterview":      "No interview questions.",
+		"redFlags":         "Red flags",
+		"suggestedUrgency": "Suggested urgency",
+		"diseases":         "Diseases",
+		"medications":      "Medications",
+		"undefined":        "undefined",
+		"green":            "green",
+		"yellow":           "yellow",
+		"red":              "red",
+		"consultation":     "Consultation",
+		"attendedBy":       "Attended by",
+	},
+}
+
+func pdfLabel(l Language, key string) string {
+	if label, ok := pdfLabels[l][key]; ok {
+		return label
+	}
+	return pdfLabels[English][key]
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAIL_PROVIDER_SMTP = "smtp"
+	MAIL_PROVIDER_LOG  = "log"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	// plain text
+	Body string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+func (s *Server) initMailer() {
+	provider := os.Getenv("MAIL_PROVIDER")
+	switch provider {
+	case "", MAIL_PROVIDER_LOG:
+		s.mailer = NewLogMailer(os.Getenv("MAIL_LOG_FILE"))
+	case MAIL_PROVIDER_SMTP:
+		host := os.Getenv("SMTP_HOST")
+		from := os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			log.Fatal("SMTP_HOST and MAIL_FROM are required when MAIL_PROVIDER is smtp")
+		}
+
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+
+		s.mailer = NewSMTPMailer(host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	default:
+		log.Fatalf("MAIL_PROVIDER must be %s or %s", MAIL_PROVIDER_SMTP, MAIL_PROVIDER_LOG)
+	}
+}
+
+// SMTPMailer relies on net/smtp, which upgrades to TLS with STARTTLS when the
+// server offers it and refuses to send credentials over plain text
+type SMTPMailer struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{
+		addr: net.JoinHostPort(host, port),
+		host: host,
+		from: from,
+	}
+
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	if strings.ContainsAny(mail.To, "\r\n") {
+		return fmt.Errorf("invalid recipient")
+	}
+
+	msg := formatMail(m.from, mail)
+
+	// smtp.SendMail takes no context, run it aside so callers can give up
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, msg)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func formatMail(from string, mail Mail) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+
+	return buf.Bytes()
+}
+
+// LogMailer sends nothing, mails are appended to a file or printed when no
+// file is given. For local development and tests, it writes reset tokens in
+// clear.
+type LogMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewLogMailer(path string) *LogMailer {
+	return &LogMailer{path: path}
+}
+
+func (m *LogMailer) Send(ctx context.Context, mail Mail) error {
+	entry := fmt.Sprintf("----- %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().Format(time.RFC3339), mail.To, mail.Subject, mail.Body)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.path == "" {
+		fmt.Print(entry)
+		return nil
+	}
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(entry)
+	return err
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// TOTP as in RFC 6238 with the parameters every authenticator app supports:
+// HMAC-SHA1, 6 digits and 30 second steps
+const (
+	TOTP_PERIOD = 30
+	TOTP_DIGITS = 6
+	// steps accepted before and after the current one, for clock drift
+	TOTP_SKEW         = 1
+	TOTP_SECRET_BYTES = 20
+
+	MFA_PURPOSE_LOGIN  = "mfa_login"
+	MFA_PURPOSE_ENROLL = "mfa_enroll"
+	MFA_TOKEN_TTL      = 5 * time.Minute
+
+	MFA_MAX_ATTEMPTS       = 5
+	MFA_LOCKOUT            = 15 * time.Minute
+	MFA_RECOVERY_CODES     = 10
+	MFA_RECOVERY_CODE_SIZE = 10
+)
+
+// set by mfaEnrollmentMiddleware when the enroll-purpose token was used
+const mfaEnrollClaim = TokenClaim("mfaEnroll")
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returned by login instead of the JWT when a second factor is needed. With
+// MFAEnrollmentRequired the role demands MFA but the employee has not
+// enrolled yet, the token then only works on the enrollment endpoints.
+type MFAChallengeResponse struct {
+	MFARequired           bool   `json:"mfaRequired,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfaEnrollmentRequired,omitempty"`
+	MFAToken              string `json:"mfaToken"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfaToken"`
+	// either a code from the authenticator app or a recovery code
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauthUri"`
+}
+
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+func (r MFACodeRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Code) == 0 && len(r.RecoveryCode) == 0 {
+		errs["code"] = append(errs["code"], "code missing")
+	}
+
+	return errs
+}
+
+type StartMFAEnrollmentRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+}
+
+type ConfirmMFAEnrollmentRequest struct {
+	MFACodeRequest
+	CurrentPassword string `json:"currentPassword"`
+}
+
+type DisableMFARequest struct {
+	MFACodeRequest
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// recovery codes are only shown once
+type MFAEnabledResponse struct {
+	Token         string         `json:"token"`
+	Employee      EmployeeOutput `json:"employee"`
+	RecoveryCodes []string       `json:"recoveryCodes"`
+}
+
+func totpCode(secret []byte, step int64) string {
+	return hotpCode(secret, uint64(step), TOTP_DIGITS)
+}
+
+// hotpCode is the HOTP value of RFC 4226 with the given number of digits
+func hotpCode(secret []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for range digits {
+		modulus *= 10
+	}
+
+	return fmt.Sprintf("%0*d", digits, value%modulus)
+}
+
+// verifyTOTP returns the step the code belongs to. Steps up to lastStep were
+// already used and are refused, so a code can't be replayed.
+func verifyTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / TOTP_PERIOD
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func otpauthURI(secret string, account string) string {
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Anamnesis"
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(TOTP_PERIOD))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + params.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// newRecoveryCodes returns the codes to show, formatted like ABCD-EFGH-IJKL-MNOP
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, 0, MFA_RECOVERY_CODES)
+	for range MFA_RECOVERY_CODES {
+		b, err := randomBytes(MFA_RECOVERY_CODE_SIZE)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := base32NoPadding.EncodeToString(b)
+		code := make([]string, 0, 4)
+		for i := 0; i < len(encoded); i += 4 {
+			code = append(code, encoded[i:min(i+4, len(encoded))])
+		}
+		codes = append(codes, strings.Join(code, "-"))
+	}
+
+	return codes, nil
+}
+
+func createMFAToken(userId int, tokenVersion int, purpose string) (string, error) {
+	claims := CustomClaims{
+		UserId:       userId,
+		TokenVersion: tokenVersion,
+		Purpose:      purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(MFA_TOKEN_TTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtSecret)
+}
+
+func (s *Server) writeMFAChallenge(w http.ResponseWriter, employeeId int, session EmployeeSession) error {
+	resp := MFAChallengeResponse{}
+	purpose := MFA_PURPOSE_LOGIN
+	if session.MFAEnabled {
+		resp.MFARequired = true
+	} else {
+		resp.MFAEnrollmentRequired = true
+		purpose = MFA_PURPOSE_ENROLL
+	}
+
+	var err error
+	resp.MFAToken, err = createMFAToken(employeeId, session.TokenVersion, purpose)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// mfaTokenEmployee returns the employee of a second step token issued for
+// purpose, as long as their credentials did not change since
+func (s *Server) mfaTokenEmployee(token string, purpose string) (int, error) {
+	claims, err := parseJWT(token)
+	if err != nil || claims.Purpose != purpose {
+		return 0, InvalidToken()
+	}
+
+	session, err := s.getEmployeeSession(claims.UserId)
+	if err != nil || session.TokenVersion != claims.TokenVersion {
+		return 0, InvalidToken()
+	}
+
+	return claims.UserId, nil
+}
+
+// mfaEnrollmentMiddleware lets employees whose role requires MFA enroll with
+// the token login gave them, everyone else goes through jwtMiddleware
+func (s *Server) mfaEnrollmentMiddleware(handler APIFunc) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		claims, err := parseJWT(token)
+		if err != nil || claims.Purpose != MFA_PURPOSE_ENROLL {
+			return s.jwtMiddleware(handler)(w, r)
+		}
+
+		employeeId, err := s.mfaTokenEmployee(token, MFA_PURPOSE_ENROLL)
+		if err != nil {
+			return err
+		}
+
+		ctx := context.WithValue(r.Context(), userIdClaim, employeeId)
+		ctx = context.WithValue(ctx, mfaEnrollClaim, true)
+		return handler(w, r.WithContext(ctx))
+	}
+}
+
+// checkEnrollmentAuth asks for the password when enrolling from a session, a
+// stolen token must not be able to put the account behind someone else's
+// authenticator. The enroll-purpose token was just issued by a login.
+func (s *Server) checkEnrollmentAuth(r *http.Request, employeeId int, password string) error {
+	if enrolling, _ := r.Context().Value(mfaEnrollClaim).(bool); enrolling {
+		return nil
+	}
+
+	return s.checkPassword(employeeId, password)
+}
+
+// verifySecondFactor checks a TOTP code or else a recovery code, which can
+// only be used once. After MFA_MAX_ATTEMPTS failures in a row the employee
+// is locked out for MFA_LOCKOUT.
+func (s *Server) verifySecondFactor(employeeId int, code string, recoveryCode string) error {
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `SELECT totp_secret, totp_last_step, mfa_failed_attempts, mfa_locked_until
+	FROM employee WHERE employee_id = $1 FOR UPDATE`
+
+	var secret string
+	var lastStep *int64
+	var attempts int
+	var lockedUntil *time.Time
+	err = tx.QueryRow(ctx, q, employeeId).Scan(unseal(SEALED_EMPLOYEE_TOTP_SECRET, &secret), &lastStep, &attempts, &lockedUntil)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if lockedUntil != nil && lockedUntil.After(now) {
+		return TooManyRequests(lockedUntil.Sub(now))
+	}
+
+	verified := false
+	if code != "" && secret != "" {
+		var last int64 = -1
+		if lastStep != nil {
+			last = *lastStep
+		}
+
+		if step, ok := verifyTOTP(secret, code, now, last); ok {
+			q = `UPDATE employee SET totp_last_step = $1 WHERE employee_id = $2`
+			if _, err := tx.Exec(ctx, q, step, employeeId); err != nil {
+				return err
+			}
+			verified = true
+		}
+	} else if recoveryCode != "" {
+		q = `UPDATE mfa_recovery_code SET used_at = $1
+		WHERE employee_id = $2 AND code_hash = $3 AND used_at IS NULL`
+		tag, err := tx.Exec(ctx, q, now, employeeId, hashToken(normalizeRecoveryCode(recoveryCode)))
+		if err != nil {
+			return err
+		}
+		verified = tag.RowsAffected() == 1
+	}
+
+	if verified {
+		q = `UPDATE employee SET mfa_failed_attempts = 0, mfa_locked_until = NULL WHERE employee_id = $1`
+		if _, err := tx.Exec(ctx, q, employeeId); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	attempts++
+	lockedUntil = nil
+	if attempts >= MFA_MAX_ATTEMPTS {
+		until := now.Add(MFA_LOCKOUT)
+		lockedUntil = &until
+		attempts = 0
+	}
+
+	q = `UPDATE employee SET mfa_failed_attempts = $1, mfa_locked_until = $2 WHERE employee_id = $3`
+	if _, err := tx.Exec(ctx, q, attempts, lockedUntil, employeeId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return NewAPIError(http.StatusUnauthorized, "invalid code")
+}
+
+// replaceRecoveryCodes invalidates the previous codes
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, employeeId int) ([]string, error) {
+	q := `DELETE FROM mfa_recovery_code WHERE employee_id = $1`
+	if _, err := tx.Exec(ctx, q, employeeId); err != nil {
+		return nil, err
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	q = `INSERT INTO mfa_recovery_code(code_hash, employee_id) VALUES($1, $2)`
+	for _, code := range codes {
+		if _, err := tx.Exec(ctx, q, hashToken(normalizeRecoveryCode(code)), employeeId); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+func (s *Server) handleLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	var req MFALoginRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	employeeId, err := s.mfaTokenEmployee(req.MFAToken, MFA_PURPOSE_LOGIN)
+	if err != nil {
+		return err
+	}
+
+	err = s.verifySecondFactor(employeeId, req.Code, req.RecoveryCode)
+	if err != nil {
+		return err
+	}
+
+	session, err := s.getEmployeeSession(employeeId)
+	if err != nil {
+		return err
+	}
+
+	token, err := createJWT(employeeId, session.TokenVersion)
+	if err != nil {
+		return err
+	}
+
+	resp := EmployeeLoginResponse{Token: token}
+	resp.Employee, err = s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// handleStartMFAEnrollment generates a new secret, MFA is only enabled once
+// a code from it is confirmed. Starting again replaces the pending secret.
+func (s *Server) handleStartMFAEnrollment(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req StartMFAEnrollmentRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		return RequestBodyParsingError(err)
+	}
+
+	if err := s.checkEnrollmentAuth(r, employeeId, req.CurrentPassword); err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	if emp.MFAEnabled {
+		return NewAPIError(http.StatusConflict, "multi-factor authentication already enabled")
+	}
+
+	key, err := randomBytes(TOTP_SECRET_BYTES)
+	if err != nil {
+		return err
+	}
+	secret := base32NoPadding.EncodeToString(key)
+
+	q := `UPDATE employee SET totp_secret = $1, totp_last_step = NULL WHERE employee_id = $2`
+	_, err = s.db.Exec(context.Background(), q, sealed(SEALED_EMPLOYEE_TOTP_SECRET, secret), employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, MFAEnrollment{
+		Secret:     secret,
+		OTPAuthURI: otpauthURI(secret, emp.Email),
+	})
+}
+
+// handleConfirmMFAEnrollment enables MFA and logs every other session out
+func (s *Server) handleConfirmMFAEnrollment(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req ConfirmMFAEnrollmentRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	if len(req.Code) == 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"code": {"code missing"},
+		})
+	}
+
+	if err := s.checkEnrollmentAuth(r, employeeId, req.CurrentPassword); err != nil {
+		return err
+	}
+
+	q := `SELECT totp_secret IS NOT NULL, totp_enabled_at IS NOT NULL FROM employee WHERE employee_id = $1`
+
+	var pending, enabled bool
+	err = s.db.QueryRow(context.Background(), q, employeeId).Scan(&pending, &enabled)
+	if err != nil {
+		return err
+	}
+
+	if enabled {
+		return NewAPIError(http.StatusConflict, "multi-factor authentication already enabled")
+	}
+
+	if !pending {
+		return NewAPIError(http.StatusConflict, "start the enrollment first")
+	}
+
+	// recovery codes don't exist yet, only the app can confirm
+	if err := s.verifySecondFactor(employeeId, req.Code, ""); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q = `UPDATE employee SET totp_enabled_at = $1, token_version = token_version + 1
+	WHERE employee_id = $2 RETURNING token_version`
+
+	var tokenVersion int
+	err = tx.QueryRow(ctx, q, time.Now(), employeeId).Scan(&tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	var resp MFAEnabledResponse
+	resp.RecoveryCodes, err = replaceRecoveryCodes(ctx, tx, employeeId)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	resp.Token, err = createJWT(employeeId, tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	resp.Employee, err = s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleDisableMFA(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req DisableMFARequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	session, err := s.getEmployeeSession(employeeId)
+	if err != nil {
+		return err
+	}
+
+	if !session.MFAEnabled {
+		return NewAPIError(http.StatusConflict, "multi-factor authentication is not enabled")
+	}
+
+	if session.RequireMFA {
+		return NewAPIError(http.StatusConflict, "your role requires multi-factor authentication")
+	}
+
+	if err := s.checkPassword(employeeId, req.CurrentPassword); err != nil {
+		return err
+	}
+
+	if err := s.verifySecondFactor(employeeId, req.Code, req.RecoveryCode); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `UPDATE employee SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL,
+	token_version = token_version + 1 WHERE employee_id = $1 RETURNING token_version`
+
+	var tokenVersion int
+	if err := tx.QueryRow(ctx, q, employeeId).Scan(&tokenVersion); err != nil {
+		return err
+	}
+
+	q = `DELETE FROM mfa_recovery_code WHERE employee_id = $1`
+	if _, err := tx.Exec(ctx, q, employeeId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	var resp ProfileResponse
+	resp.Token, err = createJWT(employeeId, tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	resp.Employee, err = s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleRegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req MFACodeRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	if len(req.Code) == 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"code": {"code missing"},
+		})
+	}
+
+	session, err := s.getEmployeeSession(employeeId)
+	if err != nil {
+		return err
+	}
+
+	if !session.MFAEnabled {
+		return NewAPIError(http.StatusConflict, "multi-factor authentication is not enabled")
+	}
+
+	if err := s.verifySecondFactor(employeeId, req.Code, ""); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	codes, err := replaceRecoveryCodes(ctx, tx, employeeId)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string][]string{"recoveryCodes": codes})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// the SHA-1 seed of RFC 6238 appendix B
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestHOTPCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		step := tt.unix / TOTP_PERIOD
+		if got := hotpCode(rfc6238Secret, uint64(step), 8); got != tt.code {
+			t.Errorf("T = %d: code = %s, want %s", tt.unix, got, tt.code)
+		}
+
+		// the 6 digit codes are the last digits of the 8 digit ones
+		if got := totpCode(rfc6238Secret, step); got != tt.code[2:] {
+			t.Errorf("T = %d: totp code = %s, want %s", tt.unix, got, tt.code[2:])
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString(rfc6238Secret)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / TOTP_PERIOD
+
+	for offset := int64(-TOTP_SKEW); offset <= TOTP_SKEW; offset++ {
+		code := totpCode(rfc6238Secret, current+offset)
+		step, ok := verifyTOTP(secret, code, now, -1)
+		if !ok || step != current+offset {
+			t.Errorf("code of step %+d: step = %d, %v, want %d, true", offset, step, ok, current+offset)
+		}
+	}
+
+	for _, offset := range []int64{-TOTP_SKEW - 1, TOTP_SKEW + 1} {
+		if _, ok := verifyTOTP(secret, totpCode(rfc6238Secret, current+offset), now, -1); ok {
+			t.Errorf("code of step %+d accepted outside the skew window", offset)
+		}
+	}
+
+	code := totpCode(rfc6238Secret, current)
+	if _, ok := verifyTOTP(secret, code[:3]+" "+code[3:], now, -1); !ok {
+		t.Error("code with a space rejected")
+	}
+
+	// once a step was used, neither it nor earlier ones are accepted again
+	if _, ok := verifyTOTP(secret, code, now, current); ok {
+		t.Error("replayed code accepted")
+	}
+	if _, ok := verifyTOTP(secret, totpCode(rfc6238Secret, current-1), now, current); ok {
+		t.Error("code older than the last used step accepted")
+	}
+	if _, ok := verifyTOTP(secret, totpCode(rfc6238Secret, current+1), now, current); !ok {
+		t.Error("code newer than the last used step rejected")
+	}
+
+	if _, ok := verifyTOTP("not base32!", code, now, -1); ok {
+		t.Error("code accepted for an invalid secret")
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != MFA_RECOVERY_CODES {
+		t.Fatalf("%d codes, want %d", len(codes), MFA_RECOVERY_CODES)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 19 || code[4] != '-' || code[9] != '-' || code[14] != '-' {
+			t.Errorf("code %q is not formatted like ABCD-EFGH-IJKL-MNOP", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[code] = true
+	}
+
+	if got := normalizeRecoveryCode("abcd-efgh ijkl-mnop"); got != "ABCDEFGHIJKLMNOP" {
+		t.Errorf("normalized code = %q", got)
+	}
+}
+
+// testDatabase loads schema.sql into a schema of its own on the database of
+// TEST_DATABASE_URL, which is dropped afterwards. Tests that need Postgres
+// are skipped without it.
+func testDatabase(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	schemaSQL, err := os.ReadFile("../schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(ctx, dbURL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(ctx)
+		conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	config, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	if _, err := pool.Exec(ctx, string(schemaSQL)); err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+func TestVerifySecondFactorRecoveryCodes(t *testing.T) {
+	s := &Server{db: testDatabase(t)}
+	ctx := context.Background()
+
+	var employeeId int
+	q := `INSERT INTO employee(role_id, name, email) VALUES(NULL, 'Ana Souza', 'ana@example.com')
+	RETURNING employee_id`
+	if err := s.db.QueryRow(ctx, q).Scan(&employeeId); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, employeeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.verifySecondFactor(employeeId, "", codes[0]); err != nil {
+		t.Fatalf("first use of a recovery code: %v", err)
+	}
+
+	var apiErr APIError
+	err = s.verifySecondFactor(employeeId, "", codes[0])
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("second use of a recovery code: %v, want invalid code", err)
+	}
+
+	// typed in lower case without dashes
+	code := strings.ToLower(normalizeRecoveryCode(codes[1]))
+	if err := s.verifySecondFactor(employeeId, "", code); err != nil {
+		t.Errorf("recovery code in lower case: %v", err)
+	}
+
+	// failures in a row lock the employee out, valid codes included
+	for range MFA_MAX_ATTEMPTS {
+		s.verifySecondFactor(employeeId, "", "WRONG")
+	}
+	err = s.verifySecondFactor(employeeId, "", codes[2])
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("recovery code during lockout: %v, want too many requests", err)
+	}
+}
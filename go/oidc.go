@@ -0,0 +1,673 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// how long the identity provider login may take
+	OIDC_LOGIN_TTL     = 10 * time.Minute
+	OIDC_HTTP_TIMEOUT  = 10 * time.Second
+	OIDC_DISCOVERY_TTL = time.Hour
+	// an unknown key id refetches the keys at most this often, providers
+	// rotate keys but tokens signed by strangers shouldn't hammer them
+	OIDC_KEYS_REFRESH_INTERVAL = time.Minute
+	OIDC_DEFAULT_SCOPES        = "openid email profile"
+	OIDC_DEFAULT_GROUPS_CLAIM  = "groups"
+)
+
+// OIDCConfig is the staff single sign-on through the hospital's identity
+// provider, with the authorization code flow and PKCE. The backend is the
+// client: the provider redirects to RedirectURL, which is
+// /auth/oidc/callback, and the callback sends the browser on to FrontendURL
+// with the outcome in the fragment.
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectURL  string
+	FrontendURL  *url.URL
+	Scopes       string
+	GroupsClaim  string
+	// the first group in the list the employee belongs to picks the role
+	GroupRoles []OIDCGroupRole
+	// create employees on their first login, active when a group maps to a
+	// role and pending approval otherwise
+	Provisioning bool
+}
+
+type OIDCGroupRole struct {
+	Group  string
+	RoleId int
+}
+
+func (c OIDCConfig) roleFor(groups []string) (int, bool) {
+	for _, gr := range c.GroupRoles {
+		for _, g := range groups {
+			if g == gr.Group {
+				return gr.RoleId, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// parseGroupRoles reads group=roleId pairs separated by commas, in the order
+// roleFor tries them
+func parseGroupRoles(v string) ([]OIDCGroupRole, error) {
+	var groupRoles []OIDCGroupRole
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		group, role, ok := strings.Cut(pair, "=")
+		roleId, err := strconv.Atoi(strings.TrimSpace(role))
+		if !ok || err != nil || strings.TrimSpace(group) == "" {
+			return nil, fmt.Errorf("invalid group role %q", pair)
+		}
+		groupRoles = append(groupRoles, OIDCGroupRole{Group: strings.TrimSpace(group), RoleId: roleId})
+	}
+
+	return groupRoles, nil
+}
+
+func (s *Server) initOIDC() {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return
+	}
+
+	config := OIDCConfig{
+		Issuer:       strings.TrimSuffix(issuer, "/"),
+		ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		FrontendURL:  envURL("OIDC_FRONTEND_URL"),
+		Scopes:       OIDC_DEFAULT_SCOPES,
+		GroupsClaim:  OIDC_DEFAULT_GROUPS_CLAIM,
+		Provisioning: os.Getenv("OIDC_JIT_PROVISIONING") != "false",
+	}
+
+	if config.ClientId == "" || config.RedirectURL == "" || config.FrontendURL == nil {
+		log.Fatal("OIDC_CLIENT_ID, OIDC_REDIRECT_URL and OIDC_FRONTEND_URL are required when OIDC_ISSUER is set")
+	}
+
+	if v := os.Getenv("OIDC_SCOPES"); v != "" {
+		config.Scopes = v
+	}
+	if v := os.Getenv("OIDC_GROUPS_CLAIM"); v != "" {
+		config.GroupsClaim = v
+	}
+
+	groupRoles, err := parseGroupRoles(os.Getenv("OIDC_GROUP_ROLES"))
+	if err != nil {
+		log.Fatal("OIDC_GROUP_ROLES must be a comma separated list of group=roleId")
+	}
+	config.GroupRoles = groupRoles
+
+	s.oidc = &oidcProvider{
+		config: config,
+		client: &http.Client{Timeout: OIDC_HTTP_TIMEOUT},
+	}
+}
+
+// oidcProvider fetches the discovery document and signing keys when first
+// needed, so the server starts while the identity provider is down
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]any
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < OIDC_DISCOVERY_TTL {
+		return *p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	err := p.getJSON(ctx, p.config.Issuer+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return d, err
+	}
+
+	if strings.TrimSuffix(d.Issuer, "/") != p.config.Issuer {
+		return d, fmt.Errorf("discovery document is for issuer %q", d.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return d, fmt.Errorf("discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	p.discoveredAt = time.Now()
+	return d, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid EC key coordinates")
+		}
+
+		point := append([]byte{4}, x...)
+		return ecdsa.ParseUncompressedPublicKey(curve, append(point, y...))
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// signingKey finds the key an ID token was signed with, refetching the
+// provider's keys when it rotated them
+func (p *oidcProvider) signingKey(ctx context.Context, kid string) (any, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetchedAt) < OIDC_KEYS_REFRESH_INTERVAL {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	p.keysFetchedAt = time.Now()
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]any)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			// other keys of the set may still be usable
+			fmt.Println("oidc key error:", err.Error())
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey must be called with mu held. Tokens without a key id can only
+// be checked against a provider with a single key.
+func (p *oidcProvider) lookupKey(kid string) (any, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+type oidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw string, nonce string) (oidcIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.config.Issuer),
+		jwt.WithAudience(p.config.ClientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return oidcIdentity{}, err
+	}
+
+	if claims["nonce"] != nonce {
+		return oidcIdentity{}, fmt.Errorf("ID token nonce does not match")
+	}
+
+	var id oidcIdentity
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	id.Name, _ = claims["name"].(string)
+
+	// some providers send it as a string
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+
+	switch v := claims[p.config.GroupsClaim].(type) {
+	case []any:
+		for _, g := range v {
+			if g, ok := g.(string); ok {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	case string:
+		id.Groups = []string{v}
+	}
+
+	if id.Subject == "" {
+		return id, fmt.Errorf("ID token has no subject")
+	}
+
+	if id.Name == "" {
+		id.Name, _ = claims["preferred_username"].(string)
+	}
+	if id.Name == "" {
+		id.Name = id.Email
+	}
+
+	return id, nil
+}
+
+// handleOIDCLogin sends the browser to the identity provider. The state,
+// nonce and PKCE verifier are kept until the callback.
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		return NotImplemented()
+	}
+
+	ctx := context.Background()
+	d, err := s.oidc.discover(ctx)
+	if err != nil {
+		fmt.Println("oidc discovery error:", err.Error())
+		return NewAPIError(http.StatusBadGateway, "identity provider unavailable")
+	}
+
+	state, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	q := `DELETE FROM oidc_login WHERE expires_at < $1`
+	if _, err := s.db.Exec(ctx, q, now); err != nil {
+		return err
+	}
+
+	q = `INSERT INTO oidc_login(state_hash, code_verifier, nonce, expires_at) VALUES($1, $2, $3, $4)`
+	_, err = s.db.Exec(ctx, q, hashToken(state), sealed(SEALED_OIDC_CODE_VERIFIER, verifier), nonce, now.Add(OIDC_LOGIN_TTL))
+	if err != nil {
+		return err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", s.oidc.config.ClientId)
+	query.Set("redirect_uri", s.oidc.config.RedirectURL)
+	query.Set("scope", s.oidc.config.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback finishes the login and redirects to the frontend with
+// the same outcome handleLogin would answer, in the URL fragment so it never
+// reaches a server log: token, mfaToken with mfaRequired or
+// mfaEnrollmentRequired, or error
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	if s.oidc == nil {
+		return NotImplemented()
+	}
+
+	result, err := s.oidcCallback(r)
+	if err != nil {
+		msg := "single sign-on failed"
+		if e, ok := err.(APIError); ok {
+			msg = fmt.Sprint(e.Msg)
+		} else {
+			fmt.Println("oidc error:", err.Error())
+		}
+
+		result = url.Values{"error": {msg}}
+	}
+
+	u := *s.oidc.config.FrontendURL
+	u.Fragment = ""
+	http.Redirect(w, r, u.String()+"#"+result.Encode(), http.StatusFound)
+	return nil
+}
+
+func (s *Server) oidcCallback(r *http.Request) (url.Values, error) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		return nil, NewAPIError(http.StatusUnauthorized, "identity provider refused the login: "+e)
+	}
+
+	ctx := context.Background()
+	q := `DELETE FROM oidc_login WHERE state_hash = $1 AND expires_at > $2
+	RETURNING code_verifier, nonce`
+
+	var verifier, nonce string
+	err := s.db.QueryRow(ctx, q, hashToken(query.Get("state")), time.Now()).Scan(unseal(SEALED_OIDC_CODE_VERIFIER, &verifier), &nonce)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, NewAPIError(http.StatusBadRequest, "login expired, try again")
+		}
+		return nil, err
+	}
+
+	idToken, err := s.oidc.exchangeCode(ctx, query.Get("code"), verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := s.oidc.verifyIDToken(ctx, idToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	employeeId, err := s.oidcEmployee(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := s.getEmployeeSession(employeeId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := employeeStatusError(session.Status); err != nil {
+		return nil, err
+	}
+
+	result := url.Values{}
+	if session.MFAEnabled || session.RequireMFA {
+		purpose := MFA_PURPOSE_LOGIN
+		if session.MFAEnabled {
+			result.Set("mfaRequired", "true")
+		} else {
+			result.Set("mfaEnrollmentRequired", "true")
+			purpose = MFA_PURPOSE_ENROLL
+		}
+
+		token, err := createMFAToken(employeeId, session.TokenVersion, purpose)
+		if err != nil {
+			return nil, err
+		}
+		result.Set("mfaToken", token)
+		return result, nil
+	}
+
+	token, err := createJWT(employeeId, session.TokenVersion)
+	if err != nil {
+		return nil, err
+	}
+	result.Set("token", token)
+
+	return result, nil
+}
+
+func (p *oidcProvider) exchangeCode(ctx context.Context, code string, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientId)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || body.IdToken == "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+
+	return body.IdToken, nil
+}
+
+// oidcEmployee finds the employee of an identity, by subject or else by a
+// verified email, which links the two for the next logins. The role follows
+// the identity provider's groups whenever one of them is mapped.
+func (s *Server) oidcEmployee(id oidcIdentity) (int, error) {
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	roleId, mapped := s.oidc.config.roleFor(id.Groups)
+
+	var employeeId int
+	q := `SELECT employee_id FROM employee WHERE oidc_subject = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, q, id.Subject).Scan(&employeeId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		employeeId, err = s.linkOIDCEmployee(ctx, tx, id, roleId, mapped)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if mapped {
+		// a group mapped to a role is as good as an approval
+		q = `UPDATE employee SET role_id = $1,
+		status = CASE WHEN status = 'pending' THEN 'active' ELSE status END
+		WHERE employee_id = $2`
+		if _, err := tx.Exec(ctx, q, roleId, employeeId); err != nil {
+			return 0, err
+		}
+	}
+
+	return employeeId, tx.Commit(ctx)
+}
+
+func (s *Server) linkOIDCEmployee(ctx context.Context, tx pgx.Tx, id oidcIdentity, roleId int, mapped bool) (int, error) {
+	if id.Email == "" {
+		return 0, NewAPIError(http.StatusForbidden, "the identity provider did not share an email")
+	}
+
+	var employeeId int
+	var subject *string
+	q := `SELECT employee_id, oidc_subject FROM employee WHERE lower(email) = lower($1) FOR UPDATE`
+	err := tx.QueryRow(ctx, q, id.Email).Scan(&employeeId, &subject)
+	if err == nil {
+		// an unverified email could be anyone's
+		if !id.EmailVerified {
+			return 0, NewAPIError(http.StatusForbidden, "an employee has this email but the identity provider did not verify it")
+		}
+		if subject != nil {
+			return 0, NewAPIError(http.StatusConflict, "employee is linked to another identity")
+		}
+
+		q = `UPDATE employee SET oidc_subject = $1 WHERE employee_id = $2`
+		_, err = tx.Exec(ctx, q, id.Subject, employeeId)
+		return employeeId, err
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+
+	if !s.oidc.config.Provisioning {
+		return 0, NewAPIError(http.StatusForbidden, "no employee account for this identity")
+	}
+
+	status := EmployeePending
+	if mapped {
+		status = EmployeeActive
+	}
+
+	name := id.Name
+	if len(name) > 255 {
+		name = name[:255]
+	}
+
+	// provisioned employees have no password nor CPF, they always log in
+	// through the identity provider
+	q = `INSERT INTO employee(name, email, status, oidc_subject) VALUES($1, $2, $3, $4) RETURNING employee_id`
+	err = tx.QueryRow(ctx, q, name, id.Email, status, id.Subject).Scan(&employeeId)
+	return employeeId, err
+}
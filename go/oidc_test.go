@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testClientId = "anamnesis"
+
+// testIdP is an identity provider serving a discovery document and the
+// public keys of rsaKey (kid "rsa") and ecKey (kid "ec")
+type testIdP struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{rsaKey: rsaKey, ecKey: ecKey}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		ecBytes, _ := ecKey.PublicKey.Bytes()
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {
+			{Kty: "RSA", Kid: "rsa", Use: "sig",
+				N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			// uncompressed point, 0x04 then X and Y
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecBytes[1:33]), Y: b64(ecBytes[33:])},
+			{Kty: "RSA", Kid: "enc", Use: "enc",
+				N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		}})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *testIdP) provider() *oidcProvider {
+	return &oidcProvider{
+		config: OIDCConfig{
+			Issuer:      idp.server.URL,
+			ClientId:    testClientId,
+			GroupsClaim: OIDC_DEFAULT_GROUPS_CLAIM,
+		},
+		client: idp.server.Client(),
+	}
+}
+
+// claims are valid for the provider unless the test overrides them
+func (idp *testIdP) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            testClientId,
+		"sub":            "user-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          "nonce-1",
+		"email":          "ana@example.com",
+		"email_verified": true,
+		"name":           "Ana Souza",
+		"groups":         []string{"nurses", "staff"},
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+
+	raw := sign(t, jwt.SigningMethodRS256, "rsa", idp.rsaKey, idp.claims())
+	id, err := p.verifyIDToken(context.Background(), raw, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := oidcIdentity{
+		Subject:       "user-1",
+		Email:         "ana@example.com",
+		EmailVerified: true,
+		Name:          "Ana Souza",
+		Groups:        []string{"nurses", "staff"},
+	}
+	if !reflect.DeepEqual(id, want) {
+		t.Errorf("identity = %+v, want %+v", id, want)
+	}
+
+	raw = sign(t, jwt.SigningMethodES256, "ec", idp.ecKey, idp.claims())
+	if _, err := p.verifyIDToken(context.Background(), raw, "nonce-1"); err != nil {
+		t.Errorf("ES256 token rejected: %v", err)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	idp := newTestIdP(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c jwt.MapClaims)
+		// nonce-1 when empty
+		nonce string
+		token func(t *testing.T, c jwt.MapClaims) string
+	}{
+		{name: "nonce of another login", nonce: "nonce-2"},
+		{name: "no nonce", change: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "other issuer", change: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{name: "other audience", change: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "audience list without client", change: func(c jwt.MapClaims) { c["aud"] = []string{"a", "b"} }},
+		{name: "expired", change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "no expiry", change: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "no subject", change: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "signed by another key", token: func(t *testing.T, c jwt.MapClaims) string {
+			return sign(t, jwt.SigningMethodRS256, "rsa", otherKey, c)
+		}},
+		{name: "unknown key id", token: func(t *testing.T, c jwt.MapClaims) string {
+			return sign(t, jwt.SigningMethodRS256, "other", idp.rsaKey, c)
+		}},
+		{name: "encryption key", token: func(t *testing.T, c jwt.MapClaims) string {
+			return sign(t, jwt.SigningMethodRS256, "enc", idp.rsaKey, c)
+		}},
+		{name: "symmetric algorithm", token: func(t *testing.T, c jwt.MapClaims) string {
+			return sign(t, jwt.SigningMethodHS256, "rsa", []byte(testClientId), c)
+		}},
+		{name: "unsigned", token: func(t *testing.T, c jwt.MapClaims) string {
+			return sign(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, c)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idp.claims()
+			if tt.change != nil {
+				tt.change(claims)
+			}
+
+			raw := sign(t, jwt.SigningMethodRS256, "rsa", idp.rsaKey, claims)
+			if tt.token != nil {
+				raw = tt.token(t, claims)
+			}
+
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "nonce-1"
+			}
+
+			if _, err := idp.provider().verifyIDToken(context.Background(), raw, nonce); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenGroupsClaim(t *testing.T) {
+	idp := newTestIdP(t)
+	p := idp.provider()
+	p.config.GroupsClaim = "roles"
+
+	claims := idp.claims()
+	claims["roles"] = "doctors"
+	raw := sign(t, jwt.SigningMethodRS256, "rsa", idp.rsaKey, claims)
+
+	id, err := p.verifyIDToken(context.Background(), raw, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(id.Groups, []string{"doctors"}) {
+		t.Errorf("groups = %v, want [doctors]", id.Groups)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                "https://evil.example.com",
+			AuthorizationEndpoint: "https://evil.example.com/authorize",
+			TokenEndpoint:         "https://evil.example.com/token",
+			JWKSURI:               "https://evil.example.com/jwks",
+		})
+	}))
+	defer server.Close()
+
+	p := &oidcProvider{config: OIDCConfig{Issuer: server.URL, ClientId: testClientId}, client: server.Client()}
+	if _, err := p.discover(context.Background()); err == nil {
+		t.Error("discovery document of another issuer accepted")
+	}
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	got, err := parseGroupRoles(" doctors=2, nurses = 3,,staff=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []OIDCGroupRole{{"doctors", 2}, {"nurses", 3}, {"staff", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("group roles = %v, want %v", got, want)
+	}
+
+	for _, v := range []string{"doctors", "doctors=x", "=2"} {
+		if _, err := parseGroupRoles(v); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
+
+func TestRoleFor(t *testing.T) {
+	config := OIDCConfig{GroupRoles: []OIDCGroupRole{{"doctors", 2}, {"nurses", 3}, {"staff", 1}}}
+
+	tests := []struct {
+		groups []string
+		roleId int
+		mapped bool
+	}{
+		// the order of the configuration wins, not the order of the token
+		{[]string{"staff", "nurses"}, 3, true},
+		{[]string{"nurses", "doctors"}, 2, true},
+		{[]string{"staff"}, 1, true},
+		{[]string{"Doctors"}, 0, false},
+		{[]string{"visitors"}, 0, false},
+		{nil, 0, false},
+	}
+
+	for _, tt := range tests {
+		roleId, mapped := config.roleFor(tt.groups)
+		if roleId != tt.roleId || mapped != tt.mapped {
+			t.Errorf("roleFor(%v) = %d, %v, want %d, %v", tt.groups, roleId, mapped, tt.roleId, tt.mapped)
+		}
+	}
+}
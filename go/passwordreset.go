@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_RESET_DEFAULT_TTL = 30 * time.Minute
+	// a new mail is not sent while an earlier one is this recent
+	PASSWORD_RESET_COOLDOWN     = time.Minute
+	PASSWORD_RESET_MAIL_TIMEOUT = 30 * time.Second
+)
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+func (r PasswordResetRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		errs["email"] = append(errs["email"], "email is invalid")
+	}
+
+	return errs
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+func (r ConfirmPasswordResetRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Token) == 0 {
+		errs["token"] = append(errs["token"], "token missing")
+	}
+
+	if pwErrs := validatePassword(r.NewPassword); len(pwErrs) > 0 {
+		errs["newPassword"] = pwErrs
+	}
+
+	return errs
+}
+
+// handleRequestPasswordReset answers the same whether the email belongs to an
+// employee or not, and mails the token in the background so the response
+// time doesn't tell either
+func (s *Server) handleRequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var req PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	go s.sendPasswordReset(req.Email)
+
+	return writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "if the email belongs to an employee, a reset link was sent to it",
+	})
+}
+
+func (s *Server) sendPasswordReset(email string) {
+	token, err := s.createPasswordReset(email)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			fmt.Println("password reset error:", err.Error())
+		}
+		return
+	}
+
+	body := fmt.Sprintf(`A password reset was requested for your Anamnesis account.
+
+Use the link below within %s to choose a new password:
+
+%s
+
+If you did not ask for it, ignore this email, your password stays the same.
+`, s.passwordReset.TTL, s.passwordReset.link(token))
+
+	ctx, cancel := context.WithTimeout(context.Background(), PASSWORD_RESET_MAIL_TIMEOUT)
+	defer cancel()
+
+	err = s.mailer.Send(ctx, Mail{To: email, Subject: "Password reset", Body: body})
+	if err != nil {
+		fmt.Println("password reset mail error:", err.Error())
+	}
+}
+
+// createPasswordReset replaces the employee's outstanding reset tokens with a
+// new one. Returns pgx.ErrNoRows when there is no such employee, the employee
+// logs in through single sign-on or a token was issued moments ago.
+func (s *Server) createPasswordReset(email string) (string, error) {
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// a password would open a second way into accounts the identity provider
+	// is supposed to control
+	q := `SELECT employee_id FROM employee WHERE email = $1 AND status <> 'deactivated'
+	AND NOT (password_hash IS NULL AND oidc_subject IS NOT NULL) FOR UPDATE`
+
+	var employeeId int
+	if err := tx.QueryRow(ctx, q, email).Scan(&employeeId); err != nil {
+		return "", err
+	}
+
+	q = `SELECT 1 FROM password_reset
+	WHERE employee_id = $1 AND used_at IS NULL AND created_at > $2 LIMIT 1`
+	err = tx.QueryRow(ctx, q, employeeId, time.Now().Add(-PASSWORD_RESET_COOLDOWN)).Scan(nil)
+	if err == nil {
+		return "", pgx.ErrNoRows
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	q = `DELETE FROM password_reset WHERE employee_id = $1 AND used_at IS NULL`
+	if _, err := tx.Exec(ctx, q, employeeId); err != nil {
+		return "", err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	q = `INSERT INTO password_reset(token_hash, employee_id, created_at, expires_at)
+	VALUES($1, $2, $3, $4)`
+	_, err = tx.Exec(ctx, q, hashToken(token), employeeId, now, now.Add(s.passwordReset.TTL))
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit(ctx)
+}
+
+// handleConfirmPasswordReset sets the new password and logs every session
+// out, the token can't be used again
+func (s *Server) handleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var req ConfirmPasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	q := `UPDATE password_reset SET used_at = $1
+	WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+	RETURNING employee_id`
+
+	var employeeId int
+	err = tx.QueryRow(ctx, q, now, hashToken(req.Token)).Scan(&employeeId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusBadRequest, "invalid or expired reset token")
+		}
+		return err
+	}
+
+	q = `UPDATE employee SET password_hash = $1, token_version = token_version + 1
+	WHERE employee_id = $2`
+	if _, err := tx.Exec(ctx, q, string(hash), employeeId); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type PasswordResetConfig struct {
+	TTL time.Duration
+	// frontend page that reads the token from the query string, only the
+	// token is mailed when missing
+	URL *url.URL
+}
+
+func (s *Server) initPasswordReset() {
+	s.passwordReset = PasswordResetConfig{
+		TTL: envDuration("PASSWORD_RESET_TTL", PASSWORD_RESET_DEFAULT_TTL),
+		URL: envURL("PASSWORD_RESET_URL"),
+	}
+}
+
+func (c PasswordResetConfig) link(token string) string {
+	if c.URL == nil {
+		return "Reset token: " + token
+	}
+
+	return tokenURL(c.URL, token)
+}
+
+// tokenURL adds the token to the query string of a frontend page
+func tokenURL(page *url.URL, token string) string {
+	u := *page
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
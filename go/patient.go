@@ -3,9 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
 	"time"
+
+	"github.com/jackc/pgx/v5"
 )
+
 type Sex string
 
 const (
@@ -13,9 +18,25 @@ const (
 	Female Sex = "F"
 )
 
+// Identifiers accepted for patients without a CPF (foreigners, newborns)
+type AltIdType string
+
+const (
+	Passport         AltIdType = "passport"
+	RNE              AltIdType = "rne"
+	CNS              AltIdType = "cns"
+	BirthCertificate AltIdType = "birth_certificate"
+)
+
+func (t AltIdType) valid() bool {
+	return t == Passport || t == RNE || t == CNS || t == BirthCertificate
+}
+
 type PatientInput struct {
 	Name        string     `json:"name"`
 	CPF         string     `json:"cpf"`
+	AltIdType   *AltIdType `json:"altIdType"`
+	AltId       *string    `json:"altId"`
 	Sex         *Sex       `json:"sex"`
 	DateOfBirth *time.Time `json:"dateOfBirth"`
 }
@@ -23,16 +44,69 @@ type PatientInput struct {
 type PatientOutput struct {
 	Id          int        `json:"id"`
 	Name        string     `json:"name"`
-	CPF         string     `json:"cpf"`
+	CPF         *string    `json:"cpf"`
+	AltIdType   *AltIdType `json:"altIdType"`
+	AltId       *string    `json:"altId"`
 	Sex         *Sex       `json:"sex"`
 	DateOfBirth *time.Time `json:"dateOfBirth"`
 }
 
+type CPFValidationMode string
+
+const (
+	CPFStrict  CPFValidationMode = "strict"
+	CPFLenient CPFValidationMode = "lenient"
+)
+
+// set from CPF_VALIDATION, kiosks with unreliable input can run lenient
+var cpfValidationMode = CPFStrict
+
+func initCPFValidation() {
+	mode := CPFValidationMode(os.Getenv("CPF_VALIDATION"))
+	switch mode {
+	case "":
+	case CPFStrict, CPFLenient:
+		cpfValidationMode = mode
+	default:
+		log.Fatal("invalid CPF_VALIDATION mode: ", mode)
+	}
+
+	fmt.Println("CPF validation mode:", cpfValidationMode)
+}
+
+func validateCPFWithMode(cpf string) bool {
+	if cpfValidationMode == CPFLenient {
+		return ValidateCPFLenient(cpf)
+	}
+
+	return ValidateCPF(cpf)
+}
+
+func (p *PatientOutput) maskIdentifiers() {
+	if p.CPF != nil {
+		masked := MaskCPF(*p.CPF)
+		p.CPF = &masked
+	}
+
+	if p.AltId != nil {
+		masked := MaskIdentifier(*p.AltId)
+		p.AltId = &masked
+	}
+}
+
 func (s *Server) handleGetPatients(w http.ResponseWriter, r *http.Request) error {
-	q := `SELECT p.patient_id, p.name, p.cpf, p.sex, p.date_of_birth FROM patient p`
+	q := `SELECT p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth FROM patient p
+	WHERE $1 OR EXISTS (SELECT 1 FROM report r WHERE r.patient_id = p.patient_id AND r.facility_id = ANY($2))`
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	maskIds := !s.requestHasPermission(r, PermViewIdentifiers)
 
 	output := make([]PatientOutput, 0)
-	rows, err := s.db.Query(context.Background(), q)
+	rows, err := s.db.Query(context.Background(), q, scope.all, scope.ids)
 	if err != nil {
 		fmt.Println("db error:", err.Error())
 		return InternalError()
@@ -41,12 +115,16 @@ func (s *Server) handleGetPatients(w http.ResponseWriter, r *http.Request) error
 
 	for rows.Next() {
 		var p PatientOutput
-		err := rows.Scan(&p.Id, &p.Name, &p.CPF, &p.Sex, &p.DateOfBirth)
+		err := rows.Scan(&p.Id, &p.Name, unseal(SEALED_PATIENT_CPF, &p.CPF), &p.AltIdType, &p.AltId, &p.Sex, &p.DateOfBirth)
 		if err != nil {
 			fmt.Println("scan error:", err.Error())
 			return InternalError()
 		}
 
+		if maskIds {
+			p.maskIdentifiers()
+		}
+
 		output = append(output, p)
 	}
 
@@ -59,15 +137,25 @@ func (s *Server) handleGetPatientById(w http.ResponseWriter, r *http.Request) er
 		return BadRequest()
 	}
 
-	q := `SELECT p.patient_id, p.name, p.cpf, p.sex, p.date_of_birth FROM patient p WHERE p.patient_id = $1`
+	if err := s.requirePatientFacility(r, id); err != nil {
+		return err
+	}
+
+	q := `SELECT p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth FROM patient p WHERE p.patient_id = $1`
 	row := s.db.QueryRow(context.Background(), q, id)
 	
 	var p PatientOutput
-	err = row.Scan(&p.Id, &p.Name, &p.CPF, &p.Sex, &p.DateOfBirth)
+	err = row.Scan(&p.Id, &p.Name, unseal(SEALED_PATIENT_CPF, &p.CPF), &p.AltIdType, &p.AltId, &p.Sex, &p.DateOfBirth)
 	if err != nil {
 		return NewAPIError(http.StatusNotFound, "patient does not exist")
 	}
 
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		p.maskIdentifiers()
+	}
+
+	s.auditRequest(r, AuditViewPatient, &p.Id, nil)
+
 	return writeJSON(w, http.StatusOK, p)
 }
 
@@ -77,46 +165,85 @@ func (s *Server) handleGetPatientReports(w http.ResponseWriter, r *http.Request)
 		return BadRequest()
 	}
 
-	q := `SELECT patient_id, name, cpf, sex, date_of_birth FROM patient WHERE patient_id = $1`
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.requirePatientFacility(r, patientId); err != nil {
+		return err
+	}
+
+	p, err := s.getPatient(patientId)
+	if err != nil {
+		return NewAPIError(http.StatusNotFound, "patient does not exist")
+	}
+
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		p.maskIdentifiers()
+	}
+
+	// reports taken elsewhere stay hidden, the patient may have been seen
+	// at other facilities of the network
+	reports, err := s.getPatientReports(p, scope)
+	if err != nil {
+		return err
+	}
+
+	s.auditRequest(r, AuditViewPatientReports, &p.Id, nil)
+
+	return writeJSON(w, http.StatusOK, reports)
+}
+
+func (s *Server) getPatient(id int) (PatientOutput, error) {
+	q := `SELECT patient_id, name, cpf, alt_id_type, alt_id, sex, date_of_birth FROM patient WHERE patient_id = $1`
 
 	var p PatientOutput
-	row := s.db.QueryRow(context.Background(), q, patientId)
-	err = row.Scan(&p.Id, &p.Name, &p.CPF, &p.Sex, &p.DateOfBirth)
-		if err != nil {
-			return NewAPIError(http.StatusNotFound, "patient does not exist")
-		}
+	row := s.db.QueryRow(context.Background(), q, id)
+	err := row.Scan(&p.Id, &p.Name, unseal(SEALED_PATIENT_CPF, &p.CPF), &p.AltIdType, &p.AltId, &p.Sex, &p.DateOfBirth)
 
-	q = `SELECT r.report_id, r.weight, r.height, r.heart_rate,
+	return p, err
+}
+
+func (s *Server) getPatientReports(p PatientOutput, scope facilityScope) ([]ReportOutput, error) {
+	q := `SELECT r.report_id, r.weight, r.height, r.heart_rate,
 	r.systolic_pressure, r.diastolic_pressure, r.temperature,
 	r.oxygen_saturation, r.interview, r.issued_at,
-	r.occupation, r.medications, r.allergies, r.diseases,
-	r.urgency, (c.report_id IS NOT NULL) AS consulted
+	r.occupation, r.medications, r.allergies, r.diseases, r.language,
+	r.urgency, r.ticket, r.called_at, r.called_room,
+	r.questionnaire_id, r.questionnaire_version, r.red_flags, r.suggested_urgency,
+	(c.report_id IS NOT NULL) AS consulted, r.facility_id
 	FROM report r LEFT JOIN consultation c on r.report_id = c.report_id
-	WHERE r.patient_id = $1`
+	WHERE r.patient_id = $1 AND ($2 OR r.facility_id = ANY($3))`
 
-	rows, err := s.db.Query(context.Background(), q, p.Id)
+	rows, err := s.db.Query(context.Background(), q, p.Id, scope.all, scope.ids)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rows.Close()
 
 	reports := make([]ReportOutput, 0)
 	for rows.Next() {
 		var r ReportOutput
 		var consulted bool
+		var qnId, qnVersion *int
 		r.Patient = p
 		err := rows.Scan(
 			&r.Id, &r.Weight, &r.Height,
 			&r.HeartRate, &r.SystolicPressure, &r.DiastolicPressure,
 			&r.Temperature, &r.OxygenSaturation,
-			&r.Interview, &r.IssuedAt,
-			&r.Occupation, &r.Medications, &r.Allergies, &r.Diseases,
-			&r.Urgency, &consulted,
+			unseal(SEALED_REPORT_INTERVIEW, &r.Interview), &r.IssuedAt,
+			&r.Occupation, &r.Medications, &r.Allergies, unseal(SEALED_REPORT_DISEASES, &r.Diseases), &r.Language,
+			&r.Urgency, &r.Ticket, &r.CalledAt, &r.CalledRoom, &qnId, &qnVersion,
+			unseal(SEALED_REPORT_RED_FLAGS, &r.RedFlags), &r.SuggestedUrgency, &consulted, &r.FacilityId,
 		)
 
 		if err != nil {
-			return err
+			return nil, err
 		}
 
+		s.setReportQuestionnaire(&r, qnId, qnVersion)
+
 		if consulted {
 			r.Consultation, err = s.getConsultation(r.Id)
 		}
@@ -124,20 +251,47 @@ func (s *Server) handleGetPatientReports(w http.ResponseWriter, r *http.Request)
 		reports = append(reports, r)
 	}
 
-	return writeJSON(w, http.StatusOK, reports)
+	return reports, nil
 }
 
-func (s *Server) createPatient(p PatientInput) (PatientOutput, error) {
+// rowQuerier is the pool or a transaction, for patients created along with
+// other rows
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
 
+func insertPatient(ctx context.Context, db rowQuerier, p PatientInput) (PatientOutput, error) {
 	q := `
-	INSERT INTO patient(name, cpf, sex, date_of_birth)
-	VALUES($1, $2, $3, $4) RETURNING patient_id, name, cpf, sex, date_of_birth
+	INSERT INTO patient(name, cpf, cpf_hash, alt_id_type, alt_id, sex, date_of_birth)
+	VALUES($1, $2, $3, $4, $5, $6, $7)
+	RETURNING patient_id, name, cpf, alt_id_type, alt_id, sex, date_of_birth
 	`
 
-	row := s.db.QueryRow(context.Background(), q, p.Name, p.CPF, p.Sex, p.DateOfBirth)
+	row := db.QueryRow(ctx, q,
+		p.Name, sealed(SEALED_PATIENT_CPF, p.CPF), blindIndex(p.CPF), p.AltIdType, p.AltId, p.Sex, p.DateOfBirth)
+
+	var out PatientOutput
+	err := row.Scan(&out.Id, &out.Name, unseal(SEALED_PATIENT_CPF, &out.CPF), &out.AltIdType, &out.AltId, &out.Sex, &out.DateOfBirth)
+
+	return out, err
+}
+
+// lookupPatient finds a patient by CPF or, when there is none, by the
+// alternative identifier
+func lookupPatient(ctx context.Context, db rowQuerier, p PatientInput) (PatientOutput, error) {
+	var row pgx.Row
+	if p.CPF != "" {
+		q := `SELECT p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth
+		FROM patient p WHERE p.cpf_hash = $1 LIMIT 1`
+		row = db.QueryRow(ctx, q, blindIndex(p.CPF))
+	} else {
+		q := `SELECT p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth
+		FROM patient p WHERE p.alt_id_type = $1 AND p.alt_id = $2 LIMIT 1`
+		row = db.QueryRow(ctx, q, p.AltIdType, p.AltId)
+	}
 
 	var out PatientOutput
-	err := row.Scan(&out.Id, &out.Name, &out.CPF, &out.Sex, &out.DateOfBirth)
+	err := row.Scan(&out.Id, &out.Name, unseal(SEALED_PATIENT_CPF, &out.CPF), &out.AltIdType, &out.AltId, &out.Sex, &out.DateOfBirth)
 
 	return out, err
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/signintech/gopdf"
+)
+
+const ANONYMIZED_NAME = "ANONYMIZED"
+
+// Everything the clinic holds about a patient, handed out on LGPD data
+// subject access requests
+type PatientDataPackage struct {
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Patient     PatientOutput  `json:"patient"`
+	Reports     []ReportOutput `json:"reports"`
+	// reports moved out by the retention job
+	ArchivedReports []ArchivedReport `json:"archivedReports"`
+	// audio files are added to the archive next to the JSON
+	Recordings []Recording  `json:"recordings"`
+	AuditLog   []AuditEntry `json:"auditLog"`
+}
+
+func (s *Server) handleExportPatientData(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermPrivacyOfficer); err != nil {
+		return err
+	}
+
+	patientId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	if err := s.requirePatientFacility(r, patientId); err != nil {
+		return err
+	}
+
+	p, err := s.getPatient(patientId)
+	if err != nil {
+		return NewAPIError(http.StatusNotFound, "patient does not exist")
+	}
+
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	// logged before collecting so the package also shows this request
+	err = s.audit(&employeeId, AuditExportPatientData, &p.Id, nil)
+	if err != nil {
+		return err
+	}
+
+	pkg := PatientDataPackage{
+		GeneratedAt: time.Now(),
+		Patient:     p,
+	}
+
+	// the export covers the whole network, data subject requests are not
+	// limited to the facility that received them
+	pkg.Reports, err = s.getPatientReports(p, facilityScope{all: true})
+	if err != nil {
+		return err
+	}
+
+	pkg.ArchivedReports, err = s.getPatientArchivedReports(p.Id)
+	if err != nil {
+		return err
+	}
+
+	pkg.Recordings = make([]Recording, 0)
+	for _, rep := range pkg.Reports {
+		recordings, err := s.getReportRecordings(rep.Id)
+		if err != nil {
+			return err
+		}
+		pkg.Recordings = append(pkg.Recordings, recordings...)
+	}
+
+	pkg.AuditLog, err = s.getPatientAuditLog(p.Id)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	f, err := archive.Create(fmt.Sprintf("patient-%d.json", p.Id))
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(pkg); err != nil {
+		return err
+	}
+
+	f, err = archive.Create(fmt.Sprintf("patient-%d.pdf", p.Id))
+	if err != nil {
+		return err
+	}
+
+	pdf, err := pkg.pdf()
+	if err != nil {
+		return err
+	}
+
+	if _, err := pdf.WriteTo(f); err != nil {
+		return err
+	}
+
+	for _, rec := range pkg.Recordings {
+		audio, err := s.getRecordingAudio(rec.Id)
+		if err != nil {
+			return err
+		}
+
+		f, err = archive.Create(fmt.Sprintf("recordings/recording-%d%s", rec.Id, recordingExtension(rec.ContentType)))
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(audio); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	w.Header().Add("Content-Type", "application/zip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"patient-%d-data.zip\"", p.Id))
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (pkg PatientDataPackage) pdf() (*gopdf.GoPdf, error) {
+	pdf, err := newPDF()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pdfCursor{pdf: pdf, y: 50}
+	c.line(24, pkg.Patient.Name, 8)
+	c.line(12, fmt.Sprintf("Generated at: %s", pkg.GeneratedAt.Format("02/01/2006 15:04")), 0)
+	if pkg.Patient.CPF != nil {
+		c.line(12, fmt.Sprintf("CPF: %s", *pkg.Patient.CPF), 0)
+	}
+	if pkg.Patient.AltIdType != nil && pkg.Patient.AltId != nil {
+		c.line(12, fmt.Sprintf("%s: %s", *pkg.Patient.AltIdType, *pkg.Patient.AltId), 0)
+	}
+	if pkg.Patient.DateOfBirth != nil {
+		c.line(12, fmt.Sprintf("Date of Birth: %s", pkg.Patient.DateOfBirth.Format("02/01/2006")), 0)
+	}
+	if pkg.Patient.Sex != nil {
+		c.line(12, fmt.Sprintf("Sex: %s", *pkg.Patient.Sex), 0)
+	}
+	c.y += 16
+
+	c.line(20, "Reports", 4)
+	reports := pkg.Reports
+	for _, a := range pkg.ArchivedReports {
+		reports = append(reports, a.ReportOutput)
+	}
+	for _, rep := range reports {
+		c.line(14, fmt.Sprintf("Report %d - %s", rep.Id, rep.IssuedAt.Format("02/01/2006 15:04")), 0)
+		c.line(12, fmt.Sprintf("Urgency: %s", rep.Urgency), 0)
+		if rep.Occupation != "" {
+			c.line(12, fmt.Sprintf("Occupation: %s", rep.Occupation), 0)
+		}
+		c.line(12, fmt.Sprintf("Medications: %s", strings.Join(rep.Medications, ", ")), 0)
+		c.line(12, fmt.Sprintf("Allergies: %s", strings.Join(rep.Allergies, ", ")), 0)
+		c.line(12, fmt.Sprintf("Diseases: %s", strings.Join(rep.Diseases, ", ")), 0)
+		for _, qa := range rep.Interview {
+			c.line(12, fmt.Sprintf("Question: %s", qa.Question), 0)
+			c.line(12, fmt.Sprintf("Answer: %s", qa.Answer), 4)
+		}
+		if rep.Consultation != nil && rep.Consultation.ConsultationDate != nil {
+			c.line(12, fmt.Sprintf("Consultation: %s, %s", rep.Consultation.ConsultationDate.Format("02/01/2006 15:04"), rep.Consultation.doctor()), 0)
+		}
+		c.y += 12
+	}
+	if len(reports) == 0 {
+		c.line(12, "No reports.", 12)
+	}
+
+	c.line(20, "Access log", 4)
+	for _, e := range pkg.AuditLog {
+		c.line(10, fmt.Sprintf("%s  %s", e.CreatedAt.Format("02/01/2006 15:04"), e.Action), 0)
+	}
+
+	return pdf, nil
+}
+
+// handleAnonymizePatient scrubs everything that identifies the patient but
+// keeps vitals, urgency, medications, allergies and diseases so that the
+// reports still count towards statistics
+func (s *Server) handleAnonymizePatient(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermPrivacyOfficer); err != nil {
+		return err
+	}
+
+	patientId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	if err := s.requirePatientFacility(r, patientId); err != nil {
+		return err
+	}
+
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// only the year of birth is kept, enough for age bands
+	q := `UPDATE patient SET name = $1, cpf = NULL, cpf_hash = NULL,
+	alt_id_type = NULL, alt_id = NULL,
+	date_of_birth = date_trunc('year', date_of_birth), anonymized_at = $2
+	WHERE patient_id = $3 AND anonymized_at IS NULL`
+
+	tag, err := tx.Exec(ctx, q, ANONYMIZED_NAME, time.Now(), patientId)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM patient WHERE patient_id = $1)`, patientId).Scan(&exists)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return NewAPIError(http.StatusNotFound, "patient does not exist")
+		}
+		return NewAPIError(http.StatusConflict, "patient already anonymized")
+	}
+
+	// free text answers and occupation may identify the patient
+	q = `UPDATE report SET interview = NULL, occupation = '' WHERE patient_id = $1`
+	_, err = tx.Exec(ctx, q, patientId)
+	if err != nil {
+		return err
+	}
+
+	if err := anonymizeArchivedReports(ctx, tx, patientId); err != nil {
+		return err
+	}
+
+	// and so does their voice
+	q = `DELETE FROM interview_recording WHERE report_id IN (SELECT report_id FROM report WHERE patient_id = $1)`
+	_, err = tx.Exec(ctx, q, patientId)
+	if err != nil {
+		return err
+	}
+
+	// the interview sessions hold a copy of the answers
+	q = `UPDATE interview_session SET answers = NULL
+	WHERE report_id IN (SELECT report_id FROM report WHERE patient_id = $1)`
+	_, err = tx.Exec(ctx, q, patientId)
+	if err != nil {
+		return err
+	}
+
+	q = `INSERT INTO audit_log(employee_id, action, patient_id, created_at) VALUES($1, $2, $3, $4)`
+	_, err = tx.Exec(ctx, q, employeeId, AuditAnonymizePatient, patientId, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	p, err := s.getPatient(patientId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, p)
+}
+
+// anonymizeArchivedReports scrubs the archived copies of the patient's
+// reports like handleAnonymizePatient does for the live ones, including the
+// patient details that archives written before they were left out still hold
+func anonymizeArchivedReports(ctx context.Context, tx pgx.Tx, patientId int) error {
+	q := `SELECT report_id, data FROM report_archive WHERE patient_id = $1 FOR UPDATE`
+	rows, err := tx.Query(ctx, q, patientId)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var d string
+		if err := rows.Scan(&id, &d); err != nil {
+			rows.Close()
+			return err
+		}
+		data[id] = d
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, d := range data {
+		a, err := openArchivedReport(d)
+		if err != nil {
+			return fmt.Errorf("archived report %d: %w", id, err)
+		}
+
+		a.Patient = nil
+		a.Interview = nil
+		a.Occupation = ""
+
+		resealed, err := a.seal()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE report_archive SET data = $1 WHERE report_id = $2`, resealed, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Changing the email or the password bumps the employee's token version, so
+// every other session has to log in again. The request's own session gets a
+// fresh token in the response.
+type ProfileResponse struct {
+	// only set when credentials changed
+	Token    string         `json:"token,omitempty"`
+	Employee EmployeeOutput `json:"employee"`
+}
+
+type PatchProfileRequest struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+	// required when changing the email
+	CurrentPassword string `json:"currentPassword"`
+	// an empty display name or registration removes it
+	DisplayName  *string                   `json:"displayName"`
+	Specialties  *[]string                 `json:"specialties"`
+	Registration *ProfessionalRegistration `json:"registration"`
+}
+
+func (r PatchProfileRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if r.Name != nil && len(*r.Name) < 3 {
+		errs["name"] = append(errs["name"], "name must be at least 3 characters long")
+	}
+
+	if r.Name != nil && len(*r.Name) > 255 {
+		errs["name"] = append(errs["name"], "name must not exceed 255 characters")
+	}
+
+	if r.Email != nil {
+		if _, err := mail.ParseAddress(*r.Email); err != nil {
+			errs["email"] = append(errs["email"], "email is invalid")
+		}
+	}
+
+	if r.DisplayName != nil && len(*r.DisplayName) > MAX_DISPLAY_NAME {
+		errs["displayName"] = append(errs["displayName"], "display name must not exceed 100 characters")
+	}
+
+	if r.Specialties != nil {
+		if specErrs := validateSpecialties(*r.Specialties); len(specErrs) > 0 {
+			errs["specialties"] = specErrs
+		}
+	}
+
+	if r.Registration != nil && !r.Registration.empty() {
+		if regErrs := r.Registration.validate(); len(regErrs) > 0 {
+			errs["registration"] = regErrs
+		}
+	}
+
+	return errs
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+func (r ChangePasswordRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.CurrentPassword) == 0 {
+		errs["currentPassword"] = append(errs["currentPassword"], "current password missing")
+	}
+
+	if pwErrs := validatePassword(r.NewPassword); len(pwErrs) > 0 {
+		errs["newPassword"] = pwErrs
+	}
+
+	if r.NewPassword == r.CurrentPassword {
+		errs["newPassword"] = append(errs["newPassword"], "new password must differ from the current one")
+	}
+
+	return errs
+}
+
+func (s *Server) handleGetMe(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+func (s *Server) handlePatchMe(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req PatchProfileRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+	if req.DisplayName != nil {
+		*req.DisplayName = strings.TrimSpace(*req.DisplayName)
+	}
+	if req.Specialties != nil {
+		*req.Specialties = normalizeSpecialties(*req.Specialties)
+	}
+	if req.Registration != nil {
+		*req.Registration = req.Registration.normalized()
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	emailChanged := req.Email != nil && *req.Email != emp.Email
+	if emailChanged {
+		if err := s.checkPassword(employeeId, req.CurrentPassword); err != nil {
+			return err
+		}
+
+		q := `SELECT 1 FROM employee WHERE email = $1 AND employee_id <> $2 LIMIT 1`
+		err = s.db.QueryRow(context.Background(), q, *req.Email, employeeId).Scan(nil)
+		if err == nil {
+			return NewAPIError(http.StatusConflict, "employee with this email already exists")
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+	}
+
+	if req.Registration != nil && !req.Registration.empty() {
+		q := `SELECT 1 FROM employee
+		WHERE council = $1 AND council_state = $2 AND council_number = $3 AND employee_id <> $4 LIMIT 1`
+		reg := req.Registration
+		err = s.db.QueryRow(context.Background(), q, reg.Council, reg.State, reg.Number, employeeId).Scan(nil)
+		if err == nil {
+			return NewAPIError(http.StatusConflict, "employee with this registration already exists")
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := updateCredentials(ctx, tx, employeeId, req); err != nil {
+		return err
+	}
+
+	if req.Name != nil {
+		emp.Name = *req.Name
+	}
+
+	var resp ProfileResponse
+	if emailChanged {
+		q := `UPDATE employee SET name = $1, email = $2, token_version = token_version + 1
+		WHERE employee_id = $3 RETURNING token_version`
+
+		var tokenVersion int
+		err = tx.QueryRow(ctx, q, emp.Name, *req.Email, employeeId).Scan(&tokenVersion)
+		if err != nil {
+			return err
+		}
+
+		resp.Token, err = createJWT(employeeId, tokenVersion)
+		if err != nil {
+			return err
+		}
+	} else {
+		q := `UPDATE employee SET name = $1 WHERE employee_id = $2`
+		_, err = tx.Exec(ctx, q, emp.Name, employeeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	resp.Employee, err = s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req ChangePasswordRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if err := s.checkPassword(employeeId, req.CurrentPassword); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	q := `UPDATE employee SET password_hash = $1, token_version = token_version + 1
+	WHERE employee_id = $2 RETURNING token_version`
+
+	var tokenVersion int
+	err = s.db.QueryRow(context.Background(), q, string(hash), employeeId).Scan(&tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	var resp ProfileResponse
+	resp.Token, err = createJWT(employeeId, tokenVersion)
+	if err != nil {
+		return err
+	}
+
+	resp.Employee, err = s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, resp)
+}
+
+// checkPassword confirms the employee knows their current password before a
+// credential change
+func (s *Server) checkPassword(employeeId int, password string) error {
+	q := `SELECT COALESCE(password_hash, '') FROM employee WHERE employee_id = $1`
+
+	var storedHash string
+	err := s.db.QueryRow(context.Background(), q, employeeId).Scan(&storedHash)
+	if err != nil {
+		return err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password))
+	if err != nil {
+		return NewAPIError(http.StatusForbidden, "current password is incorrect")
+	}
+
+	return nil
+}
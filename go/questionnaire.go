@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type AnswerType string
+
+const (
+	TextAnswer   AnswerType = "text"
+	YesNoAnswer  AnswerType = "yes_no"
+	NumberAnswer AnswerType = "number"
+	ChoiceAnswer AnswerType = "choice"
+)
+
+const (
+	// goto target that finishes the interview
+	END_OF_INTERVIEW    = "end"
+	MAX_ANSWER_LENGTH   = 1000
+	MAX_QUESTION_ID_LEN = 50
+)
+
+// Condition on the answer of an earlier (or the current) question. Only one
+// comparison is expected to be set, text comparisons ignore case.
+type Condition struct {
+	Question    string   `json:"question,omitempty"`
+	Equals      *string  `json:"equals,omitempty"`
+	Contains    *string  `json:"contains,omitempty"`
+	GreaterThan *float64 `json:"greaterThan,omitempty"`
+	LessThan    *float64 `json:"lessThan,omitempty"`
+}
+
+type Branch struct {
+	When Condition `json:"when"`
+	Goto string    `json:"goto"`
+}
+
+// Branches are checked in order and the first match wins. Without a match
+// the interview goes to Next, or to the following question in the list when
+// Next is empty.
+type Question struct {
+	Id           string                           `json:"id"`
+	Text         string                           `json:"text"`
+	Type         AnswerType                       `json:"type"`
+	Options      []string                         `json:"options,omitempty"`
+	Next         string                           `json:"next,omitempty"`
+	Branches     []Branch                         `json:"branches,omitempty"`
+	Translations map[Language]QuestionTranslation `json:"translations,omitempty"`
+}
+
+// Options are listed in the same order as the ones of the question
+type QuestionTranslation struct {
+	Text    string   `json:"text"`
+	Options []string `json:"options,omitempty"`
+}
+
+type QuestionnaireDefinition struct {
+	// language of the question texts, branching rules compare against
+	// answers in this language
+	Language  Language   `json:"language,omitempty"`
+	Start     string     `json:"start,omitempty"`
+	Questions []Question `json:"questions"`
+}
+
+type Questionnaire struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Version int    `json:"version"`
+	QuestionnaireDefinition
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Immutable snapshot of a questionnaire, reports point to the version the
+// patient answered
+type QuestionnaireVersion struct {
+	QuestionnaireId int    `json:"questionnaireId"`
+	Version         int    `json:"version"`
+	Name            string `json:"name"`
+	QuestionnaireDefinition
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type QuestionnaireRequest struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	QuestionnaireDefinition
+}
+
+func (q QuestionnaireDefinition) question(id string) (Question, bool) {
+	for _, question := range q.Questions {
+		if question.Id == id {
+			return question, true
+		}
+	}
+
+	return Question{}, false
+}
+
+// localized returns the question as asked in l, keeping the original text
+// when there is no translation
+func (question Question) localized(l Language) Question {
+	t, ok := question.Translations[l]
+	if !ok {
+		return question
+	}
+
+	question.Text = t.Text
+	if len(t.Options) == len(question.Options) {
+		question.Options = t.Options
+	}
+	return question
+}
+
+// canonicalAnswer maps a choice picked in a translation back to the option
+// of the questionnaire language, other answers are returned as is
+func (question Question) canonicalAnswer(l Language, answer string) string {
+	if question.Type != ChoiceAnswer {
+		return answer
+	}
+
+	options := question.localized(l).Options
+	for i, o := range options {
+		if o == answer {
+			return question.Options[i]
+		}
+	}
+
+	return answer
+}
+
+func (q QuestionnaireDefinition) first() string {
+	if q.Start != "" {
+		return q.Start
+	}
+
+	if len(q.Questions) > 0 {
+		return q.Questions[0].Id
+	}
+
+	return END_OF_INTERVIEW
+}
+
+func (c Condition) matches(answer string) bool {
+	answer = strings.TrimSpace(answer)
+
+	if c.Equals != nil {
+		return strings.EqualFold(answer, *c.Equals)
+	}
+
+	if c.Contains != nil {
+		return strings.Contains(strings.ToLower(answer), strings.ToLower(*c.Contains))
+	}
+
+	n, err := strconv.ParseFloat(answer, 64)
+	if err != nil {
+		return false
+	}
+
+	if c.GreaterThan != nil && n <= *c.GreaterThan {
+		return false
+	}
+
+	if c.LessThan != nil && n >= *c.LessThan {
+		return false
+	}
+
+	return c.GreaterThan != nil || c.LessThan != nil
+}
+
+// next returns the id of the question following current given the answers
+// so far, or END_OF_INTERVIEW
+func (q QuestionnaireDefinition) next(current string, answers []QA) string {
+	answerOf := func(id string) (string, bool) {
+		for i := len(answers) - 1; i >= 0; i-- {
+			if answers[i].QuestionId == id {
+				return answers[i].canonical(), true
+			}
+		}
+		return "", false
+	}
+
+	for i, question := range q.Questions {
+		if question.Id != current {
+			continue
+		}
+
+		for _, b := range question.Branches {
+			target := b.When.Question
+			if target == "" {
+				target = current
+			}
+
+			if answer, ok := answerOf(target); ok && b.When.matches(answer) {
+				return b.Goto
+			}
+		}
+
+		if question.Next != "" {
+			return question.Next
+		}
+
+		if i+1 < len(q.Questions) {
+			return q.Questions[i+1].Id
+		}
+	}
+
+	return END_OF_INTERVIEW
+}
+
+func (question Question) validateAnswer(answer string) []string {
+	errs := make([]string, 0)
+	answer = strings.TrimSpace(answer)
+
+	if len(answer) == 0 {
+		return append(errs, "answer must not be empty")
+	}
+
+	if len(answer) > MAX_ANSWER_LENGTH {
+		errs = append(errs, fmt.Sprintf("answer must not exceed %d characters", MAX_ANSWER_LENGTH))
+	}
+
+	switch question.Type {
+	case YesNoAnswer:
+		if answer != "yes" && answer != "no" {
+			errs = append(errs, "answer must be yes or no")
+		}
+	case NumberAnswer:
+		if _, err := strconv.ParseFloat(answer, 64); err != nil {
+			errs = append(errs, "answer must be a number")
+		}
+	case ChoiceAnswer:
+		valid := false
+		for _, o := range question.Options {
+			if o == answer {
+				valid = true
+			}
+		}
+		if !valid {
+			errs = append(errs, "answer must be one of the options")
+		}
+	}
+
+	return errs
+}
+
+func (r QuestionnaireRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Name) < 3 {
+		errs["name"] = append(errs["name"], "name must be at least 3 characters long")
+	}
+
+	if len(r.Questions) == 0 {
+		errs["questions"] = append(errs["questions"], "questionnaire must have at least one question")
+	}
+
+	if r.Language != "" && !r.Language.valid() {
+		errs["language"] = append(errs["language"], "unsupported language")
+	}
+
+	ids := make(map[string]bool)
+	for i, q := range r.Questions {
+		field := fmt.Sprintf("questions[%d]", i)
+
+		if q.Id == "" || q.Id == END_OF_INTERVIEW || len(q.Id) > MAX_QUESTION_ID_LEN {
+			errs[field] = append(errs[field], "invalid question id")
+		}
+
+		if ids[q.Id] {
+			errs[field] = append(errs[field], "duplicated question id")
+		}
+		ids[q.Id] = true
+
+		if len(q.Text) == 0 {
+			errs[field] = append(errs[field], "question text missing")
+		}
+
+		switch q.Type {
+		case TextAnswer, YesNoAnswer, NumberAnswer:
+		case ChoiceAnswer:
+			if len(q.Options) < 2 {
+				errs[field] = append(errs[field], "choice questions need at least 2 options")
+			}
+		default:
+			errs[field] = append(errs[field], "invalid answer type")
+		}
+
+		for l, t := range q.Translations {
+			if !l.valid() {
+				errs[field] = append(errs[field], fmt.Sprintf("unsupported translation language %q", l))
+			}
+
+			if len(t.Text) == 0 {
+				errs[field] = append(errs[field], fmt.Sprintf("%s translation text missing", l))
+			}
+
+			if q.Type == ChoiceAnswer && len(t.Options) != len(q.Options) {
+				errs[field] = append(errs[field], fmt.Sprintf("%s translation must have one option per question option", l))
+			}
+		}
+	}
+
+	exists := func(id string) bool {
+		return id == END_OF_INTERVIEW || ids[id]
+	}
+
+	if r.Start != "" && !exists(r.Start) {
+		errs["start"] = append(errs["start"], "start question does not exist")
+	}
+
+	for i, q := range r.Questions {
+		field := fmt.Sprintf("questions[%d]", i)
+
+		if q.Next != "" && !exists(q.Next) {
+			errs[field] = append(errs[field], "next question does not exist")
+		}
+
+		for _, b := range q.Branches {
+			if !exists(b.Goto) {
+				errs[field] = append(errs[field], fmt.Sprintf("branch target %q does not exist", b.Goto))
+			}
+
+			if b.When.Question != "" && !ids[b.When.Question] {
+				errs[field] = append(errs[field], fmt.Sprintf("branch condition question %q does not exist", b.When.Question))
+			}
+		}
+	}
+
+	if len(errs) == 0 && r.QuestionnaireDefinition.hasCycle() {
+		errs["questions"] = append(errs["questions"], "questions must not loop back")
+	}
+
+	return errs
+}
+
+// hasCycle walks every possible path, an interview has to finish no matter
+// what the patient answers
+func (q QuestionnaireDefinition) hasCycle() bool {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		if id == END_OF_INTERVIEW {
+			return false
+		}
+
+		switch state[id] {
+		case visiting:
+			return true
+		case done:
+			return false
+		}
+		state[id] = visiting
+
+		for i, question := range q.Questions {
+			if question.Id != id {
+				continue
+			}
+
+			targets := make([]string, 0, len(question.Branches)+1)
+			for _, b := range question.Branches {
+				targets = append(targets, b.Goto)
+			}
+
+			if question.Next != "" {
+				targets = append(targets, question.Next)
+			} else if i+1 < len(q.Questions) {
+				targets = append(targets, q.Questions[i+1].Id)
+			}
+
+			for _, t := range targets {
+				if visit(t) {
+					return true
+				}
+			}
+		}
+
+		state[id] = done
+		return false
+	}
+
+	return visit(q.first())
+}
+
+func (s *Server) handleGetQuestionnaires(w http.ResponseWriter, r *http.Request) error {
+	q := `SELECT q.questionnaire_id, q.name, q.active, q.current_version, v.definition, v.created_at
+	FROM questionnaire q JOIN questionnaire_version v
+	ON v.questionnaire_id = q.questionnaire_id AND v.version = q.current_version
+	ORDER BY q.questionnaire_id`
+
+	rows, err := s.db.Query(context.Background(), q)
+	if err != nil {
+		fmt.Println("db error:", err.Error())
+		return InternalError()
+	}
+	defer rows.Close()
+
+	output := make([]Questionnaire, 0)
+	for rows.Next() {
+		var qn Questionnaire
+		err := rows.Scan(&qn.Id, &qn.Name, &qn.Active, &qn.Version, &qn.QuestionnaireDefinition, &qn.UpdatedAt)
+		if err != nil {
+			fmt.Println("scan error:", err.Error())
+			return InternalError()
+		}
+		output = append(output, qn)
+	}
+
+	return writeJSON(w, http.StatusOK, output)
+}
+
+func (s *Server) handleGetQuestionnaireById(w http.ResponseWriter, r *http.Request) error {
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	qn, err := s.getQuestionnaire(id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "questionnaire does not exist")
+		}
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, qn)
+}
+
+func (s *Server) handleGetQuestionnaireVersions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	q := `SELECT questionnaire_id, version, name, definition, created_at
+	FROM questionnaire_version WHERE questionnaire_id = $1 ORDER BY version`
+
+	rows, err := s.db.Query(context.Background(), q, id)
+	if err != nil {
+		fmt.Println("db error:", err.Error())
+		return InternalError()
+	}
+	defer rows.Close()
+
+	output := make([]QuestionnaireVersion, 0)
+	for rows.Next() {
+		var v QuestionnaireVersion
+		err := rows.Scan(&v.QuestionnaireId, &v.Version, &v.Name, &v.QuestionnaireDefinition, &v.CreatedAt)
+		if err != nil {
+			fmt.Println("scan error:", err.Error())
+			return InternalError()
+		}
+		output = append(output, v)
+	}
+
+	if len(output) == 0 {
+		return NewAPIError(http.StatusNotFound, "questionnaire does not exist")
+	}
+
+	return writeJSON(w, http.StatusOK, output)
+}
+
+func (s *Server) handleGetQuestionnaireVersion(w http.ResponseWriter, r *http.Request) error {
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	version, err := getPathId("version", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	v, err := s.getQuestionnaireVersion(id, version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "questionnaire version does not exist")
+		}
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) handleCreateQuestionnaire(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageQuestionnaires); err != nil {
+		return err
+	}
+
+	var req QuestionnaireRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `INSERT INTO questionnaire(name, active, current_version)
+	VALUES($1, $2, 1) RETURNING questionnaire_id`
+
+	var id int
+	err = tx.QueryRow(ctx, q, req.Name, req.Active).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	q = `INSERT INTO questionnaire_version(questionnaire_id, version, name, definition, created_at)
+	VALUES($1, 1, $2, $3, $4)`
+
+	_, err = tx.Exec(ctx, q, id, req.Name, req.QuestionnaireDefinition, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	qn, err := s.getQuestionnaire(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, qn)
+}
+
+// handleUpdateQuestionnaire never changes an existing version, edits to the
+// name or questions are stored as a new version. Toggling active does not
+// create one.
+func (s *Server) handleUpdateQuestionnaire(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageQuestionnaires); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req QuestionnaireRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `SELECT q.current_version, v.name, v.definition
+	FROM questionnaire q JOIN questionnaire_version v
+	ON v.questionnaire_id = q.questionnaire_id AND v.version = q.current_version
+	WHERE q.questionnaire_id = $1 FOR UPDATE OF q`
+
+	var version int
+	var currentName string
+	var currentDefinition QuestionnaireDefinition
+	err = tx.QueryRow(ctx, q, id).Scan(&version, &currentName, &currentDefinition)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "questionnaire does not exist")
+		}
+		return err
+	}
+
+	current, err := json.Marshal(currentDefinition)
+	if err != nil {
+		return err
+	}
+
+	updated, err := json.Marshal(req.QuestionnaireDefinition)
+	if err != nil {
+		return err
+	}
+
+	if currentName != req.Name || string(current) != string(updated) {
+		version++
+
+		q = `INSERT INTO questionnaire_version(questionnaire_id, version, name, definition, created_at)
+		VALUES($1, $2, $3, $4, $5)`
+
+		_, err = tx.Exec(ctx, q, id, version, req.Name, req.QuestionnaireDefinition, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	q = `UPDATE questionnaire SET name = $1, active = $2, current_version = $3
+	WHERE questionnaire_id = $4`
+
+	_, err = tx.Exec(ctx, q, req.Name, req.Active, version, id)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	qn, err := s.getQuestionnaire(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, qn)
+}
+
+// getQuestionnaire returns the questionnaire with its current version
+func (s *Server) getQuestionnaire(id int) (Questionnaire, error) {
+	q := `SELECT q.questionnaire_id, q.name, q.active, q.current_version, v.definition, v.created_at
+	FROM questionnaire q JOIN questionnaire_version v
+	ON v.questionnaire_id = q.questionnaire_id AND v.version = q.current_version
+	WHERE q.questionnaire_id = $1`
+
+	var qn Questionnaire
+	err := s.db.QueryRow(context.Background(), q, id).Scan(
+		&qn.Id, &qn.Name, &qn.Active, &qn.Version, &qn.QuestionnaireDefinition, &qn.UpdatedAt)
+
+	return qn, err
+}
+
+// getQuestionnaireVersion is cached for the lifetime of the server, versions
+// are never modified once written
+func (s *Server) getQuestionnaireVersion(id int, version int) (QuestionnaireVersion, error) {
+	key := [2]int{id, version}
+	if v, ok := s.questionnaireVersions.Load(key); ok {
+		return v.(QuestionnaireVersion), nil
+	}
+
+	q := `SELECT questionnaire_id, version, name, definition, created_at
+	FROM questionnaire_version WHERE questionnaire_id = $1 AND version = $2`
+
+	var v QuestionnaireVersion
+	err := s.db.QueryRow(context.Background(), q, id, version).Scan(
+		&v.QuestionnaireId, &v.Version, &v.Name, &v.QuestionnaireDefinition, &v.CreatedAt)
+	if err != nil {
+		return v, err
+	}
+
+	s.questionnaireVersions.Store(key, v)
+	return v, nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_LIMIT_DEFAULT_AUTH_PER_MINUTE    = 10
+	RATE_LIMIT_DEFAULT_AUTH_BURST         = 5
+	RATE_LIMIT_DEFAULT_REPORTS_PER_MINUTE = 6
+	RATE_LIMIT_DEFAULT_REPORTS_BURST      = 3
+
+	LOGIN_DEFAULT_MAX_FAILURES = 5
+	LOGIN_DEFAULT_LOCKOUT      = time.Minute
+	LOGIN_DEFAULT_MAX_LOCKOUT  = time.Hour
+
+	RATE_LIMIT_CLEANUP_INTERVAL = 5 * time.Minute
+	// lockouts are forgotten after a day without failures
+	LOGIN_FAILURE_MEMORY = 24 * time.Hour
+)
+
+// RateLimit is a token bucket: Burst requests at once, refilled at PerMinute
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// rateLimiter keeps one bucket per key in memory, a restart forgets them
+type rateLimiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	l := &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+	}
+	go l.cleanup()
+
+	return l
+}
+
+// allow takes a token from the key's bucket, or tells how long until one is
+// available
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(l.limit.PerMinute) / 60
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	return false, wait
+}
+
+// cleanup drops buckets that refilled completely, they are the same as new ones
+func (l *rateLimiter) cleanup() {
+	full := time.Duration(float64(l.limit.Burst) / float64(l.limit.PerMinute) * float64(time.Minute))
+	for {
+		time.Sleep(RATE_LIMIT_CLEANUP_INTERVAL)
+
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) > full {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func rateLimitMiddleware(l *rateLimiter, key func(r *http.Request) string, handler APIFunc) APIFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if ok, wait := l.allow(key(r)); !ok {
+			return TooManyRequests(wait)
+		}
+
+		return handler(w, r)
+	}
+}
+
+// trustProxyHeaders makes clientIP use X-Forwarded-For, only enable it behind
+// a proxy that sets the header, clients could pick their own key otherwise
+var trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			// the last entry was added by our proxy, the others by the client
+			parts := strings.Split(fwd, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// deviceKey limits kiosks by their id when they send a valid token, reports
+// may also be created without it, those are limited by address. Unknown
+// tokens are limited by address too, or every made up token would get a
+// bucket of its own.
+func (s *Server) deviceKey(r *http.Request) string {
+	if token := r.Header.Get("X-Kiosk-Token"); token != "" {
+		if kioskId, _, err := s.activeKiosk(token); err == nil {
+			return "kiosk:" + strconv.Itoa(kioskId)
+		}
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// loginGuard locks an account out after MaxFailures wrong passwords in a
+// row, for Lockout the first time and twice as long on every lockout after
+// that, up to MaxLockout. It is keyed by the email typed in, whether an
+// employee has it or not, so lockouts say nothing about which emails exist.
+type loginGuard struct {
+	MaxFailures int
+	Lockout     time.Duration
+	MaxLockout  time.Duration
+
+	mu       sync.Mutex
+	accounts map[string]*loginFailures
+}
+
+type loginFailures struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+func newLoginGuard(maxFailures int, lockout time.Duration, maxLockout time.Duration) *loginGuard {
+	g := &loginGuard{
+		MaxFailures: maxFailures,
+		Lockout:     lockout,
+		MaxLockout:  maxLockout,
+		accounts:    make(map[string]*loginFailures),
+	}
+	go g.cleanup()
+
+	return g
+}
+
+func loginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// locked returns how long the account stays locked, 0 when it is not
+func (g *loginGuard) locked(email string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	a, ok := g.accounts[loginKey(email)]
+	if !ok {
+		return 0
+	}
+
+	return max(time.Until(a.lockedUntil), 0)
+}
+
+func (g *loginGuard) fail(email string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := loginKey(email)
+	a, ok := g.accounts[key]
+	if !ok || time.Since(a.lastFailure) > LOGIN_FAILURE_MEMORY {
+		a = &loginFailures{}
+		g.accounts[key] = a
+	}
+
+	a.failures++
+	a.lastFailure = time.Now()
+	if a.failures < g.MaxFailures {
+		return
+	}
+
+	lockout := g.Lockout
+	for i := 0; i < a.lockouts && lockout < g.MaxLockout; i++ {
+		lockout *= 2
+	}
+
+	a.lockedUntil = time.Now().Add(min(lockout, g.MaxLockout))
+	a.lockouts++
+	a.failures = 0
+}
+
+func (g *loginGuard) succeed(email string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.accounts, loginKey(email))
+}
+
+func (g *loginGuard) cleanup() {
+	for {
+		time.Sleep(RATE_LIMIT_CLEANUP_INTERVAL)
+
+		g.mu.Lock()
+		for key, a := range g.accounts {
+			if time.Since(a.lastFailure) > LOGIN_FAILURE_MEMORY && time.Now().After(a.lockedUntil) {
+				delete(g.accounts, key)
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+func envRateLimit(prefix string, perMinute int, burst int) RateLimit {
+	limit := RateLimit{PerMinute: perMinute, Burst: burst}
+	if n := envInt(prefix + "_PER_MINUTE"); n > 0 {
+		limit.PerMinute = n
+	}
+	if n := envInt(prefix + "_BURST"); n > 0 {
+		limit.Burst = n
+	}
+
+	return limit
+}
+
+func (s *Server) initRateLimits() {
+	s.authLimiter = newRateLimiter(envRateLimit("RATE_LIMIT_AUTH",
+		RATE_LIMIT_DEFAULT_AUTH_PER_MINUTE, RATE_LIMIT_DEFAULT_AUTH_BURST))
+	s.reportLimiter = newRateLimiter(envRateLimit("RATE_LIMIT_REPORTS",
+		RATE_LIMIT_DEFAULT_REPORTS_PER_MINUTE, RATE_LIMIT_DEFAULT_REPORTS_BURST))
+
+	maxFailures := LOGIN_DEFAULT_MAX_FAILURES
+	if n := envInt("LOGIN_MAX_FAILURES"); n > 0 {
+		maxFailures = n
+	}
+
+	s.logins = newLoginGuard(maxFailures,
+		envDuration("LOGIN_LOCKOUT", LOGIN_DEFAULT_LOCKOUT),
+		envDuration("LOGIN_MAX_LOCKOUT", LOGIN_DEFAULT_MAX_LOCKOUT))
+}
+
+// limitAuth throttles the unauthenticated endpoints that run bcrypt or send
+// mail, per client address
+func (s *Server) limitAuth(handler APIFunc) APIFunc {
+	return rateLimitMiddleware(s.authLimiter, clientIP, handler)
+}
+
+func (s *Server) limitReports(handler APIFunc) APIFunc {
+	return rateLimitMiddleware(s.reportLimiter, s.deviceKey, handler)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const RECORDING_MAX_BYTES = 5 << 20
+
+// Audio of a single answer as captured by the kiosk, together with the raw
+// speech to text output the answer was taken from
+type Recording struct {
+	Id          int    `json:"id"`
+	ReportId    *int   `json:"reportId"`
+	QuestionId  string `json:"questionId"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	Transcript  string `json:"transcript"`
+	// recognizer confidence between 0 and 1, when the kiosk reported one
+	Confidence *float32  `json:"confidence"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type UploadRecordingRequest struct {
+	QuestionId  string
+	Transcript  string
+	Confidence  *float32
+	ContentType string
+	Audio       []byte
+}
+
+func (r UploadRecordingRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.QuestionId) == 0 {
+		errs["questionId"] = append(errs["questionId"], "question id missing")
+	}
+
+	if len(r.Audio) == 0 {
+		errs["audio"] = append(errs["audio"], "audio missing")
+	}
+
+	if !strings.HasPrefix(r.ContentType, "audio/") {
+		errs["audio"] = append(errs["audio"], "audio must have an audio/* content type")
+	}
+
+	if r.Confidence != nil && (*r.Confidence < 0 || *r.Confidence > 1) {
+		errs["confidence"] = append(errs["confidence"], "confidence must be between 0 and 1")
+	}
+
+	return errs
+}
+
+// handleUploadRecording stores the clip of one answer, sent by the kiosk as
+// multipart form with questionId, transcript, confidence and audio fields.
+// Uploading again for the same question replaces the previous clip.
+func (s *Server) handleUploadRecording(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.getInterviewSession(r.PathValue("sessionId"))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "interview session does not exist")
+		}
+		return err
+	}
+
+	if !session.AudioConsent {
+		return NewAPIError(http.StatusForbidden, "patient did not consent to audio recording")
+	}
+
+	if session.expired() {
+		return NewAPIError(http.StatusGone, "interview session expired")
+	}
+
+	if session.Status == InterviewSubmitted {
+		return NewAPIError(http.StatusConflict, "interview already submitted")
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, RECORDING_MAX_BYTES)
+	if err := r.ParseMultipartForm(RECORDING_MAX_BYTES); err != nil {
+		return NewAPIError(http.StatusBadRequest, "invalid multipart form or recording too large")
+	}
+
+	req := UploadRecordingRequest{
+		QuestionId: r.FormValue("questionId"),
+		Transcript: strings.TrimSpace(r.FormValue("transcript")),
+	}
+
+	if v := r.FormValue("confidence"); v != "" {
+		c, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+				"confidence": {"confidence must be a number"},
+			})
+		}
+		confidence := float32(c)
+		req.Confidence = &confidence
+	}
+
+	f, header, err := r.FormFile("audio")
+	if err == nil {
+		req.ContentType = header.Header.Get("Content-Type")
+		req.Audio, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if !session.asked(req.QuestionId) {
+		return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"questionId": {"question was not asked in this interview"},
+		})
+	}
+
+	rec := Recording{
+		QuestionId:  req.QuestionId,
+		ContentType: req.ContentType,
+		Size:        len(req.Audio),
+		Transcript:  req.Transcript,
+		Confidence:  req.Confidence,
+		CreatedAt:   time.Now(),
+	}
+
+	q := `INSERT INTO interview_recording(session_id, question_id, content_type, size,
+	audio, transcript, confidence, created_at)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+	ON CONFLICT (session_id, question_id) DO UPDATE SET content_type = EXCLUDED.content_type,
+	size = EXCLUDED.size, audio = EXCLUDED.audio, transcript = EXCLUDED.transcript,
+	confidence = EXCLUDED.confidence, created_at = EXCLUDED.created_at
+	RETURNING recording_id`
+
+	err = s.db.QueryRow(context.Background(), q, session.Id, rec.QuestionId, rec.ContentType, rec.Size,
+		sealed(SEALED_RECORDING_AUDIO, req.Audio), sealed(SEALED_RECORDING_TRANSCRIPT, rec.Transcript), rec.Confidence, rec.CreatedAt).Scan(&rec.Id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, rec)
+}
+
+// asked reports whether the question was answered or is being asked now
+func (s *InterviewSession) asked(questionId string) bool {
+	if s.currentQuestion != nil && *s.currentQuestion == questionId {
+		return true
+	}
+
+	for _, qa := range s.Answers {
+		if qa.QuestionId == questionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) handleGetReportRecordings(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermAccessRecordings); err != nil {
+		return err
+	}
+
+	reportId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	if err := s.requireReportFacility(r, reportId); err != nil {
+		return err
+	}
+
+	rep, err := s.getReportById(reportId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "report does not exist")
+		}
+		return err
+	}
+
+	recordings, err := s.getReportRecordings(reportId)
+	if err != nil {
+		return err
+	}
+
+	s.auditRequest(r, AuditViewRecordings, &rep.Patient.Id, &rep.Id)
+
+	return writeJSON(w, http.StatusOK, recordings)
+}
+
+func (s *Server) handleGetRecordingAudio(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermAccessRecordings); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	q := `SELECT rec.content_type, rec.audio, rec.created_at, rec.report_id, rep.patient_id
+	FROM interview_recording rec JOIN report rep ON rec.report_id = rep.report_id
+	WHERE rec.recording_id = $1`
+
+	var contentType string
+	var audio []byte
+	var createdAt time.Time
+	var reportId, patientId int
+	err = s.db.QueryRow(context.Background(), q, id).Scan(
+		&contentType, unseal(SEALED_RECORDING_AUDIO, &audio), &createdAt, &reportId, &patientId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "recording does not exist")
+		}
+		return err
+	}
+
+	if err := s.requireReportFacility(r, reportId); err != nil {
+		return err
+	}
+
+	s.auditRequest(r, AuditListenRecording, &patientId, &reportId)
+
+	// ServeContent handles range requests so players can seek
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, fmt.Sprintf("recording-%d", id), createdAt, bytes.NewReader(audio))
+	return nil
+}
+
+func (s *Server) getRecordingAudio(id int) ([]byte, error) {
+	var audio []byte
+	q := `SELECT audio FROM interview_recording WHERE recording_id = $1`
+	err := s.db.QueryRow(context.Background(), q, id).Scan(unseal(SEALED_RECORDING_AUDIO, &audio))
+
+	return audio, err
+}
+
+// recordingExtension guesses a file extension for exported clips
+func recordingExtension(contentType string) string {
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "audio/wav", "audio/x-wav", "audio/wave":
+		return ".wav"
+	case "audio/webm":
+		return ".webm"
+	case "audio/ogg":
+		return ".ogg"
+	case "audio/mpeg":
+		return ".mp3"
+	}
+
+	return ""
+}
+
+func (s *Server) getReportRecordings(reportId int) ([]Recording, error) {
+	q := `SELECT recording_id, report_id, question_id, content_type, size, transcript, confidence, created_at
+	FROM interview_recording WHERE report_id = $1 ORDER BY recording_id`
+
+	rows, err := s.db.Query(context.Background(), q, reportId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recordings := make([]Recording, 0)
+	for rows.Next() {
+		var rec Recording
+		err := rows.Scan(&rec.Id, &rec.ReportId, &rec.QuestionId, &rec.ContentType, &rec.Size,
+			unseal(SEALED_RECORDING_TRANSCRIPT, &rec.Transcript), &rec.Confidence, &rec.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		recordings = append(recordings, rec)
+	}
+
+	return recordings, rows.Err()
+}
+
+// setReportRecordings links the interview answers to their recordings
+func (s *Server) setReportRecordings(rep *ReportOutput) error {
+	q := `SELECT recording_id, question_id FROM interview_recording WHERE report_id = $1`
+
+	rows, err := s.db.Query(context.Background(), q, rep.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var questionId string
+		if err := rows.Scan(&id, &questionId); err != nil {
+			return err
+		}
+		ids[questionId] = id
+	}
+
+	for i, qa := range rep.Interview {
+		if id, ok := ids[qa.QuestionId]; ok && qa.QuestionId != "" {
+			rep.Interview[i].RecordingId = &id
+		}
+	}
+
+	return rows.Err()
+}
+
+// purgeRecordings deletes audio and transcripts older than cutoff, attached
+// to a report or not
+func (s *Server) purgeRecordings(cutoff time.Time) (int, error) {
+	q := `DELETE FROM interview_recording WHERE created_at < $1`
+
+	tag, err := s.db.Exec(context.Background(), q, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
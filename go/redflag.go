@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/signintech/gopdf"
+	"golang.org/x/text/unicode/norm"
+)
+
+type RedFlagField string
+
+const (
+	RedFlagInterview   RedFlagField = "interview"
+	RedFlagDiseases    RedFlagField = "diseases"
+	RedFlagMedications RedFlagField = "medications"
+
+	MAX_RED_FLAG_TERM_LEN = 100
+)
+
+func (f RedFlagField) valid() bool {
+	return f == RedFlagInterview || f == RedFlagDiseases || f == RedFlagMedications
+}
+
+// Terms are matched on whole words, ignoring case and accents, so "dor no
+// peito" also matches "Dor no PEITO." but "pain" does not match "painting".
+// Every language's terms are checked against every answer, patients mix
+// languages more often than not.
+type RedFlagRule struct {
+	Id    int                   `json:"id"`
+	Name  string                `json:"name"`
+	Terms map[Language][]string `json:"terms"`
+	// fields scanned by the rule, all of them when empty
+	Fields    []RedFlagField `json:"fields"`
+	Urgency   Urgency        `json:"urgency"`
+	Active    bool           `json:"active"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+type RedFlagRuleRequest struct {
+	Name    string                `json:"name"`
+	Terms   map[Language][]string `json:"terms"`
+	Fields  []RedFlagField        `json:"fields"`
+	Urgency Urgency               `json:"urgency"`
+	Active  bool                  `json:"active"`
+}
+
+func (r RedFlagRuleRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Name) < 3 || len(r.Name) > 100 {
+		errs["name"] = append(errs["name"], "name must be between 3 and 100 characters long")
+	}
+
+	if r.Urgency != Green && r.Urgency != Yellow && r.Urgency != Red {
+		errs["urgency"] = append(errs["urgency"], "urgency must be green, yellow or red")
+	}
+
+	if len(r.Terms) == 0 {
+		errs["terms"] = append(errs["terms"], "rule must have at least one term")
+	}
+
+	for l, terms := range r.Terms {
+		field := fmt.Sprintf("terms.%s", l)
+
+		if !l.valid() {
+			errs[field] = append(errs[field], "unsupported language")
+		}
+
+		if len(terms) == 0 {
+			errs[field] = append(errs[field], "language must have at least one term")
+		}
+
+		for _, t := range terms {
+			if len(words(t)) == 0 || len(t) > MAX_RED_FLAG_TERM_LEN {
+				errs[field] = append(errs[field], fmt.Sprintf("invalid term %q", t))
+			}
+		}
+	}
+
+	for _, f := range r.Fields {
+		if !f.valid() {
+			errs["fields"] = append(errs["fields"], fmt.Sprintf("invalid field %q", f))
+		}
+	}
+
+	return errs
+}
+
+func (rule RedFlagRule) scans(f RedFlagField) bool {
+	if len(rule.Fields) == 0 {
+		return true
+	}
+
+	for _, field := range rule.Fields {
+		if field == f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A term found in the report. Start and End are character offsets into the
+// text, for highlighting.
+type RedFlag struct {
+	RuleId  int          `json:"ruleId"`
+	Rule    string       `json:"rule"`
+	Urgency Urgency      `json:"urgency"`
+	Field   RedFlagField `json:"field"`
+	// position in the interview, diseases or medications list
+	Index int `json:"index"`
+	// set when the term was found in the translation of an interview answer
+	// instead of the answer itself
+	Translation bool   `json:"translation,omitempty"`
+	Term        string `json:"term"`
+	// the text as the patient wrote or said it
+	Match string `json:"match"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// urgencyRank orders urgencies from least to most urgent, like the database
+// enum does
+func urgencyRank(u Urgency) int {
+	switch u {
+	case Green:
+		return 1
+	case Yellow:
+		return 2
+	case Red:
+		return 3
+	}
+
+	return 0
+}
+
+// suggestedUrgency is the most urgent of the flags
+func suggestedUrgency(flags []RedFlag) Urgency {
+	u := Undefined
+	for _, f := range flags {
+		if urgencyRank(f.Urgency) > urgencyRank(u) {
+			u = f.Urgency
+		}
+	}
+
+	return u
+}
+
+type word struct {
+	text       string
+	start, end int
+}
+
+// words splits text on anything that is not a letter or digit, lowercased
+// and without accents. Offsets are in characters of the original text.
+func words(text string) []word {
+	out := make([]word, 0)
+	var current []rune
+	start := 0
+
+	runes := []rune(text)
+	for i, r := range runes {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(current) == 0 {
+				start = i
+			}
+			current = append(current, foldRune(r))
+			continue
+		}
+
+		// combining accents written apart from their letter are skipped
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		if len(current) > 0 {
+			out = append(out, word{text: string(current), start: start, end: i})
+			current = nil
+		}
+	}
+
+	if len(current) > 0 {
+		out = append(out, word{text: string(current), start: start, end: len(runes)})
+	}
+
+	return out
+}
+
+// foldRune lowercases r and drops its accent, keeping one rune per rune so
+// offsets stay valid
+func foldRune(r rune) rune {
+	decomposed := []rune(norm.NFD.String(string(unicode.ToLower(r))))
+	if len(decomposed) == 0 {
+		return r
+	}
+
+	return decomposed[0]
+}
+
+// find returns the spans of text where the term appears as a sequence of
+// whole words
+func find(text []word, term []word) [][2]int {
+	spans := make([][2]int, 0)
+	if len(term) == 0 {
+		return spans
+	}
+
+	for i := 0; i+len(term) <= len(text); i++ {
+		matched := true
+		for j := range term {
+			if text[i+j].text != term[j].text {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			spans = append(spans, [2]int{text[i].start, text[i+len(term)-1].end})
+		}
+	}
+
+	return spans
+}
+
+// detectRedFlags runs the rules over the interview answers, diseases and
+// medications. Matches of the same rule that overlap, like "chest pain" and
+// "pain", are reported once, keeping the longest.
+func detectRedFlags(rules []RedFlagRule, rep ReportBase) []RedFlag {
+	flags := make([]RedFlag, 0)
+
+	scan := func(f RedFlagField, index int, translation bool, text string) {
+		textWords := words(text)
+		runes := []rune(text)
+
+		for _, rule := range rules {
+			if !rule.scans(f) {
+				continue
+			}
+
+			found := make([]RedFlag, 0)
+			for _, terms := range rule.Terms {
+				for _, term := range terms {
+					for _, span := range find(textWords, words(term)) {
+						found = append(found, RedFlag{
+							RuleId:      rule.Id,
+							Rule:        rule.Name,
+							Urgency:     rule.Urgency,
+							Field:       f,
+							Index:       index,
+							Translation: translation,
+							Term:        term,
+							Match:       string(runes[span[0]:span[1]]),
+							Start:       span[0],
+							End:         span[1],
+						})
+					}
+				}
+			}
+
+			sort.Slice(found, func(i, j int) bool {
+				if found[i].Start != found[j].Start {
+					return found[i].Start < found[j].Start
+				}
+				return found[i].End > found[j].End
+			})
+
+			end := -1
+			for _, flag := range found {
+				if flag.Start >= end {
+					flags = append(flags, flag)
+					end = flag.End
+				}
+			}
+		}
+	}
+
+	for i, qa := range rep.Interview {
+		scan(RedFlagInterview, i, false, qa.Answer)
+		if qa.Translation != nil {
+			scan(RedFlagInterview, i, true, *qa.Translation)
+		}
+	}
+
+	for i, d := range rep.Diseases {
+		scan(RedFlagDiseases, i, false, d)
+	}
+
+	for i, m := range rep.Medications {
+		scan(RedFlagMedications, i, false, m)
+	}
+
+	return flags
+}
+
+// highlights returns the merged spans flagged in a single text, sorted
+func highlights(flags []RedFlag, f RedFlagField, index int, translation bool) [][2]int {
+	spans := make([][2]int, 0)
+	for _, flag := range flags {
+		if flag.Field == f && flag.Index == index && flag.Translation == translation {
+			spans = append(spans, [2]int{flag.Start, flag.End})
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	merged := make([][2]int, 0, len(spans))
+	for _, span := range spans {
+		last := len(merged) - 1
+		if last >= 0 && span[0] <= merged[last][1] {
+			merged[last][1] = max(merged[last][1], span[1])
+			continue
+		}
+		merged = append(merged, span)
+	}
+
+	return merged
+}
+
+func (s *Server) getActiveRedFlagRules() ([]RedFlagRule, error) {
+	return s.queryRedFlagRules(`WHERE active`)
+}
+
+func (s *Server) queryRedFlagRules(where string) ([]RedFlagRule, error) {
+	q := `SELECT rule_id, name, terms, fields, urgency, active, updated_at
+	FROM red_flag_rule ` + where + ` ORDER BY rule_id`
+
+	rows, err := s.db.Query(context.Background(), q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]RedFlagRule, 0)
+	for rows.Next() {
+		var rule RedFlagRule
+		err := rows.Scan(&rule.Id, &rule.Name, &rule.Terms, &rule.Fields, &rule.Urgency, &rule.Active, &rule.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (s *Server) getRedFlagRule(id int) (RedFlagRule, error) {
+	q := `SELECT rule_id, name, terms, fields, urgency, active, updated_at
+	FROM red_flag_rule WHERE rule_id = $1`
+
+	var rule RedFlagRule
+	err := s.db.QueryRow(context.Background(), q, id).Scan(
+		&rule.Id, &rule.Name, &rule.Terms, &rule.Fields, &rule.Urgency, &rule.Active, &rule.UpdatedAt)
+
+	return rule, err
+}
+
+func (s *Server) handleGetRedFlagRules(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageRedFlags); err != nil {
+		return err
+	}
+
+	rules, err := s.queryRedFlagRules("")
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, rules)
+}
+
+func (s *Server) handleCreateRedFlagRule(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageRedFlags); err != nil {
+		return err
+	}
+
+	var req RedFlagRuleRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if req.Fields == nil {
+		req.Fields = make([]RedFlagField, 0)
+	}
+
+	q := `INSERT INTO red_flag_rule(name, terms, fields, urgency, active, updated_at)
+	VALUES($1, $2, $3, $4, $5, $6) RETURNING rule_id`
+
+	var id int
+	err = s.db.QueryRow(context.Background(), q,
+		req.Name, req.Terms, req.Fields, req.Urgency, req.Active, time.Now()).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	rule, err := s.getRedFlagRule(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, rule)
+}
+
+// handleUpdateRedFlagRule only affects reports created from now on, flags
+// already stored on reports are kept as they were raised
+func (s *Server) handleUpdateRedFlagRule(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageRedFlags); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req RedFlagRuleRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if req.Fields == nil {
+		req.Fields = make([]RedFlagField, 0)
+	}
+
+	q := `UPDATE red_flag_rule SET name = $1, terms = $2, fields = $3, urgency = $4,
+	active = $5, updated_at = $6 WHERE rule_id = $7`
+
+	tag, err := s.db.Exec(context.Background(), q,
+		req.Name, req.Terms, req.Fields, req.Urgency, req.Active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusNotFound, "red flag rule does not exist")
+	}
+
+	rule, err := s.getRedFlagRule(id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "red flag rule does not exist")
+		}
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, rule)
+}
+
+// pdfHighlighted writes text from the current position with the spans in
+// red, gopdf moves x past what was written
+func pdfHighlighted(pdf *gopdf.GoPdf, text string, spans [][2]int) {
+	runes := []rune(text)
+	last := 0
+	for _, span := range spans {
+		pdf.Text(string(runes[last:span[0]]))
+		pdf.SetTextColor(200, 0, 0)
+		pdf.Text(string(runes[span[0]:span[1]]))
+		pdf.SetTextColor(0, 0, 0)
+		last = span[1]
+	}
+	pdf.Text(string(runes[last:]))
+}
+
+// redFlagRuleNames lists the rules raised on a report, once each
+func redFlagRuleNames(flags []RedFlag) []string {
+	seen := make(map[int]bool)
+	names := make([]string, 0)
+	for _, f := range flags {
+		if !seen[f.RuleId] {
+			seen[f.RuleId] = true
+			names = append(names, f.Rule)
+		}
+	}
+
+	return names
+}
+
+// A report that raised red flags, listed until someone acknowledges it. Only
+// the rule names are kept, the matched text stays sealed on the report.
+type RedFlagAlert struct {
+	Id               int        `json:"id"`
+	ReportId         int        `json:"reportId"`
+	FacilityId       int        `json:"facilityId"`
+	Facility         string     `json:"facility"`
+	SuggestedUrgency Urgency    `json:"suggestedUrgency"`
+	Rules            []string   `json:"rules"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	AcknowledgedAt   *time.Time `json:"acknowledgedAt"`
+	AcknowledgedBy   *int       `json:"acknowledgedBy"`
+}
+
+type RedFlagConfig struct {
+	// alerts are mailed here, they are only listed otherwise
+	AlertEmails []string
+}
+
+func (s *Server) initRedFlags() {
+	s.redFlags = RedFlagConfig{
+		AlertEmails: envList("RED_FLAG_ALERT_EMAILS"),
+	}
+}
+
+// insertRedFlagAlert stores the alert in the transaction of the report, it
+// is mailed once the report is committed
+func insertRedFlagAlert(ctx context.Context, tx pgx.Tx, rep ReportOutput) (RedFlagAlert, error) {
+	alert := RedFlagAlert{
+		ReportId:         rep.Id,
+		FacilityId:       rep.FacilityId,
+		SuggestedUrgency: rep.SuggestedUrgency,
+		Rules:            redFlagRuleNames(rep.RedFlags),
+		CreatedAt:        rep.IssuedAt,
+	}
+
+	q := `INSERT INTO red_flag_alert(report_id, facility_id, suggested_urgency, rules, created_at)
+	VALUES($1, $2, $3, $4, $5)
+	RETURNING alert_id, (SELECT name FROM facility WHERE facility_id = $2)`
+
+	err := tx.QueryRow(ctx, q, alert.ReportId, alert.FacilityId, alert.SuggestedUrgency,
+		alert.Rules, alert.CreatedAt).Scan(&alert.Id, &alert.Facility)
+
+	return alert, err
+}
+
+func (s *Server) notifyRedFlagAlert(a RedFlagAlert) {
+	fmt.Printf("report %d raised red flags (%s), suggested urgency %s\n",
+		a.ReportId, strings.Join(a.Rules, ", "), a.SuggestedUrgency)
+
+	subject := fmt.Sprintf("Red flags on report %d at %s", a.ReportId, a.Facility)
+	body := fmt.Sprintf(`Report %d at %s raised red flags: %s.
+
+The suggested urgency is %s, the report has not been triaged yet.
+`, a.ReportId, a.Facility, strings.Join(a.Rules, ", "), a.SuggestedUrgency)
+
+	for _, email := range s.redFlags.AlertEmails {
+		go s.notifyEmployee(email, subject, body)
+	}
+}
+
+const redFlagAlertColumns = `a.alert_id, a.report_id, a.facility_id, f.name, a.suggested_urgency,
+	a.rules, a.created_at, a.acknowledged_at, a.acknowledged_by
+	FROM red_flag_alert a JOIN facility f ON f.facility_id = a.facility_id`
+
+func scanRedFlagAlert(row pgx.Row) (RedFlagAlert, error) {
+	var a RedFlagAlert
+	err := row.Scan(&a.Id, &a.ReportId, &a.FacilityId, &a.Facility, &a.SuggestedUrgency,
+		&a.Rules, &a.CreatedAt, &a.AcknowledgedAt, &a.AcknowledgedBy)
+
+	return a, err
+}
+
+// handleGetRedFlagAlerts lists the alerts of the employee's facilities, with
+// pending=true only the ones nobody acknowledged yet
+func (s *Server) handleGetRedFlagAlerts(w http.ResponseWriter, r *http.Request) error {
+	req, errs := parseStatsRequest(r)
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	pending := r.URL.Query().Get("pending") == "true"
+
+	q := `SELECT ` + redFlagAlertColumns + `
+	WHERE a.created_at >= $1 AND a.created_at < $2 AND ($3 OR a.facility_id = ANY($4))
+	AND (NOT $5 OR a.acknowledged_at IS NULL)
+	ORDER BY a.created_at DESC`
+
+	rows, err := s.db.Query(context.Background(), q, req.From, req.To, scope.all, scope.ids, pending)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	alerts := make([]RedFlagAlert, 0)
+	for rows.Next() {
+		a, err := scanRedFlagAlert(rows)
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, alerts)
+}
+
+func (s *Server) handleAcknowledgeRedFlagAlert(w http.ResponseWriter, r *http.Request) error {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	q := `SELECT ` + redFlagAlertColumns + ` WHERE a.alert_id = $1`
+
+	alert, err := scanRedFlagAlert(s.db.QueryRow(ctx, q, id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusNotFound, "red flag alert does not exist")
+		}
+		return err
+	}
+
+	if !scope.contains(alert.FacilityId) {
+		return NewAPIError(http.StatusNotFound, "red flag alert does not exist")
+	}
+
+	q = `UPDATE red_flag_alert SET acknowledged_at = $1, acknowledged_by = $2
+	WHERE alert_id = $3 AND acknowledged_at IS NULL`
+
+	now := time.Now()
+	tag, err := s.db.Exec(ctx, q, now, employeeId, id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusConflict, "red flag alert already acknowledged")
+	}
+
+	alert.AcknowledgedAt, alert.AcknowledgedBy = &now, &employeeId
+	return writeJSON(w, http.StatusOK, alert)
+}
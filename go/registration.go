@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type EmployeeStatus string
+
+const (
+	// self registered, can't log in until approved
+	EmployeePending  EmployeeStatus = "pending"
+	EmployeeActive   EmployeeStatus = "active"
+	EmployeeRejected EmployeeStatus = "rejected"
+	// left, kept so their consultations still show who attended
+	EmployeeDeactivated EmployeeStatus = "deactivated"
+)
+
+const (
+	SELF_REGISTRATION_APPROVAL = "approval"
+	SELF_REGISTRATION_DISABLED = "disabled"
+
+	INVITATION_DEFAULT_TTL  = 7 * 24 * time.Hour
+	INVITATION_MAIL_TIMEOUT = 30 * time.Second
+)
+
+type RegistrationConfig struct {
+	// anyone may register and wait for approval, otherwise only invited
+	// employees can
+	SelfRegistration bool
+	// lower case domains self registration is limited to, any when empty
+	EmailDomains  []string
+	InvitationTTL time.Duration
+	// frontend registration page that reads the token from the query string,
+	// only the token is mailed when missing
+	InvitationURL *url.URL
+}
+
+func (s *Server) initRegistration() {
+	s.registration = RegistrationConfig{
+		InvitationTTL: envDuration("INVITATION_TTL", INVITATION_DEFAULT_TTL),
+		InvitationURL: envURL("INVITATION_URL"),
+	}
+
+	switch os.Getenv("SELF_REGISTRATION") {
+	case "", SELF_REGISTRATION_APPROVAL:
+		s.registration.SelfRegistration = true
+	case SELF_REGISTRATION_DISABLED:
+		s.registration.SelfRegistration = false
+	default:
+		log.Fatalf("SELF_REGISTRATION must be %s or %s", SELF_REGISTRATION_APPROVAL, SELF_REGISTRATION_DISABLED)
+	}
+
+	for _, domain := range strings.Split(os.Getenv("REGISTRATION_EMAIL_DOMAINS"), ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			s.registration.EmailDomains = append(s.registration.EmailDomains, domain)
+		}
+	}
+}
+
+func (c RegistrationConfig) allowsEmail(email string) bool {
+	if len(c.EmailDomains) == 0 {
+		return true
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return false
+	}
+
+	at := strings.LastIndex(addr.Address, "@")
+	return slices.Contains(c.EmailDomains, strings.ToLower(addr.Address[at+1:]))
+}
+
+// Invitations let an employee register with a role chosen beforehand and
+// without waiting for approval. Only the hash of the token is stored, the
+// token is mailed and shown once on creation.
+type Invitation struct {
+	Id     int    `json:"id"`
+	Email  string `json:"email"`
+	RoleId int    `json:"roleId"`
+	// the employee joins these facilities on registration
+	FacilityIds []int      `json:"facilityIds"`
+	InvitedBy   *int       `json:"invitedBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	AcceptedAt  *time.Time `json:"acceptedAt"`
+	// the employee that registered with it
+	EmployeeId *int `json:"employeeId"`
+}
+
+type InvitationCreated struct {
+	Invitation
+	Token string `json:"token"`
+}
+
+type CreateInvitationRequest struct {
+	Email  string `json:"email"`
+	RoleId int    `json:"roleId"`
+	// the facilities of the inviting employee when missing
+	FacilityIds []int `json:"facilityIds"`
+	// INVITATION_TTL from now when missing
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+func (r CreateInvitationRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if _, err := mail.ParseAddress(r.Email); err != nil {
+		errs["email"] = append(errs["email"], "email is invalid")
+	}
+
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(time.Now()) {
+		errs["expiresAt"] = append(errs["expiresAt"], "expiresAt must be in the future")
+	}
+
+	return errs
+}
+
+type ApproveEmployeeRequest struct {
+	RoleId int `json:"roleId"`
+	// the facilities of the approving employee when missing
+	FacilityIds []int `json:"facilityIds"`
+}
+
+// assignedFacilities defaults the facilities handed to a new employee to the
+// ones of the request, network-wide roles have to pick them
+func assignedFacilities(scope facilityScope, ids []int) []int {
+	if len(ids) == 0 && !scope.all {
+		return scope.ids
+	}
+
+	return ids
+}
+
+func (s *Server) handleGetPendingEmployees(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	q := `SELECT ` + employeeColumns + ` FROM employee e JOIN employee_role r on e.role_id = r.role_id
+	WHERE e.status = $1 ORDER BY e.employee_id`
+
+	rows, err := s.db.Query(context.Background(), q, EmployeePending)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	output := make([]EmployeeOutput, 0)
+	for rows.Next() {
+		var emp EmployeeOutput
+		if err := scanEmployee(rows, &emp); err != nil {
+			return err
+		}
+		output = append(output, emp)
+	}
+
+	return writeJSON(w, http.StatusOK, output)
+}
+
+func (s *Server) handleApproveEmployee(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req ApproveEmployeeRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+	req.FacilityIds = assignedFacilities(scope, req.FacilityIds)
+
+	errs := make(map[string][]string)
+	if err := s.validateAssignedRole(r, req.RoleId, errs); err != nil {
+		return err
+	}
+	if facilityErrs := s.validateFacilities(scope, req.FacilityIds); len(facilityErrs) > 0 {
+		errs["facilityIds"] = facilityErrs
+	}
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = s.reviewRegistration(ctx, tx, employeeId, EmployeeActive, &req.RoleId)
+	if err != nil {
+		return err
+	}
+
+	q := `INSERT INTO employee_facility(employee_id, facility_id) SELECT $1, unnest($2::INTEGER[])
+	ON CONFLICT DO NOTHING`
+	if _, err := tx.Exec(ctx, q, employeeId, req.FacilityIds); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	go s.notifyEmployee(emp.Email, "Account approved",
+		"Your Anamnesis account was approved, you can log in now.\n")
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+// handleRejectEmployee keeps the account so the same email and CPF can't
+// queue up again, an invitation is needed for them instead
+func (s *Server) handleRejectEmployee(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	employeeId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = s.reviewRegistration(ctx, tx, employeeId, EmployeeRejected, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	emp, err := s.getEmployee(employeeId)
+	if err != nil {
+		return err
+	}
+
+	go s.notifyEmployee(emp.Email, "Account not approved",
+		"Your Anamnesis account registration was not approved.\n")
+
+	return writeJSON(w, http.StatusOK, emp)
+}
+
+// reviewRegistration moves a pending employee to status, setting the role
+// when given
+func (s *Server) reviewRegistration(ctx context.Context, tx pgx.Tx, employeeId int, status EmployeeStatus, roleId *int) error {
+	q := `UPDATE employee SET status = $1, role_id = COALESCE($2, role_id)
+	WHERE employee_id = $3 AND status = $4`
+
+	tag, err := tx.Exec(ctx, q, status, roleId, employeeId, EmployeePending)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return s.employeeStatusConflict(employeeId, "employee is not pending approval")
+	}
+
+	return nil
+}
+
+func (s *Server) roleExists(roleId int) bool {
+	q := `SELECT 1 FROM employee_role WHERE role_id = $1 LIMIT 1`
+	return s.db.QueryRow(context.Background(), q, roleId).Scan(nil) == nil
+}
+
+// validateAssignedRole adds to errs when the role can't be given by the
+// requester
+func (s *Server) validateAssignedRole(r *http.Request, roleId int, errs map[string][]string) error {
+	if !s.roleExists(roleId) {
+		errs["roleId"] = append(errs["roleId"], "selected role does not exist")
+		return nil
+	}
+
+	assignable, err := s.canAssignRole(r, roleId)
+	if err != nil {
+		return err
+	}
+	if !assignable {
+		errs["roleId"] = append(errs["roleId"], "selected role has permissions you don't have")
+	}
+	return nil
+}
+
+func (s *Server) notifyEmployee(email string, subject string, body string) {
+	ctx, cancel := context.WithTimeout(context.Background(), INVITATION_MAIL_TIMEOUT)
+	defer cancel()
+
+	err := s.mailer.Send(ctx, Mail{To: email, Subject: subject, Body: body})
+	if err != nil {
+		fmt.Println("mail error:", err.Error())
+	}
+}
+
+func (s *Server) handleGetInvitations(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT invitation_id, email, role_id, facility_ids, invited_by, created_at, expires_at, accepted_at, employee_id
+	FROM employee_invitation WHERE $1 OR facility_ids && $2 ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(context.Background(), q, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	invitations := make([]Invitation, 0)
+	for rows.Next() {
+		var inv Invitation
+		err := rows.Scan(&inv.Id, &inv.Email, &inv.RoleId, &inv.FacilityIds, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt,
+			&inv.AcceptedAt, &inv.EmployeeId)
+		if err != nil {
+			return err
+		}
+		invitations = append(invitations, inv)
+	}
+
+	return writeJSON(w, http.StatusOK, invitations)
+}
+
+// handleCreateInvitation replaces any outstanding invitation for the same
+// email
+func (s *Server) handleCreateInvitation(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	invitedBy, err := getIdFromToken(r)
+	if err != nil {
+		return InvalidToken()
+	}
+
+	var req CreateInvitationRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+	req.FacilityIds = assignedFacilities(scope, req.FacilityIds)
+
+	errs := req.validate()
+	if err := s.validateAssignedRole(r, req.RoleId, errs); err != nil {
+		return err
+	}
+	if facilityErrs := s.validateFacilities(scope, req.FacilityIds); len(facilityErrs) > 0 {
+		errs["facilityIds"] = facilityErrs
+	}
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `SELECT 1 FROM employee WHERE lower(email) = lower($1) LIMIT 1`
+	err = tx.QueryRow(ctx, q, req.Email).Scan(nil)
+	if err == nil {
+		return NewAPIError(http.StatusConflict, "employee with this email already exists")
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	q = `DELETE FROM employee_invitation WHERE lower(email) = lower($1) AND accepted_at IS NULL`
+	if _, err := tx.Exec(ctx, q, req.Email); err != nil {
+		return err
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	inv := InvitationCreated{
+		Invitation: Invitation{
+			Email:       req.Email,
+			RoleId:      req.RoleId,
+			FacilityIds: req.FacilityIds,
+			InvitedBy:   &invitedBy,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(s.registration.InvitationTTL),
+		},
+		Token: token,
+	}
+	if req.ExpiresAt != nil {
+		inv.ExpiresAt = *req.ExpiresAt
+	}
+
+	q = `INSERT INTO employee_invitation(token_hash, email, role_id, facility_ids, invited_by, created_at, expires_at)
+	VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING invitation_id`
+	err = tx.QueryRow(ctx, q, hashToken(token), inv.Email, inv.RoleId, inv.FacilityIds, invitedBy,
+		inv.CreatedAt, inv.ExpiresAt).Scan(&inv.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	go s.notifyEmployee(inv.Email, "Anamnesis invitation", fmt.Sprintf(`You were invited to create an Anamnesis account.
+
+Register with this email address before %s:
+
+%s
+`, inv.ExpiresAt.Format(time.RFC1123), s.registration.invitationLink(token)))
+
+	return writeJSON(w, http.StatusCreated, inv)
+}
+
+func (c RegistrationConfig) invitationLink(token string) string {
+	if c.InvitationURL == nil {
+		return "Invitation token: " + token
+	}
+
+	return tokenURL(c.InvitationURL, token)
+}
+
+func (s *Server) handleRevokeInvitation(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageEmployees); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	q := `DELETE FROM employee_invitation WHERE invitation_id = $1 AND accepted_at IS NULL`
+	tag, err := s.db.Exec(context.Background(), q, id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusNotFound, "invitation does not exist or was already accepted")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// acceptInvitation marks the invitation used within the registration
+// transaction and returns the role it assigns
+func acceptInvitation(ctx context.Context, tx pgx.Tx, token string, email string) (int, int, error) {
+	now := time.Now()
+	q := `UPDATE employee_invitation SET accepted_at = $1
+	WHERE token_hash = $2 AND accepted_at IS NULL AND expires_at > $1
+	RETURNING invitation_id, email, role_id`
+
+	var invitationId, roleId int
+	var invitedEmail string
+	err := tx.QueryRow(ctx, q, now, hashToken(token)).Scan(&invitationId, &invitedEmail, &roleId)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, 0, NewAPIError(http.StatusBadRequest, "invalid or expired invitation")
+		}
+		return 0, 0, err
+	}
+
+	if !strings.EqualFold(invitedEmail, email) {
+		return 0, 0, NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+			"email": {"email does not match the invitation"},
+		})
+	}
+
+	return invitationId, roleId, nil
+}
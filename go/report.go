@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -17,7 +18,7 @@ type Urgency string
 const (
 	Undefined Urgency = "undefined"
 	Green     Urgency = "green"
-	Yellow    Urgency = "Yellow"
+	Yellow    Urgency = "yellow"
 	Red       Urgency = "red"
 )
 
@@ -34,31 +35,84 @@ type ReportBase struct {
 	Medications       []string `json:"medications"`
 	Allergies         []string `json:"allergies"`
 	Diseases          []string `json:"diseases"`
+	// language the patient was interviewed in
+	Language          Language `json:"language"`
 }
 
 type ReportOutput struct {
 	Id           int           `json:"id"`
 	Patient      PatientOutput `json:"patient"`
+	FacilityId   int           `json:"facilityId"`
 	ReportBase
 	IssuedAt     time.Time     `json:"issuedAt"`
 	Urgency      Urgency       `json:"urgency"`
+	Ticket       string        `json:"ticket"`
+	CalledAt     *time.Time    `json:"calledAt,omitempty"`
+	CalledRoom   *string       `json:"calledRoom,omitempty"`
 	Consultation *Consultation `json:"consultation,omitempty"`
+	// set when the interview came from a configurable questionnaire
+	Questionnaire *ReportQuestionnaire `json:"questionnaire,omitempty"`
+	// red flag terms found when the report was created, null for reports
+	// created before red flag detection
+	RedFlags         []RedFlag `json:"redFlags"`
+	// most urgent level of the red flags, urgency itself is left to staff
+	SuggestedUrgency Urgency   `json:"suggestedUrgency"`
+}
+
+type ReportQuestionnaire struct {
+	Id      int    `json:"id"`
+	Version int    `json:"version"`
+	Name    string `json:"name"`
 }
 
 type QA struct {
-	Question string `json:"question"`
-	Answer   string `json:"answer"`
+	// set when the answer came from a server driven interview session
+	QuestionId  string `json:"questionId,omitempty"`
+	Question    string `json:"question"`
+	Answer      string `json:"answer"`
+	// answer in the questionnaire language when the patient answered in
+	// another one
+	Translation *string `json:"translation,omitempty"`
+	// only shown to staff allowed to access recordings
+	RecordingId *int    `json:"recordingId,omitempty"`
+}
+
+// canonical is the answer in the questionnaire language
+func (qa QA) canonical() string {
+	if qa.Translation != nil {
+		return *qa.Translation
+	}
+	return qa.Answer
 }
 
 type Consultation struct {
 	DoctorId         int       `json:"doctorId,omitempty"`
+	// display name, still set when the doctor was deactivated since
+	DoctorName         string                    `json:"doctorName,omitempty"`
+	DoctorRegistration *ProfessionalRegistration `json:"doctorRegistration,omitempty"`
+	DoctorSpecialties  []string                  `json:"doctorSpecialties,omitempty"`
 	// using time.Time as pointer is a workaround to make sure no json parsing when zero value is given
 	ConsultationDate *time.Time `json:"consultationDate,omitempty"`
 }
 
+// doctor is how documents identify who attended, e.g. Dra. Ana, CRM/SP 123456
+func (c Consultation) doctor() string {
+	if c.DoctorRegistration == nil {
+		return c.DoctorName
+	}
+	return c.DoctorName + ", " + c.DoctorRegistration.String()
+}
+
 type CreateReportRequest struct {
 	ReportBase
 	Patient PatientInput `json:"patient"`
+	// test reports are purged by the retention job if nobody consulted them
+	Test    bool         `json:"test"`
+	// when set the interview is taken from the session instead of the request
+	InterviewSessionId *string `json:"interviewSessionId"`
+	// ignored for kiosks and interview sessions, they have their own, and only
+	// taken from employees
+	FacilityId *int `json:"facilityId"`
 }
 
 func (r CreateReportRequest) validate() map[string][]string {
@@ -68,9 +122,25 @@ func (r CreateReportRequest) validate() map[string][]string {
 		errs["name"] = append(errs["name"], "patient name missing")
 	}
 
-	// if !ValidateCPF(r.Patient.CPF) {
-	// 	errs["cpf"] = append(errs["cpf"], "invalid CPF")
-	// }
+	if r.Patient.CPF != "" {
+		if !validateCPFWithMode(r.Patient.CPF) {
+			errs["cpf"] = append(errs["cpf"], "invalid CPF")
+		}
+	} else if r.Patient.AltIdType == nil || r.Patient.AltId == nil || len(*r.Patient.AltId) == 0 {
+		errs["cpf"] = append(errs["cpf"], "CPF or alternative identifier required")
+	}
+
+	if r.Patient.AltIdType != nil && !r.Patient.AltIdType.valid() {
+		errs["altIdType"] = append(errs["altIdType"], "invalid alternative identifier type")
+	}
+
+	if r.Patient.AltId != nil && len(*r.Patient.AltId) > 40 {
+		errs["altId"] = append(errs["altId"], "alternative identifier must not exceed 40 characters")
+	}
+
+	if r.Language != "" && !r.Language.valid() {
+		errs["language"] = append(errs["language"], "unsupported language")
+	}
 
 	if r.Patient.Sex != nil && *r.Patient.Sex != Male && *r.Patient.Sex != Female {
 		errs["sex"] = append(errs["sex"], "invalid sex")
@@ -122,6 +192,24 @@ func (r CreateReportRequest) validate() map[string][]string {
 	return errs
 }
 
+type CallReportRequest struct {
+	Room string `json:"room"`
+}
+
+func (r CallReportRequest) validate() map[string][]string {
+	errs := make(map[string][]string)
+
+	if len(r.Room) == 0 {
+		errs["room"] = append(errs["room"], "room missing")
+	}
+
+	if len(r.Room) > 20 {
+		errs["room"] = append(errs["room"], "room must not exceed 20 characters")
+	}
+
+	return errs
+}
+
 type ChangeUrgencyRequest struct {
 	Urgency Urgency `json:"urgency"`
 }
@@ -138,19 +226,75 @@ func (r ChangeUrgencyRequest) validate() map[string][]string {
 	return errs
 }
 
+// reportFilter narrows the report listing and export to the facilities of the
+// request and to the reports issued from and before to, when given
+type reportFilter struct {
+	scope facilityScope
+	from  *time.Time
+	to    *time.Time
+}
+
+// reportFilterSQL takes the filter as the first four arguments
+const reportFilterSQL = `($1 OR r.facility_id = ANY($2))
+	AND ($3::TIMESTAMP IS NULL OR r.issued_at >= $3) AND ($4::TIMESTAMP IS NULL OR r.issued_at < $4)`
+
+func (f reportFilter) args() []any {
+	return []any{f.scope.all, f.scope.ids, f.from, f.to}
+}
+
+func (s *Server) parseReportFilter(r *http.Request) (reportFilter, error) {
+	var f reportFilter
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return f, err
+	}
+	f.scope = scope
+
+	errs := make(map[string][]string)
+	for key, dst := range map[string]**time.Time{"from": &f.from, "to": &f.to} {
+		v := r.URL.Query().Get(key)
+		if v == "" {
+			continue
+		}
+
+		t, ok := parseQueryTime(v)
+		if !ok {
+			errs[key] = append(errs[key], key+" must be a date (2006-01-02) or an RFC 3339 time")
+			continue
+		}
+		*dst = &t
+	}
+
+	if len(errs) > 0 {
+		return f, NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	return f, nil
+}
+
 func (s *Server) handleGetReports(w http.ResponseWriter, r *http.Request) error {
 	q := `SELECT r.report_id, r.weight, r.height, r.heart_rate,
 	r.systolic_pressure, r.diastolic_pressure, r.temperature,
 	r.oxygen_saturation, r.interview, r.issued_at,
-	r.occupation, r.medications, r.allergies, r.diseases,
-	p.patient_id, p.name, p.cpf, p.sex, p.date_of_birth,
-	r.urgency, (c.report_id IS NOT NULL) AS consulted
+	r.occupation, r.medications, r.allergies, r.diseases, r.language,
+	p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth,
+	r.urgency, r.ticket, r.called_at, r.called_room,
+	r.questionnaire_id, r.questionnaire_version, r.red_flags, r.suggested_urgency,
+	(c.report_id IS NOT NULL) AS consulted, r.facility_id
 	FROM report r JOIN patient p on r.patient_id = p.patient_id
 	LEFT JOIN consultation c on r.report_id = c.report_id
-	`
+	WHERE ` + reportFilterSQL
+
+	filter, err := s.parseReportFilter(r)
+	if err != nil {
+		return err
+	}
+
+	maskIds := !s.requestHasPermission(r, PermViewIdentifiers)
 
 	output := make([]ReportOutput, 0)
-	rows, err := s.db.Query(context.Background(), q)
+	rows, err := s.db.Query(context.Background(), q, filter.args()...)
 	if err != nil {
 		fmt.Println("db error:", err.Error())
 		return InternalError()
@@ -160,25 +304,34 @@ func (s *Server) handleGetReports(w http.ResponseWriter, r *http.Request) error
 	for rows.Next() {
 		var r ReportOutput
 		var consulted bool
+		var qnId, qnVersion *int
 		err := rows.Scan(
 			&r.Id, &r.Weight, &r.Height,
 			&r.HeartRate, &r.SystolicPressure, &r.DiastolicPressure,
 			&r.Temperature, &r.OxygenSaturation,
-			&r.Interview, &r.IssuedAt,
-			&r.Occupation, &r.Medications, &r.Allergies, &r.Diseases,
-			&r.Patient.Id, &r.Patient.Name, &r.Patient.CPF,
+			unseal(SEALED_REPORT_INTERVIEW, &r.Interview), &r.IssuedAt,
+			&r.Occupation, &r.Medications, &r.Allergies, unseal(SEALED_REPORT_DISEASES, &r.Diseases), &r.Language,
+			&r.Patient.Id, &r.Patient.Name, unseal(SEALED_PATIENT_CPF, &r.Patient.CPF),
+			&r.Patient.AltIdType, &r.Patient.AltId,
 			&r.Patient.Sex, &r.Patient.DateOfBirth,
-			&r.Urgency, &consulted)
+			&r.Urgency, &r.Ticket, &r.CalledAt, &r.CalledRoom, &qnId, &qnVersion,
+			unseal(SEALED_REPORT_RED_FLAGS, &r.RedFlags), &r.SuggestedUrgency, &consulted, &r.FacilityId)
 
 		if err != nil {
 			fmt.Println("scan error:", err.Error())
 			return InternalError()
 		}
 
+		s.setReportQuestionnaire(&r, qnId, qnVersion)
+
 		if consulted {
 			r.Consultation, err = s.getConsultation(r.Id)
 		}
 
+		if maskIds {
+			r.Patient.maskIdentifiers()
+		}
+
 		output = append(output, r)
 	}
 
@@ -191,6 +344,10 @@ func (s *Server) handleGetReportById(w http.ResponseWriter, r *http.Request) err
 		return BadRequest()
 	}
 
+	if err := s.requireReportFacility(r, id); err != nil {
+		return err
+	}
+
 	rep, err := s.getReportById(id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -200,9 +357,70 @@ func (s *Server) handleGetReportById(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		rep.Patient.maskIdentifiers()
+	}
+
+	if s.requestHasPermission(r, PermAccessRecordings) {
+		if err := s.setReportRecordings(&rep); err != nil {
+			return err
+		}
+	}
+
+	s.auditRequest(r, AuditViewReport, &rep.Patient.Id, &rep.Id)
+
 	return writeJSON(w, http.StatusOK, rep)
 }
 
+func newPDF() (*gopdf.GoPdf, error) {
+	pdf := gopdf.GoPdf{}
+	pdf.Start(gopdf.Config{ PageSize: *gopdf.PageSizeA4 })
+	pdf.AddPage()
+	pdf.SetMarginLeft(100)
+	pdf.SetMarginRight(100)
+	err := pdf.AddTTFFont("arial", "../fonts/arial/ARIAL.TTF")
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	err = pdf.SetFont("arial", "", 14)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	return &pdf, nil
+}
+
+const PDF_PAGE_BOTTOM = 790.0
+
+// pdfCursor writes lines top to bottom, wrapping long text and adding pages
+// as needed
+type pdfCursor struct {
+	pdf *gopdf.GoPdf
+	y   float64
+}
+
+func (c *pdfCursor) line(size float64, text string, spacing float64) {
+	c.pdf.SetFontSize(size)
+	lines, err := c.pdf.SplitText(text, gopdf.PageSizeA4.W-c.pdf.MarginLeft()-c.pdf.MarginRight())
+	if err != nil {
+		lines = []string{text}
+	}
+
+	for _, l := range lines {
+		if c.y > PDF_PAGE_BOTTOM {
+			c.pdf.AddPage()
+			c.y = 50
+		}
+
+		c.pdf.SetXY(c.pdf.MarginLeft(), c.y)
+		c.pdf.Text(l)
+		c.y += size + 4
+	}
+	c.y += spacing
+}
+
 // TODO add new fields to report
 func (s *Server) handleGetReportPDF(w http.ResponseWriter, r *http.Request) error {
 	id, err := getPathId("id", r)
@@ -210,6 +428,10 @@ func (s *Server) handleGetReportPDF(w http.ResponseWriter, r *http.Request) erro
 		return BadRequest()
 	}
 
+	if err := s.requireReportFacility(r, id); err != nil {
+		return err
+	}
+
 	rep, err := s.getReportById(id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -219,19 +441,14 @@ func (s *Server) handleGetReportPDF(w http.ResponseWriter, r *http.Request) erro
 		return err
 	}
 
-	pdf := gopdf.GoPdf{}
-	pdf.Start(gopdf.Config{ PageSize: *gopdf.PageSizeA4 })
-	pdf.AddPage()
-	pdf.SetMarginLeft(100)
-	pdf.SetMarginRight(100)
-	err = pdf.AddTTFFont("arial", "../fonts/arial/ARIAL.TTF")
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-	err = pdf.SetFont("arial", "", 14)
+	s.auditRequest(r, AuditViewReport, &rep.Patient.Id, &rep.Id)
+
+	// labels and question texts follow the clinician, answers stay as given
+	lang := requestLanguage(r)
+	label := func(key string) string { return pdfLabel(lang, key) }
+
+	pdf, err := newPDF()
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
 
@@ -243,16 +460,16 @@ func (s *Server) handleGetReportPDF(w http.ResponseWriter, r *http.Request) erro
 	pdf.SetXY(pdf.MarginLeft(), 60)
 	rect := gopdf.Rect{ W: 100, H: 32 }
 	if rep.Patient.DateOfBirth != nil {
-		pdf.Cell(&rect, fmt.Sprintf("Date of Birth: %s", rep.Patient.DateOfBirth.Format("02/01/2006")))
+		pdf.Cell(&rect, fmt.Sprintf("%s: %s", label("dateOfBirth"), rep.Patient.DateOfBirth.Format("02/01/2006")))
 	} else {
-		pdf.Text("Date of Birth: N/A")
+		pdf.Text(label("dateOfBirth") + ": N/A")
 	}
 
 	pdf.SetXY(400, 70)
 	if rep.Patient.Sex != nil {
-		pdf.Text(fmt.Sprintf("Issued at: %s", rep.IssuedAt.Format("02/01/2006")))
+		pdf.Text(fmt.Sprintf("%s: %s", label("issuedAt"), rep.IssuedAt.Format("02/01/2006")))
 	} else {
-		pdf.Text("Sex: N/A")
+		pdf.Text(label("sex") + ": N/A")
 	}
 
 	y := 100.0
@@ -263,74 +480,148 @@ func (s *Server) handleGetReportPDF(w http.ResponseWriter, r *http.Request) erro
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.Height != nil {
-		pdf.Text(fmt.Sprintf("Height: %.2f m", float32(*rep.Height) / 100.0))
+		pdf.Text(fmt.Sprintf("%s: %.2f m", label("height"), float32(*rep.Height) / 100.0))
 	} else {
-		pdf.Text("Height: N/A")
+		pdf.Text(label("height") + ": N/A")
 	}
 	y += 20
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.Weight != nil {
-		pdf.Text(fmt.Sprintf("Weight: %.1f Kg", *rep.Weight))
+		pdf.Text(fmt.Sprintf("%s: %.1f Kg", label("weight"), *rep.Weight))
 	} else {
-		pdf.Text("Weight: N/A")
+		pdf.Text(label("weight") + ": N/A")
 	}
 	y += 20
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.HeartRate != nil {
-		pdf.Text(fmt.Sprintf("Heart Rate: %d BPM", *rep.HeartRate))
+		pdf.Text(fmt.Sprintf("%s: %d BPM", label("heartRate"), *rep.HeartRate))
 	} else {
-		pdf.Text("Heart Rate: N/A")
+		pdf.Text(label("heartRate") + ": N/A")
 	}
 	y += 20
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.OxygenSaturation != nil {
-		pdf.Text(fmt.Sprintf("Oxygen Saturation: %d%%", *rep.OxygenSaturation))
+		pdf.Text(fmt.Sprintf("%s: %d%%", label("oxygenSaturation"), *rep.OxygenSaturation))
 	} else {
-		pdf.Text("Oxygen Saturation: N/A")
+		pdf.Text(label("oxygenSaturation") + ": N/A")
 	}
 	y += 20
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.Temperature != nil {
-		pdf.Text(fmt.Sprintf("Temperature: %.1f °C", *rep.Temperature))
+		pdf.Text(fmt.Sprintf("%s: %.1f °C", label("temperature"), *rep.Temperature))
 	} else {
-		pdf.Text("Temperature: N/A")
+		pdf.Text(label("temperature") + ": N/A")
 	}
 	y += 20
 
 	pdf.SetXY(pdf.MarginLeft(), y)
 	if rep.SystolicPressure != nil && rep.DiastolicPressure != nil {
-		pdf.Text(fmt.Sprintf("Blood pressure: %d/%d", *rep.SystolicPressure, *rep.DiastolicPressure))
+		pdf.Text(fmt.Sprintf("%s: %d/%d", label("bloodPressure"), *rep.SystolicPressure, *rep.DiastolicPressure))
 	} else {
-		pdf.Text("Blood pressure: N/A")
+		pdf.Text(label("bloodPressure") + ": N/A")
 	}
 	y += 36
 
+	if len(rep.RedFlags) > 0 {
+		pdf.SetXY(pdf.MarginLeft(), y)
+		pdf.SetFontSize(20)
+		pdf.SetTextColor(200, 0, 0)
+		pdf.Text(label("redFlags"))
+		y += 24
+		pdf.SetFontSize(12)
+
+		pdf.SetXY(pdf.MarginLeft(), y)
+		pdf.Text(fmt.Sprintf("%s: %s", label("suggestedUrgency"), label(string(rep.SuggestedUrgency))))
+		y += 20
+
+		for _, flag := range rep.RedFlags {
+			pdf.SetXY(pdf.MarginLeft(), y)
+			pdf.Text(fmt.Sprintf("%s: \"%s\" (%s)", flag.Rule, flag.Match, label(string(flag.Field))))
+			y += 20
+		}
+		pdf.SetTextColor(0, 0, 0)
+		y += 16
+	}
+
 	pdf.SetXY(pdf.MarginLeft(), y)
 	pdf.SetFontSize(20)
-	pdf.Text("Interview")
+	pdf.Text(label("interview"))
 	y += 16
 	pdf.SetFontSize(12)
 
-	for _, qa := range rep.Interview {
+	if rep.Questionnaire != nil {
+		pdf.SetXY(pdf.MarginLeft(), y)
+		pdf.Text(fmt.Sprintf("%s: %s (%s %d)", label("questionnaire"), rep.Questionnaire.Name,
+			label("version"), rep.Questionnaire.Version))
+		y += 24
+	}
+
+	pdf.SetXY(pdf.MarginLeft(), y)
+	pdf.Text(fmt.Sprintf("%s: %s", label("language"), rep.Language))
+	y += 24
+
+	var version *QuestionnaireVersion
+	if rep.Questionnaire != nil {
+		if v, err := s.getQuestionnaireVersion(rep.Questionnaire.Id, rep.Questionnaire.Version); err == nil {
+			version = &v
+		}
+	}
+
+	for i, qa := range rep.Interview {
+		question := qa.Question
+		if version != nil {
+			if q, ok := version.question(qa.QuestionId); ok {
+				question = q.localized(lang).Text
+			}
+		}
+
 		pdf.SetXY(pdf.MarginLeft(), y)
-		pdf.Text(fmt.Sprintf("Question: %s", qa.Question))
+		pdf.Text(fmt.Sprintf("%s: %s", label("question"), question))
 		y += 20
 
 		pdf.SetXY(pdf.MarginLeft(), y)
-		pdf.Text(fmt.Sprintf("Answer: %s", qa.Answer))
-		y += 32
+		pdf.Text(label("answer") + ": ")
+		pdfHighlighted(pdf, qa.Answer, highlights(rep.RedFlags, RedFlagInterview, i, false))
+		y += 20
+
+		if qa.Translation != nil && lang != rep.Language {
+			pdf.SetXY(pdf.MarginLeft(), y)
+			pdf.Text(label("translation") + ": ")
+			pdfHighlighted(pdf, *qa.Translation, highlights(rep.RedFlags, RedFlagInterview, i, true))
+			y += 20
+		}
+		y += 12
 	}
 	if len(rep.Interview) == 0 {
 		pdf.SetXY(pdf.MarginLeft(), y)
-		pdf.Text("No interview questions.")
+		pdf.Text(label("noInterview"))
 		y += 32
 	}
 
-	return writePDF(w, &pdf)
+	if c := rep.Consultation; c != nil && c.ConsultationDate != nil {
+		if y > PDF_PAGE_BOTTOM {
+			pdf.AddPage()
+			y = 50
+		}
+
+		pdf.SetXY(pdf.MarginLeft(), y)
+		pdf.Text(fmt.Sprintf("%s: %s", label("consultation"), c.ConsultationDate.Format("02/01/2006 15:04")))
+		y += 20
+
+		doctor := c.doctor()
+		if len(c.DoctorSpecialties) > 0 {
+			doctor += " (" + strings.Join(c.DoctorSpecialties, ", ") + ")"
+		}
+
+		pdf.SetXY(pdf.MarginLeft(), y)
+		pdf.Text(fmt.Sprintf("%s: %s", label("attendedBy"), doctor))
+	}
+
+	return writePDF(w, pdf)
 }
 
 func (s *Server) handleChangeReportUrgency(w http.ResponseWriter, r *http.Request) error {
@@ -353,6 +644,10 @@ func (s *Server) handleChangeReportUrgency(w http.ResponseWriter, r *http.Reques
 		return BadRequest()
 	}
 
+	if err := s.requireReportFacility(r, reportId); err != nil {
+		return err
+	}
+
 	var req ChangeUrgencyRequest
 	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -375,6 +670,10 @@ func (s *Server) handleChangeReportUrgency(w http.ResponseWriter, r *http.Reques
 		return err
 	}
 
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		rep.Patient.maskIdentifiers()
+	}
+
 	return writeJSON(w, http.StatusOK, rep)
 }
 
@@ -398,6 +697,10 @@ func (s *Server) handleCreateConsultation(w http.ResponseWriter, r *http.Request
 		return BadRequest()
 	}
 
+	if err := s.requireReportFacility(r, reportId); err != nil {
+		return err
+	}
+
 	rep, err := s.getReportById(reportId)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -412,9 +715,56 @@ func (s *Server) handleCreateConsultation(w http.ResponseWriter, r *http.Request
 		return err
 	}
 
-	rep.Consultation = &Consultation{
-		DoctorId: employeeId,
-		ConsultationDate: &now,
+	rep.Consultation, err = s.getConsultation(reportId)
+	if err != nil {
+		return err
+	}
+
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		rep.Patient.maskIdentifiers()
+	}
+
+	return writeJSON(w, http.StatusOK, rep)
+}
+
+func (s *Server) handleCallReport(w http.ResponseWriter, r *http.Request) error {
+	reportId, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	if err := s.requireReportFacility(r, reportId); err != nil {
+		return err
+	}
+
+	var req CallReportRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	q := `UPDATE report SET called_at = $1, called_room = $2 WHERE report_id = $3`
+	tag, err := s.db.Exec(context.Background(), q, time.Now(), req.Room, reportId)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusNotFound, "report does not exist")
+	}
+
+	rep, err := s.getReportById(reportId)
+	if err != nil {
+		return err
+	}
+
+	if !s.requestHasPermission(r, PermViewIdentifiers) {
+		rep.Patient.maskIdentifiers()
 	}
 
 	return writeJSON(w, http.StatusOK, rep)
@@ -427,55 +777,134 @@ func (s *Server) handleCreateReport(w http.ResponseWriter, r *http.Request) erro
 		return RequestBodyParsingError(err)
 	}
 
+	req.Patient.CPF = NormalizeCPF(req.Patient.CPF)
+	req.Language = req.Language.orDefault()
+
 	errs := req.validate()
 	if len(errs) > 0 {
 		return NewAPIError(http.StatusUnprocessableEntity, errs)
 	}
 
-	q := `SELECT p.patient_id, p.name, p.cpf, p.sex, p.date_of_birth
-	FROM patient p WHERE p.cpf = $1 LIMIT 1`
+	var qnId, qnVersion *int
+	var facilityId int
+	if req.InterviewSessionId != nil {
+		session, err := s.completedInterview(*req.InterviewSessionId)
+		if errors.Is(err, errInterviewExpired) {
+			return NewAPIError(http.StatusGone, "interview session expired")
+		}
+		if err != nil {
+			return NewAPIError(http.StatusUnprocessableEntity, map[string][]string{
+				"interviewSessionId": {"interview session does not exist or is not completed"},
+			})
+		}
+
+		req.Interview = session.Answers
+		req.Language = session.Language
+		qnId, qnVersion = &session.QuestionnaireId, &session.QuestionnaireVersion
+		facilityId = session.FacilityId
+	} else {
+		facilityId, err = s.intakeFacility(r, req.FacilityId)
+		if err != nil {
+			return err
+		}
+	}
 
-	row := s.db.QueryRow(context.Background(), q, req.Patient.CPF)
-	var patient PatientOutput
-	err = row.Scan(
-		&patient.Id, &patient.Name, &patient.CPF,
-		&patient.Sex, &patient.DateOfBirth)
+	rules, err := s.getActiveRedFlagRules()
+	if err != nil {
+		// a report without flags is better than no report at all
+		fmt.Println("red flag rules error:", err.Error())
+	}
+	redFlags := detectRedFlags(rules, req.ReportBase)
 
+	syndromes, err := s.querySyndromes(`WHERE active`)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	patient, err := lookupPatient(ctx, tx, req.Patient)
 	if err != nil {
 		// patient doesnt exist 
-		patient, err = s.createPatient(req.Patient)
+		patient, err = insertPatient(ctx, tx, req.Patient)
 		if err != nil {
 			return err
 		}
 	}
 
-	q = `
+	q := `
 	INSERT INTO report(patient_id, weight, height, heart_rate, systolic_pressure,
 	diastolic_pressure, temperature, oxygen_saturation, interview, issued_at,
-	occupation, medications, allergies, diseases)
-	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+	occupation, medications, allergies, diseases, test, questionnaire_id, questionnaire_version, language,
+	red_flags, suggested_urgency, facility_id)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
 	RETURNING report_id, weight, height, heart_rate, systolic_pressure,
 	diastolic_pressure, temperature, oxygen_saturation, interview, issued_at,
-	occupation, medications, allergies, diseases
+	occupation, medications, allergies, diseases, language, urgency, ticket,
+	red_flags, suggested_urgency, facility_id
 	`
 
-	row = s.db.QueryRow(context.Background(), q,
+	row := tx.QueryRow(ctx, q,
 		patient.Id, req.Weight, req.Height, req.HeartRate,
 		req.SystolicPressure, req.DiastolicPressure, req.Temperature,
-		req.OxygenSaturation, req.Interview, time.Now(),
-		req.Occupation, req.Medications, req.Allergies, req.Diseases)
+		req.OxygenSaturation, sealed(SEALED_REPORT_INTERVIEW, req.Interview), time.Now(),
+		req.Occupation, req.Medications, req.Allergies, sealed(SEALED_REPORT_DISEASES, req.Diseases), req.Test,
+		qnId, qnVersion, req.Language, sealed(SEALED_REPORT_RED_FLAGS, redFlags), suggestedUrgency(redFlags), facilityId)
 
 	var rep ReportOutput
 	err = row.Scan(&rep.Id, &rep.Weight, &rep.Height, &rep.HeartRate,
 		&rep.SystolicPressure, &rep.DiastolicPressure, &rep.Temperature,
-		&rep.OxygenSaturation, &rep.Interview, &rep.IssuedAt,
-		&rep.Occupation, &rep.Medications, &rep.Allergies, &rep.Diseases)
+		&rep.OxygenSaturation, unseal(SEALED_REPORT_INTERVIEW, &rep.Interview), &rep.IssuedAt,
+		&rep.Occupation, &rep.Medications, &rep.Allergies, unseal(SEALED_REPORT_DISEASES, &rep.Diseases),
+		&rep.Language, &rep.Urgency, &rep.Ticket, unseal(SEALED_REPORT_RED_FLAGS, &rep.RedFlags), &rep.SuggestedUrgency, &rep.FacilityId)
 
 	if err != nil {
 		return err
 	}
 
+	if req.InterviewSessionId != nil {
+		err = markInterviewSubmitted(ctx, tx, *req.InterviewSessionId, rep.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// test reports would skew the counts
+	if !req.Test {
+		err = recordSyndromes(ctx, tx, syndromes, rep.Id, facilityId, rep.IssuedAt, req.ReportBase)
+		if err != nil {
+			return err
+		}
+	}
+
+	// test reports would page staff for nothing
+	var alert *RedFlagAlert
+	if len(rep.RedFlags) > 0 && !req.Test {
+		a, err := insertRedFlagAlert(ctx, tx, rep)
+		if err != nil {
+			return err
+		}
+		alert = &a
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if alert != nil {
+		s.notifyRedFlagAlert(*alert)
+	}
+
+	s.setReportQuestionnaire(&rep, qnId, qnVersion)
+
 	rep.Patient = patient
+	// kiosks are never allowed to see identifiers back
+	rep.Patient.maskIdentifiers()
 	return writeJSON(w, http.StatusCreated, rep)
 }
 
@@ -484,9 +913,11 @@ func (s *Server) getReportById(id int) (ReportOutput, error) {
 	SELECT r.report_id, r.weight, r.height, r.heart_rate,
 	r.systolic_pressure, r.diastolic_pressure, r.temperature,
 	r.oxygen_saturation, r.interview, r.issued_at,
-	r.occupation, r.medications, r.allergies, r.diseases,
-	p.patient_id, p.name, p.cpf, p.sex, p.date_of_birth,
-	r.urgency, (c.report_id IS NOT NULL) AS consulted
+	r.occupation, r.medications, r.allergies, r.diseases, r.language,
+	p.patient_id, p.name, p.cpf, p.alt_id_type, p.alt_id, p.sex, p.date_of_birth,
+	r.urgency, r.ticket, r.called_at, r.called_room,
+	r.questionnaire_id, r.questionnaire_version, r.red_flags, r.suggested_urgency,
+	(c.report_id IS NOT NULL) AS consulted, r.facility_id
 	FROM report r JOIN patient p on r.patient_id = p.patient_id
 	LEFT JOIN consultation c on r.report_id = c.report_id
 	WHERE r.report_id = $1
@@ -495,11 +926,19 @@ func (s *Server) getReportById(id int) (ReportOutput, error) {
 	row := s.db.QueryRow(context.Background(), q, id)
 	var rep ReportOutput
 	var consulted bool
+	var qnId, qnVersion *int
 	err := row.Scan(&rep.Id, &rep.Weight, &rep.Height, &rep.HeartRate, &rep.SystolicPressure, &rep.DiastolicPressure,
-		&rep.Temperature, &rep.OxygenSaturation, &rep.Interview, &rep.IssuedAt,
-		&rep.Occupation, &rep.Medications, &rep.Allergies, &rep.Diseases,
-		&rep.Patient.Id, &rep.Patient.Name, &rep.Patient.CPF, &rep.Patient.Sex, &rep.Patient.DateOfBirth,
-		&rep.Urgency, &consulted)
+		&rep.Temperature, &rep.OxygenSaturation, unseal(SEALED_REPORT_INTERVIEW, &rep.Interview), &rep.IssuedAt,
+		&rep.Occupation, &rep.Medications, &rep.Allergies, unseal(SEALED_REPORT_DISEASES, &rep.Diseases), &rep.Language,
+		&rep.Patient.Id, &rep.Patient.Name, unseal(SEALED_PATIENT_CPF, &rep.Patient.CPF), &rep.Patient.AltIdType, &rep.Patient.AltId,
+		&rep.Patient.Sex, &rep.Patient.DateOfBirth,
+		&rep.Urgency, &rep.Ticket, &rep.CalledAt, &rep.CalledRoom, &qnId, &qnVersion,
+		unseal(SEALED_REPORT_RED_FLAGS, &rep.RedFlags), &rep.SuggestedUrgency, &consulted, &rep.FacilityId)
+	if err != nil {
+		return rep, err
+	}
+
+	s.setReportQuestionnaire(&rep, qnId, qnVersion)
 
 	if consulted {
 		rep.Consultation, err = s.getConsultation(id)
@@ -510,9 +949,43 @@ func (s *Server) getReportById(id int) (ReportOutput, error) {
 
 func (s *Server) getConsultation(reportId int) (*Consultation, error) {
 	var c Consultation
-	q := `SELECT c.doctor_id, c.consultation_date FROM consultation c WHERE report_id = $1`
+	q := `SELECT c.doctor_id, COALESCE(e.display_name, e.name), e.specialties, e.council, e.council_number, e.council_state,
+	e.council_verified_at IS NOT NULL, c.consultation_date FROM consultation c
+	JOIN employee e ON e.employee_id = c.doctor_id WHERE report_id = $1`
 	row := s.db.QueryRow(context.Background(), q, reportId)
-	err := row.Scan(&c.DoctorId, &c.ConsultationDate)
+
+	var council, number, state *string
+	var verified bool
+	err := row.Scan(&c.DoctorId, &c.DoctorName, &c.DoctorSpecialties, &council, &number, &state, &verified, &c.ConsultationDate)
+	// unverified registrations were only given by the doctor, documents
+	// leave them out
+	if verified {
+		c.DoctorRegistration = scannedRegistration(council, number, state, verified)
+	}
 
 	return &c, err
 }
+
+// setReportQuestionnaire attaches the questionnaire version the interview was
+// answered on and renders the question texts as they were in that version, in
+// the language the patient was interviewed in
+func (s *Server) setReportQuestionnaire(rep *ReportOutput, id *int, version *int) {
+	if id == nil || version == nil {
+		return
+	}
+
+	rep.Questionnaire = &ReportQuestionnaire{Id: *id, Version: *version}
+
+	v, err := s.getQuestionnaireVersion(*id, *version)
+	if err != nil {
+		fmt.Println("questionnaire version error:", err.Error())
+		return
+	}
+
+	rep.Questionnaire.Name = v.Name
+	for i, qa := range rep.Interview {
+		if q, ok := v.question(qa.QuestionId); ok {
+			rep.Interview[i].Question = q.localized(rep.Language).Text
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RETENTION_BATCH            = 100
+	RETENTION_DEFAULT_INTERVAL = 24 * time.Hour
+	// dry runs count everything but only list this many ids per policy
+	RETENTION_DRY_RUN_MAX_IDS = 100
+)
+
+// Setting a period to 0 disables that policy
+type RetentionPolicy struct {
+	ArchiveAfterYears  int `json:"archiveAfterYears"`
+	PurgeTestAfterDays int `json:"purgeTestAfterDays"`
+	// answer audio and transcripts, whether or not the report was archived
+	PurgeRecordingsAfterDays int           `json:"purgeRecordingsAfterDays"`
+	Interval                 time.Duration `json:"-"`
+}
+
+func (p RetentionPolicy) enabled() bool {
+	return p.ArchiveAfterYears > 0 || p.PurgeTestAfterDays > 0 || p.PurgeRecordingsAfterDays > 0
+}
+
+func (p RetentionPolicy) archiveCutoff(now time.Time) time.Time {
+	return now.AddDate(-p.ArchiveAfterYears, 0, 0)
+}
+
+func (p RetentionPolicy) purgeTestCutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -p.PurgeTestAfterDays)
+}
+
+func (p RetentionPolicy) purgeRecordingsCutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -p.PurgeRecordingsAfterDays)
+}
+
+func envInt(name string) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Fatalf("%s must be a non negative integer", name)
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s must be a positive duration like 24h", name)
+	}
+	return d
+}
+
+// envList reads a comma separated list, empty entries are dropped
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envURL returns nil when the variable is unset
+func envURL(name string) *url.URL {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || !u.IsAbs() {
+		log.Fatalf("%s must be an absolute URL", name)
+	}
+	return u
+}
+
+func (s *Server) initRetention() {
+	s.retention = RetentionPolicy{
+		ArchiveAfterYears:        envInt("RETENTION_ARCHIVE_AFTER_YEARS"),
+		PurgeTestAfterDays:       envInt("RETENTION_PURGE_TEST_AFTER_DAYS"),
+		PurgeRecordingsAfterDays: envInt("RETENTION_PURGE_RECORDINGS_AFTER_DAYS"),
+		Interval:                 envDuration("RETENTION_INTERVAL", RETENTION_DEFAULT_INTERVAL),
+	}
+
+	if s.retention.enabled() {
+		go s.runRetention()
+	}
+}
+
+func (s *Server) runRetention() {
+	for {
+		now := time.Now()
+
+		if s.retention.ArchiveAfterYears > 0 {
+			n, err := s.archiveReports(s.retention.archiveCutoff(now))
+			if err != nil {
+				fmt.Println("retention error archiving reports:", err)
+			} else if n > 0 {
+				fmt.Printf("retention: archived %d reports\n", n)
+			}
+		}
+
+		if s.retention.PurgeTestAfterDays > 0 {
+			n, err := s.purgeTestReports(s.retention.purgeTestCutoff(now))
+			if err != nil {
+				fmt.Println("retention error purging test reports:", err)
+			} else if n > 0 {
+				fmt.Printf("retention: purged %d test reports\n", n)
+			}
+		}
+
+		if s.retention.PurgeRecordingsAfterDays > 0 {
+			n, err := s.purgeRecordings(s.retention.purgeRecordingsCutoff(now))
+			if err != nil {
+				fmt.Println("retention error purging recordings:", err)
+			} else if n > 0 {
+				fmt.Printf("retention: purged %d recordings\n", n)
+			}
+		}
+
+		time.Sleep(s.retention.Interval)
+	}
+}
+
+// archiveReports moves reports issued before cutoff, together with their
+// consultation, into report_archive as compressed and sealed JSON without the
+// patient details
+func (s *Server) archiveReports(cutoff time.Time) (int, error) {
+	q := `SELECT report_id FROM report WHERE issued_at < $1 ORDER BY report_id LIMIT $2`
+
+	total := 0
+	for {
+		rows, err := s.db.Query(context.Background(), q, cutoff, RETENTION_BATCH)
+		if err != nil {
+			return total, err
+		}
+
+		ids := make([]int, 0, RETENTION_BATCH)
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return total, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return total, err
+		}
+
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		for _, id := range ids {
+			if err := s.archiveReport(id); err != nil {
+				return total, fmt.Errorf("report %d: %w", id, err)
+			}
+			total++
+		}
+	}
+}
+
+// ArchivedReport is what report_archive keeps of a report. The patient is
+// only referenced by id, so anonymizing them does not have to find their
+// name and CPF in every archived copy.
+type ArchivedReport struct {
+	ReportOutput
+	// shadows ReportOutput.Patient, archives written before it was dropped
+	// still carry the patient and are scrubbed when the patient is anonymized
+	Patient   *PatientOutput `json:"patient,omitempty"`
+	PatientId int            `json:"patientId"`
+}
+
+// seal compresses the archived report and seals it for report_archive.data
+func (a ArchivedReport) seal() (string, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(a); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	return fieldCipher.Seal(buf.Bytes(), SEALED_REPORT_ARCHIVE_DATA)
+}
+
+func openArchivedReport(data string) (ArchivedReport, error) {
+	var a ArchivedReport
+
+	compressed, err := fieldCipher.Open(data, SEALED_REPORT_ARCHIVE_DATA)
+	if err != nil {
+		return a, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return a, err
+	}
+	defer gz.Close()
+
+	err = json.NewDecoder(gz).Decode(&a)
+	return a, err
+}
+
+func (s *Server) getPatientArchivedReports(patientId int) ([]ArchivedReport, error) {
+	q := `SELECT data FROM report_archive WHERE patient_id = $1 ORDER BY issued_at DESC`
+	rows, err := s.db.Query(context.Background(), q, patientId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]ArchivedReport, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		a, err := openArchivedReport(data)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, a)
+	}
+
+	return reports, rows.Err()
+}
+
+func (s *Server) archiveReport(id int) error {
+	rep, err := s.getReportById(id)
+	if err != nil {
+		return err
+	}
+
+	patientId := rep.Patient.Id
+	rep.Patient = PatientOutput{}
+	data, err := ArchivedReport{ReportOutput: rep, PatientId: patientId}.seal()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `INSERT INTO report_archive(report_id, patient_id, issued_at, archived_at, data)
+	VALUES($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(ctx, q, rep.Id, patientId, rep.IssuedAt, time.Now(), data)
+	if err != nil {
+		return err
+	}
+
+	// recordings are not archived, they only exist to double check answers
+	_, err = tx.Exec(ctx, `DELETE FROM interview_recording WHERE report_id = $1`, rep.Id)
+	if err != nil {
+		return err
+	}
+
+	// the archive keeps the interview, the copy of the session goes
+	q = `UPDATE interview_session SET report_id = NULL, answers = NULL WHERE report_id = $1`
+	_, err = tx.Exec(ctx, q, rep.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM consultation WHERE report_id = $1`, rep.Id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM report WHERE report_id = $1`, rep.Id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// purgeTestReports deletes reports flagged as test data that never got a
+// consultation
+func (s *Server) purgeTestReports(cutoff time.Time) (int, error) {
+	ctx := context.Background()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// the answers of their interview sessions go with them
+	q := `UPDATE interview_session s SET report_id = NULL, answers = NULL
+	FROM report r WHERE s.report_id = r.report_id AND r.test AND r.issued_at < $1
+	AND NOT EXISTS (SELECT 1 FROM consultation c WHERE c.report_id = r.report_id)`
+	if _, err := tx.Exec(ctx, q, cutoff); err != nil {
+		return 0, err
+	}
+
+	q = `DELETE FROM report r WHERE r.test AND r.issued_at < $1
+	AND NOT EXISTS (SELECT 1 FROM consultation c WHERE c.report_id = r.report_id)`
+
+	tag, err := tx.Exec(ctx, q, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), tx.Commit(ctx)
+}
+
+type RetentionDryRunItem struct {
+	Enabled   bool       `json:"enabled"`
+	Cutoff    *time.Time `json:"cutoff,omitempty"`
+	Count     int        `json:"count"`
+	ReportIds []int      `json:"reportIds"`
+}
+
+type RetentionDryRun struct {
+	Policy          RetentionPolicy           `json:"policy"`
+	Archive         RetentionDryRunItem       `json:"archive"`
+	PurgeTest       RetentionDryRunItem       `json:"purgeTest"`
+	PurgeRecordings RetentionRecordingsDryRun `json:"purgeRecordings"`
+}
+
+// recordings are listed by their own id, not every recording is linked to a
+// report
+type RetentionRecordingsDryRun struct {
+	Enabled      bool       `json:"enabled"`
+	Cutoff       *time.Time `json:"cutoff,omitempty"`
+	Count        int        `json:"count"`
+	RecordingIds []int      `json:"recordingIds"`
+}
+
+func (s *Server) retentionDryRunItem(q string, cutoff time.Time) (RetentionDryRunItem, error) {
+	item := RetentionDryRunItem{
+		Enabled:   true,
+		Cutoff:    &cutoff,
+		ReportIds: make([]int, 0),
+	}
+
+	rows, err := s.db.Query(context.Background(), q, cutoff, RETENTION_DRY_RUN_MAX_IDS)
+	if err != nil {
+		return item, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id, &item.Count); err != nil {
+			return item, err
+		}
+		item.ReportIds = append(item.ReportIds, id)
+	}
+
+	return item, rows.Err()
+}
+
+// recordingsDryRun matches what purgeRecordings deletes
+func (s *Server) recordingsDryRun(cutoff time.Time) (RetentionRecordingsDryRun, error) {
+	item := RetentionRecordingsDryRun{
+		Enabled:      true,
+		Cutoff:       &cutoff,
+		RecordingIds: make([]int, 0),
+	}
+
+	ctx := context.Background()
+	q := `SELECT COUNT(*) FROM interview_recording WHERE created_at < $1`
+	if err := s.db.QueryRow(ctx, q, cutoff).Scan(&item.Count); err != nil {
+		return item, err
+	}
+
+	q = `SELECT recording_id FROM interview_recording WHERE created_at < $1
+	ORDER BY recording_id LIMIT $2`
+	rows, err := s.db.Query(ctx, q, cutoff, RETENTION_DRY_RUN_MAX_IDS)
+	if err != nil {
+		return item, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return item, err
+		}
+		item.RecordingIds = append(item.RecordingIds, id)
+	}
+
+	return item, rows.Err()
+}
+
+func (s *Server) handleRetentionDryRun(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageRetention); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	out := RetentionDryRun{
+		Policy:          s.retention,
+		Archive:         RetentionDryRunItem{ReportIds: make([]int, 0)},
+		PurgeTest:       RetentionDryRunItem{ReportIds: make([]int, 0)},
+		PurgeRecordings: RetentionRecordingsDryRun{RecordingIds: make([]int, 0)},
+	}
+
+	var err error
+	if s.retention.ArchiveAfterYears > 0 {
+		q := `SELECT report_id, COUNT(*) OVER () FROM report
+		WHERE issued_at < $1 ORDER BY report_id LIMIT $2`
+
+		out.Archive, err = s.retentionDryRunItem(q, s.retention.archiveCutoff(now))
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.retention.PurgeTestAfterDays > 0 {
+		q := `SELECT r.report_id, COUNT(*) OVER () FROM report r
+		WHERE r.test AND r.issued_at < $1
+		AND NOT EXISTS (SELECT 1 FROM consultation c WHERE c.report_id = r.report_id)
+		ORDER BY r.report_id LIMIT $2`
+
+		out.PurgeTest, err = s.retentionDryRunItem(q, s.retention.purgeTestCutoff(now))
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.retention.PurgeRecordingsAfterDays > 0 {
+		out.PurgeRecordings, err = s.recordingsDryRun(s.retention.purgeRecordingsCutoff(now))
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeJSON(w, http.StatusOK, out)
+}
@@ -3,19 +3,66 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/jackc/pgx/v5"
 )
 
+type Permission string
+
+const (
+	// see full CPF and alternative identifiers instead of masked ones
+	PermViewIdentifiers Permission = "view_identifiers"
+	// answer LGPD data subject requests (data export and anonymization)
+	PermPrivacyOfficer Permission = "privacy_officer"
+	// inspect data retention jobs
+	PermManageRetention Permission = "manage_retention"
+	// create and edit interview questionnaires
+	PermManageQuestionnaires Permission = "manage_questionnaires"
+	// register and revoke kiosk devices
+	PermManageKiosks Permission = "manage_kiosks"
+	// listen to answer recordings and read their raw transcripts
+	PermAccessRecordings Permission = "access_recordings"
+	// configure the red flag terms scanned on new reports
+	PermManageRedFlags Permission = "manage_red_flags"
+	// approve self registered employees and send invitations
+	PermManageEmployees Permission = "manage_employees"
+	// see the reports, patients and employees of every facility
+	PermAllFacilities Permission = "all_facilities"
+	// create and rename facilities
+	PermManageFacilities Permission = "manage_facilities"
+	// read the triage dashboard statistics
+	PermViewStats Permission = "view_stats"
+	// configure the surveillance syndromes, read their counts and alerts
+	PermManageSurveillance Permission = "manage_surveillance"
+	// import patients and past reports from CSV files
+	PermImportData Permission = "import_data"
+	// download the report listing as a spreadsheet
+	PermExportReports Permission = "export_reports"
+)
+
 type Role struct {
-	Id            int    `json:"id"`
-	Name          string `json:"name"`
-	AccessAllowed bool   `json:"accessAllowed"`
+	Id            int          `json:"id"`
+	Name          string       `json:"name"`
+	AccessAllowed bool         `json:"accessAllowed"`
+	Permissions   []Permission `json:"permissions"`
+	// employees of the role can't use the API until they enroll in MFA
+	RequireMFA    bool         `json:"requireMfa"`
+}
+
+func (r Role) hasPermission(p Permission) bool {
+	for _, perm := range r.Permissions {
+		if perm == p {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (s *Server) handleGetRoles(w http.ResponseWriter, r *http.Request) error {
-	q := `SELECT role_id, name, access_allowed FROM employee_role`
+	q := `SELECT role_id, name, access_allowed, permissions, require_mfa FROM employee_role`
 
 	rows, err := s.db.Query(context.Background(), q)
 	if err != nil {
@@ -26,7 +73,7 @@ func (s *Server) handleGetRoles(w http.ResponseWriter, r *http.Request) error {
 	roles := make([]Role, 0)
 	for rows.Next() {
 		var role Role
-		err := rows.Scan(&role.Id, &role.Name, &role.AccessAllowed)
+		err := rows.Scan(&role.Id, &role.Name, &role.AccessAllowed, &role.Permissions, &role.RequireMFA)
 		if err != nil {
 			return InternalError()
 		}
@@ -42,12 +89,12 @@ func (s *Server) handleGetRoleById(w http.ResponseWriter, r *http.Request) error
 		return NewAPIError(http.StatusBadRequest, "missing or invalid path id")
 	}
 
-	q := `SELECT role_id, name, access_allowed FROM employee_role WHERE role_id = $1`
+	q := `SELECT role_id, name, access_allowed, permissions, require_mfa FROM employee_role WHERE role_id = $1`
 
 	row := s.db.QueryRow(context.Background(), q, id)
 
 	var role Role
-	err = row.Scan(&role.Id, &role.Name, &role.AccessAllowed)
+	err = row.Scan(&role.Id, &role.Name, &role.AccessAllowed, &role.Permissions, &role.RequireMFA)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return NewAPIError(http.StatusNotFound, "role does not exist")
@@ -57,3 +104,66 @@ func (s *Server) handleGetRoleById(w http.ResponseWriter, r *http.Request) error
 
 	return writeJSON(w, http.StatusOK, role)
 }
+
+func (s *Server) employeeHasPermission(employeeId int, p Permission) (bool, error) {
+	q := `
+	SELECT r.access_allowed AND e.status = 'active', $2 = ANY(r.permissions) FROM employee e
+	JOIN employee_role r ON e.role_id = r.role_id
+	WHERE e.employee_id = $1
+	`
+	row := s.db.QueryRow(context.Background(), q, employeeId, p)
+
+	var accessAllowed, allowed bool
+	err := row.Scan(&accessAllowed, &allowed)
+	if err != nil {
+		return false, err
+	}
+
+	return accessAllowed && allowed, nil
+}
+
+// requestHasPermission reports whether the authenticated employee of the
+// request holds the permission, unauthenticated requests never do
+func (s *Server) requestHasPermission(r *http.Request, p Permission) bool {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return false
+	}
+
+	allowed, err := s.employeeHasPermission(employeeId, p)
+	if err != nil {
+		fmt.Println("db error:", err.Error())
+		return false
+	}
+
+	return allowed
+}
+
+// canAssignRole reports whether the requester may give the role to someone,
+// which needs every permission of the role. Otherwise a facility-scoped
+// manager could hand out all_facilities and escape their scope.
+func (s *Server) canAssignRole(r *http.Request, roleId int) (bool, error) {
+	employeeId, err := getIdFromToken(r)
+	if err != nil {
+		return false, err
+	}
+
+	q := `SELECT role.permissions <@ own.permissions FROM employee_role role, employee e
+	JOIN employee_role own ON e.role_id = own.role_id
+	WHERE role.role_id = $1 AND e.employee_id = $2`
+
+	var allowed bool
+	err = s.db.QueryRow(context.Background(), q, roleId, employeeId).Scan(&allowed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return allowed, err
+}
+
+func (s *Server) requirePermission(r *http.Request, p Permission) error {
+	if !s.requestHasPermission(r, p) {
+		return AccessNotAllowed()
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SPEECH_PROVIDER_REMOTE = "remote"
+	SPEECH_PROVIDER_FAKE   = "fake"
+
+	SPEECH_DIAL_TIMEOUT       = 5 * time.Second
+	SPEECH_SYNTHESIZE_TIMEOUT = 30 * time.Second
+	// buffered so a slow reader does not stall the recognizer
+	SPEECH_TRANSCRIPT_BUFFER = 32
+)
+
+var errSpeechStreamClosed = errors.New("speech stream closed")
+
+type Transcript struct {
+	Text string `json:"text"`
+	// nil when the recognizer does not report one
+	Confidence *float32 `json:"confidence"`
+}
+
+// SpeechProvider turns kiosk audio into text and interview questions into
+// audio
+type SpeechProvider interface {
+	// Transcribe opens a recognition stream for a single interview
+	Transcribe(ctx context.Context, lang Language) (TranscriptionStream, error)
+	// Synthesize returns the spoken text as a WAV file
+	Synthesize(ctx context.Context, lang Language, text string) ([]byte, error)
+}
+
+type TranscriptionStream interface {
+	// Send feeds raw audio, 16 kHz 16 bit mono PCM
+	Send(chunk []byte) error
+	// Transcripts is closed when the stream ends
+	Transcripts() <-chan Transcript
+	Close() error
+}
+
+func (s *Server) initSpeechProvider() {
+	provider := os.Getenv("SPEECH_PROVIDER")
+	switch provider {
+	case "", SPEECH_PROVIDER_REMOTE:
+		serviceURL := os.Getenv("SPEECH_SERVICE_URL")
+		if serviceURL == "" {
+			serviceURL = "ws://localhost:8000"
+		}
+		s.speech = NewRemoteSpeechProvider(serviceURL)
+	case SPEECH_PROVIDER_FAKE:
+		s.speech = NewFakeSpeechProvider()
+	default:
+		log.Fatalf("SPEECH_PROVIDER must be %s or %s", SPEECH_PROVIDER_REMOTE, SPEECH_PROVIDER_FAKE)
+	}
+}
+
+// RemoteSpeechProvider talks to the Python service (main.py) over its
+// /ws/stt and /ws/tts endpoints, the lang query parameter picks the models
+type RemoteSpeechProvider struct {
+	url    string
+	dialer websocket.Dialer
+}
+
+func NewRemoteSpeechProvider(serviceURL string) *RemoteSpeechProvider {
+	return &RemoteSpeechProvider{
+		url:    strings.TrimSuffix(serviceURL, "/"),
+		dialer: websocket.Dialer{HandshakeTimeout: SPEECH_DIAL_TIMEOUT},
+	}
+}
+
+func (p *RemoteSpeechProvider) endpoint(path string, lang Language) string {
+	return p.url + path + "?lang=" + url.QueryEscape(string(lang))
+}
+
+func (p *RemoteSpeechProvider) Transcribe(ctx context.Context, lang Language) (TranscriptionStream, error) {
+	conn, _, err := p.dialer.DialContext(ctx, p.endpoint("/ws/stt", lang), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &remoteTranscription{
+		conn:        conn,
+		transcripts: make(chan Transcript, SPEECH_TRANSCRIPT_BUFFER),
+		done:        make(chan struct{}),
+	}
+	go st.read()
+
+	return st, nil
+}
+
+// Synthesize opens a connection per call, the service answers every text
+// message with the audio followed by an echo of the text
+func (p *RemoteSpeechProvider) Synthesize(ctx context.Context, lang Language, text string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, SPEECH_SYNTHESIZE_TIMEOUT)
+	defer cancel()
+
+	conn, _, err := p.dialer.DialContext(ctx, p.endpoint("/ws/tts", lang), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetWriteDeadline(deadline)
+	conn.SetReadDeadline(deadline)
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		return nil, err
+	}
+
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if kind == websocket.BinaryMessage {
+			return data, nil
+		}
+	}
+}
+
+type remoteTranscription struct {
+	conn        *websocket.Conn
+	transcripts chan Transcript
+	done        chan struct{}
+	closeOnce   sync.Once
+	// gorilla allows a single concurrent writer per connection
+	mu sync.Mutex
+}
+
+func (st *remoteTranscription) read() {
+	defer close(st.transcripts)
+
+	for {
+		kind, data, err := st.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		if kind != websocket.TextMessage || len(data) == 0 {
+			continue
+		}
+
+		// the service only sends final sentences, as JSON like Transcript.
+		// Older versions sent the plain text.
+		var t Transcript
+		if err := json.Unmarshal(data, &t); err != nil || t.Text == "" {
+			t = Transcript{Text: string(data)}
+		}
+
+		select {
+		case st.transcripts <- t:
+		case <-st.done:
+			return
+		}
+	}
+}
+
+func (st *remoteTranscription) Send(chunk []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.conn.SetWriteDeadline(time.Now().Add(AUDIO_WRITE_TIMEOUT))
+	return st.conn.WriteMessage(websocket.BinaryMessage, chunk)
+}
+
+func (st *remoteTranscription) Transcripts() <-chan Transcript {
+	return st.transcripts
+}
+
+func (st *remoteTranscription) Close() error {
+	st.closeOnce.Do(func() { close(st.done) })
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	st.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return st.conn.Close()
+}
+
+// FakeSpeechProvider needs no models and always gives the same output for
+// the same input, for running interview flows offline. Transcription reads
+// every audio chunk as UTF-8 text and synthesis returns silence lasting
+// FAKE_SPEECH_MS_PER_CHAR per character.
+type FakeSpeechProvider struct{}
+
+const (
+	FAKE_SPEECH_SAMPLE_RATE = 16000
+	FAKE_SPEECH_MS_PER_CHAR = 50
+)
+
+func NewFakeSpeechProvider() *FakeSpeechProvider {
+	return &FakeSpeechProvider{}
+}
+
+func (p *FakeSpeechProvider) Transcribe(ctx context.Context, lang Language) (TranscriptionStream, error) {
+	return &fakeTranscription{
+		transcripts: make(chan Transcript, SPEECH_TRANSCRIPT_BUFFER),
+	}, nil
+}
+
+func (p *FakeSpeechProvider) Synthesize(ctx context.Context, lang Language, text string) ([]byte, error) {
+	samples := len([]rune(text)) * FAKE_SPEECH_SAMPLE_RATE * FAKE_SPEECH_MS_PER_CHAR / 1000
+	return wavSilence(samples), nil
+}
+
+type fakeTranscription struct {
+	mu          sync.Mutex
+	closed      bool
+	transcripts chan Transcript
+}
+
+func (st *fakeTranscription) Send(chunk []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return errSpeechStreamClosed
+	}
+
+	text := strings.TrimSpace(string(chunk))
+	if text == "" {
+		return nil
+	}
+
+	confidence := float32(1)
+	select {
+	case st.transcripts <- Transcript{Text: text, Confidence: &confidence}:
+		return nil
+	default:
+		return fmt.Errorf("fake transcription buffer full")
+	}
+}
+
+func (st *fakeTranscription) Transcripts() <-chan Transcript {
+	return st.transcripts
+}
+
+func (st *fakeTranscription) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !st.closed {
+		st.closed = true
+		close(st.transcripts)
+	}
+	return nil
+}
+
+// wavSilence builds a 16 bit mono PCM WAV file with the given sample count
+func wavSilence(samples int) []byte {
+	dataSize := uint32(samples * 2)
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, 36+dataSize)
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1)) // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(FAKE_SPEECH_SAMPLE_RATE))
+	binary.Write(&buf, binary.LittleEndian, uint32(FAKE_SPEECH_SAMPLE_RATE*2))
+	binary.Write(&buf, binary.LittleEndian, uint16(2))
+	binary.Write(&buf, binary.LittleEndian, uint16(16))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, dataSize)
+	buf.Write(make([]byte, dataSize))
+
+	return buf.Bytes()
+}
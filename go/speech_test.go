@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestRemoteTranscription runs against a stand-in for the /ws/stt endpoint of
+// main.py, which answers every chunk with the message given in the chunk
+func TestRemoteTranscription(t *testing.T) {
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws/stt" || r.URL.Query().Get("lang") != "es" {
+			http.NotFound(w, r)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, data)
+		}
+	}))
+	defer server.Close()
+
+	p := NewRemoteSpeechProvider("ws" + strings.TrimPrefix(server.URL, "http"))
+	st, err := p.Transcribe(context.Background(), "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	confidence := float32(0.75)
+	tests := []struct {
+		message string
+		want    Transcript
+	}{
+		{`{"text": "me duele la cabeza", "confidence": 0.75}`, Transcript{Text: "me duele la cabeza", Confidence: &confidence}},
+		{`{"text": "fiebre", "confidence": null}`, Transcript{Text: "fiebre"}},
+		// older versions of the service sent the bare text
+		{"tos seca", Transcript{Text: "tos seca"}},
+	}
+
+	for _, tt := range tests {
+		if err := st.Send([]byte(tt.message)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-st.Transcripts():
+			if got.Text != tt.want.Text || (got.Confidence == nil) != (tt.want.Confidence == nil) ||
+				(got.Confidence != nil && *got.Confidence != *tt.want.Confidence) {
+				t.Errorf("%s: transcript = %+v, want %+v", tt.message, got, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no transcript", tt.message)
+		}
+	}
+}
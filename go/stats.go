@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type StatsBucketSize string
+
+const (
+	StatsHour StatsBucketSize = "hour"
+	StatsDay  StatsBucketSize = "day"
+	StatsWeek StatsBucketSize = "week"
+)
+
+const (
+	STATS_DEFAULT_RANGE = 7 * 24 * time.Hour
+	// a month of hours
+	STATS_MAX_BUCKETS = 744
+	// called patients that did not show up within this time count as no-shows
+	STATS_NO_SHOW_AFTER = time.Hour
+)
+
+func (b StatsBucketSize) duration() time.Duration {
+	switch b {
+	case StatsHour:
+		return time.Hour
+	case StatsDay:
+		return 24 * time.Hour
+	case StatsWeek:
+		return 7 * 24 * time.Hour
+	}
+
+	return 0
+}
+
+// Age bands of the patient on the day of the report
+const (
+	AgeChild   = "0-11"
+	AgeTeen    = "12-17"
+	AgeAdult   = "18-39"
+	AgeMiddle  = "40-59"
+	AgeSenior  = "60+"
+	AgeUnknown = "unknown"
+)
+
+// StatsCounts aggregates the reports issued in a period. Waits are the door
+// to doctor time, from the report to the consultation, null without any
+// consultation.
+type StatsCounts struct {
+	Reports           int             `json:"reports"`
+	ByUrgency         map[Urgency]int `json:"byUrgency"`
+	Consultations     int             `json:"consultations"`
+	NoShows           int             `json:"noShows"`
+	MedianWaitSeconds *float64        `json:"medianWaitSeconds"`
+	P90WaitSeconds    *float64        `json:"p90WaitSeconds"`
+}
+
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	StatsCounts
+}
+
+type DoctorStats struct {
+	DoctorId          int      `json:"doctorId"`
+	DoctorName        string   `json:"doctorName"`
+	Consultations     int      `json:"consultations"`
+	MedianWaitSeconds *float64 `json:"medianWaitSeconds"`
+	P90WaitSeconds    *float64 `json:"p90WaitSeconds"`
+}
+
+type Stats struct {
+	From   time.Time       `json:"from"`
+	To     time.Time       `json:"to"`
+	Bucket StatsBucketSize `json:"bucket"`
+	Totals StatsCounts     `json:"totals"`
+	BySex  map[Sex]int     `json:"bySex"`
+	// keys are the age bands, e.g. 18-39
+	ByAgeBand map[string]int `json:"byAgeBand"`
+	// every bucket of the range, empty ones included
+	Buckets  []StatsBucket `json:"buckets"`
+	ByDoctor []DoctorStats `json:"byDoctor"`
+	// red flag alerts raised in the range and the ones still unacknowledged
+	RedFlagAlerts        int `json:"redFlagAlerts"`
+	PendingRedFlagAlerts int `json:"pendingRedFlagAlerts"`
+}
+
+type StatsRequest struct {
+	From   time.Time
+	To     time.Time
+	Bucket StatsBucketSize
+}
+
+// parseQueryTime reads a date, as midnight in local time, or an RFC 3339 time
+func parseQueryTime(v string) (time.Time, bool) {
+	if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.Local(), true
+	}
+
+	return time.Time{}, false
+}
+
+// parseStatsRequest reads from and to as dates or RFC 3339 times, the week up
+// to now by default
+func parseStatsRequest(r *http.Request) (StatsRequest, map[string][]string) {
+	query := r.URL.Query()
+	errs := make(map[string][]string)
+
+	req := StatsRequest{
+		To:     time.Now(),
+		Bucket: StatsBucketSize(query.Get("bucket")),
+	}
+
+	if req.Bucket == "" {
+		req.Bucket = StatsDay
+	}
+	if req.Bucket.duration() == 0 {
+		errs["bucket"] = append(errs["bucket"], fmt.Sprintf("bucket must be %s, %s or %s", StatsHour, StatsDay, StatsWeek))
+	}
+
+	parse := func(key string) (time.Time, bool) {
+		v := query.Get(key)
+		if v == "" {
+			return time.Time{}, false
+		}
+
+		t, ok := parseQueryTime(v)
+		if !ok {
+			errs[key] = append(errs[key], key+" must be a date (2006-01-02) or an RFC 3339 time")
+		}
+		return t, ok
+	}
+
+	if t, ok := parse("to"); ok {
+		req.To = t
+	}
+	req.From = req.To.Add(-STATS_DEFAULT_RANGE)
+	if t, ok := parse("from"); ok {
+		req.From = t
+	}
+
+	if len(errs) > 0 {
+		return req, errs
+	}
+
+	if !req.From.Before(req.To) {
+		errs["from"] = append(errs["from"], "from must be before to")
+	} else if req.To.Sub(req.From)/req.Bucket.duration() > STATS_MAX_BUCKETS {
+		errs["bucket"] = append(errs["bucket"], fmt.Sprintf("range spans more than %d buckets, use a larger bucket", STATS_MAX_BUCKETS))
+	}
+
+	return req, errs
+}
+
+// statsVisits are the reports of the range, $1 and $2, in the facilities of
+// $5 and $6. Test reports never count.
+const statsVisits = `WITH visits AS (
+	SELECT date_trunc($3, r.issued_at) AS bucket, r.urgency,
+	c.report_id IS NOT NULL AS consulted,
+	r.called_at IS NOT NULL AND c.report_id IS NULL AND r.called_at < $4 AS no_show,
+	EXTRACT(EPOCH FROM c.consultation_date - r.issued_at)::FLOAT8 AS wait
+	FROM report r LEFT JOIN consultation c ON r.report_id = c.report_id
+	WHERE r.issued_at >= $1 AND r.issued_at < $2 AND NOT r.test AND ($5 OR r.facility_id = ANY($6))
+)
+`
+
+const statsCountColumns = `COUNT(v.bucket),
+	COUNT(*) FILTER (WHERE v.urgency = 'undefined'), COUNT(*) FILTER (WHERE v.urgency = 'green'),
+	COUNT(*) FILTER (WHERE v.urgency = 'yellow'), COUNT(*) FILTER (WHERE v.urgency = 'red'),
+	COUNT(*) FILTER (WHERE v.consulted), COUNT(*) FILTER (WHERE v.no_show),
+	percentile_cont(0.5) WITHIN GROUP (ORDER BY v.wait),
+	percentile_cont(0.9) WITHIN GROUP (ORDER BY v.wait)`
+
+// scanStatsCounts reads statsCountColumns, after the columns of before
+func scanStatsCounts(row pgx.Row, c *StatsCounts, before ...any) error {
+	var undefined, green, yellow, red int
+	dest := append(before, &c.Reports, &undefined, &green, &yellow, &red,
+		&c.Consultations, &c.NoShows, &c.MedianWaitSeconds, &c.P90WaitSeconds)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	c.ByUrgency = map[Urgency]int{Undefined: undefined, Green: green, Yellow: yellow, Red: red}
+	return nil
+}
+
+func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermViewStats); err != nil {
+		return err
+	}
+
+	req, errs := parseStatsRequest(r)
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	stats := Stats{
+		From:      req.From,
+		To:        req.To,
+		Bucket:    req.Bucket,
+		BySex:     map[Sex]int{},
+		ByAgeBand: map[string]int{},
+		Buckets:   make([]StatsBucket, 0),
+		ByDoctor:  make([]DoctorStats, 0),
+	}
+
+	ctx := context.Background()
+	args := []any{req.From, req.To, string(req.Bucket), time.Now().Add(-STATS_NO_SHOW_AFTER), scope.all, scope.ids}
+
+	q := statsVisits + `SELECT b.bucket, ` + statsCountColumns + `
+	FROM generate_series(date_trunc($3, $1::TIMESTAMP), $2::TIMESTAMP - INTERVAL '1 microsecond',
+	('1 ' || $3)::INTERVAL) AS b(bucket)
+	LEFT JOIN visits v ON v.bucket = b.bucket
+	GROUP BY b.bucket ORDER BY b.bucket`
+
+	rows, err := s.db.Query(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b StatsBucket
+		if err := scanStatsCounts(rows, &b.StatsCounts, &b.Start); err != nil {
+			return err
+		}
+		stats.Buckets = append(stats.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	q = statsVisits + `SELECT ` + statsCountColumns + ` FROM visits v`
+	if err := scanStatsCounts(s.db.QueryRow(ctx, q, args...), &stats.Totals); err != nil {
+		return err
+	}
+
+	// one row per sex and one per age band
+	q = `SELECT GROUPING(d.sex) = 0, d.sex, d.band, COUNT(*) FROM (
+		SELECT p.sex, CASE
+			WHEN p.date_of_birth IS NULL THEN '` + AgeUnknown + `'
+			WHEN date_part('year', age(r.issued_at, p.date_of_birth)) < 12 THEN '` + AgeChild + `'
+			WHEN date_part('year', age(r.issued_at, p.date_of_birth)) < 18 THEN '` + AgeTeen + `'
+			WHEN date_part('year', age(r.issued_at, p.date_of_birth)) < 40 THEN '` + AgeAdult + `'
+			WHEN date_part('year', age(r.issued_at, p.date_of_birth)) < 60 THEN '` + AgeMiddle + `'
+			ELSE '` + AgeSenior + `' END AS band
+		FROM report r JOIN patient p ON r.patient_id = p.patient_id
+		WHERE r.issued_at >= $1 AND r.issued_at < $2 AND NOT r.test AND ($3 OR r.facility_id = ANY($4))
+	) d GROUP BY GROUPING SETS ((d.sex), (d.band))`
+
+	rows, err = s.db.Query(ctx, q, req.From, req.To, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bySex bool
+		var sex *Sex
+		var band *string
+		var count int
+		if err := rows.Scan(&bySex, &sex, &band, &count); err != nil {
+			return err
+		}
+
+		if bySex && sex != nil {
+			stats.BySex[*sex] = count
+		} else if band != nil {
+			stats.ByAgeBand[*band] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	q = `SELECT c.doctor_id, COALESCE(e.display_name, e.name), COUNT(*),
+	percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM c.consultation_date - r.issued_at)::FLOAT8),
+	percentile_cont(0.9) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM c.consultation_date - r.issued_at)::FLOAT8)
+	FROM consultation c JOIN report r ON r.report_id = c.report_id
+	JOIN employee e ON e.employee_id = c.doctor_id
+	WHERE r.issued_at >= $1 AND r.issued_at < $2 AND NOT r.test AND ($3 OR r.facility_id = ANY($4))
+	GROUP BY c.doctor_id, e.display_name, e.name
+	ORDER BY COUNT(*) DESC, c.doctor_id`
+
+	rows, err = s.db.Query(ctx, q, req.From, req.To, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d DoctorStats
+		err := rows.Scan(&d.DoctorId, &d.DoctorName, &d.Consultations, &d.MedianWaitSeconds, &d.P90WaitSeconds)
+		if err != nil {
+			return err
+		}
+		stats.ByDoctor = append(stats.ByDoctor, d)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	q = `SELECT COUNT(*), COUNT(*) FILTER (WHERE a.acknowledged_at IS NULL)
+	FROM red_flag_alert a
+	WHERE a.created_at >= $1 AND a.created_at < $2 AND ($3 OR a.facility_id = ANY($4))`
+
+	err = s.db.QueryRow(ctx, q, req.From, req.To, scope.all, scope.ids).
+		Scan(&stats.RedFlagAlerts, &stats.PendingRedFlagAlerts)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SURVEILLANCE_DEFAULT_INTERVAL         = time.Hour
+	SURVEILLANCE_DEFAULT_BASELINE_PERIODS = 7
+)
+
+var syndromeCode = regexp.MustCompile(`^[a-z0-9_]{2,50}$`)
+
+// Syndromes are the symptoms and conditions counted for surveillance, e.g.
+// dengue or influenza-like illness. Terms are matched like red flag terms and
+// a report counts once per syndrome however many terms it matches. Only the
+// report, facility and time of a match are stored, so counts can be taken in
+// SQL without unsealing the reports.
+type Syndrome struct {
+	Id int `json:"id"`
+	// stable name used in exports, e.g. dengue
+	Code  string                `json:"code"`
+	Name  string                `json:"name"`
+	Terms map[Language][]string `json:"terms"`
+	// fields scanned, all of them when empty
+	Fields []RedFlagField `json:"fields"`
+	// an alert is raised when a bucket has at least MinCases cases and
+	// Threshold times the baseline
+	MinCases  int       `json:"minCases"`
+	Threshold float64   `json:"threshold"`
+	Active    bool      `json:"active"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// cases are counted from then on, when the syndrome was created, its
+	// terms changed or it was reactivated. Alerts wait for BaselinePeriods
+	// buckets after it, before that the baseline would be made of buckets
+	// nobody counted.
+	CountedSince time.Time `json:"countedSince"`
+}
+
+type SyndromeRequest struct {
+	Code      string                `json:"code"`
+	Name      string                `json:"name"`
+	Terms     map[Language][]string `json:"terms"`
+	Fields    []RedFlagField        `json:"fields"`
+	MinCases  int                   `json:"minCases"`
+	Threshold float64               `json:"threshold"`
+	Active    bool                  `json:"active"`
+}
+
+func (r SyndromeRequest) validate() map[string][]string {
+	// the terms follow the red flag rules, urgency aside
+	errs := RedFlagRuleRequest{Name: r.Name, Terms: r.Terms, Fields: r.Fields, Urgency: Green}.validate()
+
+	if !syndromeCode.MatchString(r.Code) {
+		errs["code"] = append(errs["code"], "code must have 2 to 50 lower case letters, digits or underscores")
+	}
+
+	if r.MinCases < 1 {
+		errs["minCases"] = append(errs["minCases"], "minCases must be at least 1")
+	}
+
+	if r.Threshold < 1 {
+		errs["threshold"] = append(errs["threshold"], "threshold must be at least 1")
+	}
+
+	return errs
+}
+
+// SurveillancePoint is the count of a syndrome in one bucket and facility
+// against the mean of the buckets before it
+type SurveillancePoint struct {
+	Start      time.Time `json:"start"`
+	FacilityId int       `json:"facilityId"`
+	Facility   string    `json:"facility"`
+	SyndromeId int       `json:"syndromeId"`
+	Syndrome   string    `json:"syndrome"`
+	Cases      int       `json:"cases"`
+	Baseline   float64   `json:"baseline"`
+	Alert      bool      `json:"alert"`
+}
+
+type SurveillanceAlert struct {
+	Id         int             `json:"id"`
+	Start      time.Time       `json:"start"`
+	Bucket     StatsBucketSize `json:"bucket"`
+	FacilityId int             `json:"facilityId"`
+	Facility   string          `json:"facility"`
+	SyndromeId int             `json:"syndromeId"`
+	Syndrome   string          `json:"syndrome"`
+	Cases      int             `json:"cases"`
+	Baseline   float64         `json:"baseline"`
+	CreatedAt  time.Time       `json:"createdAt"`
+}
+
+type SurveillanceConfig struct {
+	// how often the current bucket is checked for alerts
+	Interval time.Duration
+	// buckets averaged into the baseline
+	BaselinePeriods int
+	AlertBucket     StatsBucketSize
+	// alerts are mailed here, they are only listed otherwise
+	AlertEmails []string
+}
+
+func (s *Server) initSurveillance() {
+	s.surveillance = SurveillanceConfig{
+		Interval:        envDuration("SURVEILLANCE_INTERVAL", SURVEILLANCE_DEFAULT_INTERVAL),
+		BaselinePeriods: SURVEILLANCE_DEFAULT_BASELINE_PERIODS,
+		AlertBucket:     StatsDay,
+	}
+
+	if n := envInt("SURVEILLANCE_BASELINE_PERIODS"); n > 0 {
+		s.surveillance.BaselinePeriods = n
+	}
+
+	if b := StatsBucketSize(os.Getenv("SURVEILLANCE_ALERT_BUCKET")); b != "" {
+		if b.duration() == 0 {
+			log.Fatalf("SURVEILLANCE_ALERT_BUCKET must be %s, %s or %s", StatsHour, StatsDay, StatsWeek)
+		}
+		s.surveillance.AlertBucket = b
+	}
+
+	s.surveillance.AlertEmails = envList("SURVEILLANCE_ALERT_EMAILS")
+
+	go s.runSurveillance()
+}
+
+// detectSyndromes returns the ids of the syndromes found in the report
+func detectSyndromes(syndromes []Syndrome, rep ReportBase) []int {
+	ids := make([]int, 0)
+	for _, sy := range syndromes {
+		rule := RedFlagRule{Id: sy.Id, Terms: sy.Terms, Fields: sy.Fields}
+		if len(detectRedFlags([]RedFlagRule{rule}, rep)) > 0 {
+			ids = append(ids, sy.Id)
+		}
+	}
+
+	return ids
+}
+
+// recordSyndromes stores the active syndromes found on a new report in its
+// transaction. Syndromes created or changed later do not apply to earlier
+// reports.
+func recordSyndromes(ctx context.Context, tx pgx.Tx, syndromes []Syndrome, reportId int, facilityId int, issuedAt time.Time, rep ReportBase) error {
+	ids := detectSyndromes(syndromes, rep)
+	if len(ids) == 0 {
+		return nil
+	}
+
+	q := `INSERT INTO surveillance_case(report_id, syndrome_id, facility_id, issued_at)
+	SELECT $1, unnest($2::INTEGER[]), $3, $4`
+	_, err := tx.Exec(ctx, q, reportId, ids, facilityId, issuedAt)
+	return err
+}
+
+// surveillanceSeries counts the cases of the active syndromes per bucket and
+// facility from from to to. The baseline is the mean of the BaselinePeriods
+// buckets before, so counting starts that many buckets early. Points without
+// cases nor baseline are left out.
+func (s *Server) surveillanceSeries(from time.Time, to time.Time, bucket StatsBucketSize, scope facilityScope) ([]SurveillancePoint, error) {
+	q := fmt.Sprintf(`WITH buckets AS (
+		SELECT generate_series(date_trunc($3, $1::TIMESTAMP) - %[1]d * ('1 ' || $3)::INTERVAL,
+		$2::TIMESTAMP - INTERVAL '1 microsecond', ('1 ' || $3)::INTERVAL) AS bucket
+	), counts AS (
+		SELECT date_trunc($3, sc.issued_at) AS bucket, sc.facility_id, sc.syndrome_id, COUNT(*) AS cases
+		FROM surveillance_case sc
+		WHERE sc.issued_at >= date_trunc($3, $1::TIMESTAMP) - %[1]d * ('1 ' || $3)::INTERVAL AND sc.issued_at < $2
+		AND ($4 OR sc.facility_id = ANY($5))
+		GROUP BY 1, 2, 3
+	), series AS (
+		SELECT b.bucket, f.facility_id, f.name AS facility, sy.syndrome_id, sy.code,
+		sy.min_cases, sy.threshold, sy.counted_since, COALESCE(c.cases, 0) AS cases,
+		COALESCE(AVG(COALESCE(c.cases, 0)) OVER (PARTITION BY f.facility_id, sy.syndrome_id
+			ORDER BY b.bucket ROWS BETWEEN %[1]d PRECEDING AND 1 PRECEDING), 0)::FLOAT8 AS baseline
+		FROM buckets b CROSS JOIN facility f CROSS JOIN surveillance_syndrome sy
+		LEFT JOIN counts c ON c.bucket = b.bucket AND c.facility_id = f.facility_id AND c.syndrome_id = sy.syndrome_id
+		WHERE sy.active AND ($4 OR f.facility_id = ANY($5))
+	)
+	SELECT bucket, facility_id, facility, syndrome_id, code, cases, baseline,
+	cases >= min_cases AND cases >= baseline * threshold
+	AND bucket - %[1]d * ('1 ' || $3)::INTERVAL >= counted_since
+	FROM series
+	WHERE bucket >= date_trunc($3, $1::TIMESTAMP) AND (cases > 0 OR baseline > 0)
+	ORDER BY bucket, facility_id, syndrome_id`, s.surveillance.BaselinePeriods)
+
+	rows, err := s.db.Query(context.Background(), q, from, to, string(bucket), scope.all, scope.ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]SurveillancePoint, 0)
+	for rows.Next() {
+		var p SurveillancePoint
+		err := rows.Scan(&p.Start, &p.FacilityId, &p.Facility, &p.SyndromeId, &p.Syndrome, &p.Cases, &p.Baseline, &p.Alert)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	return points, rows.Err()
+}
+
+func (s *Server) runSurveillance() {
+	for {
+		if err := s.checkOutbreaks(time.Now()); err != nil {
+			fmt.Println("surveillance error:", err)
+		}
+
+		time.Sleep(s.surveillance.Interval)
+	}
+}
+
+// checkOutbreaks raises the alerts of the current bucket, each syndrome and
+// facility alerts at most once per bucket
+func (s *Server) checkOutbreaks(now time.Time) error {
+	bucket := s.surveillance.AlertBucket
+	// the database keeps microseconds, a second makes sure now is in range
+	points, err := s.surveillanceSeries(now, now.Add(time.Second), bucket, facilityScope{all: true})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range points {
+		if !p.Alert {
+			continue
+		}
+
+		q := `INSERT INTO surveillance_alert(syndrome_id, facility_id, bucket, bucket_start, cases, baseline, created_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (syndrome_id, facility_id, bucket, bucket_start) DO NOTHING`
+
+		tag, err := s.db.Exec(context.Background(), q, p.SyndromeId, p.FacilityId, bucket, p.Start, p.Cases, p.Baseline, now)
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() > 0 {
+			fmt.Printf("surveillance: %s alert at %s, %d cases against a baseline of %.1f\n",
+				p.Syndrome, p.Facility, p.Cases, p.Baseline)
+			s.notifyOutbreak(p, bucket)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) notifyOutbreak(p SurveillancePoint, bucket StatsBucketSize) {
+	subject := fmt.Sprintf("Surveillance alert: %s at %s", p.Syndrome, p.Facility)
+	body := fmt.Sprintf(`%d cases of %s at %s in the %s starting %s.
+
+The mean of the %d %ss before was %.1f.
+`, p.Cases, p.Syndrome, p.Facility, bucket, p.Start.Format(time.DateTime),
+		s.surveillance.BaselinePeriods, bucket, p.Baseline)
+
+	for _, email := range s.surveillance.AlertEmails {
+		go s.notifyEmployee(email, subject, body)
+	}
+}
+
+func (s *Server) querySyndromes(where string) ([]Syndrome, error) {
+	q := `SELECT syndrome_id, code, name, terms, fields, min_cases, threshold, active, updated_at, counted_since
+	FROM surveillance_syndrome ` + where + ` ORDER BY syndrome_id`
+
+	rows, err := s.db.Query(context.Background(), q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	syndromes := make([]Syndrome, 0)
+	for rows.Next() {
+		var sy Syndrome
+		err := rows.Scan(&sy.Id, &sy.Code, &sy.Name, &sy.Terms, &sy.Fields, &sy.MinCases, &sy.Threshold,
+			&sy.Active, &sy.UpdatedAt, &sy.CountedSince)
+		if err != nil {
+			return nil, err
+		}
+		syndromes = append(syndromes, sy)
+	}
+
+	return syndromes, rows.Err()
+}
+
+func (s *Server) getSyndrome(id int) (Syndrome, error) {
+	q := `SELECT syndrome_id, code, name, terms, fields, min_cases, threshold, active, updated_at, counted_since
+	FROM surveillance_syndrome WHERE syndrome_id = $1`
+
+	var sy Syndrome
+	err := s.db.QueryRow(context.Background(), q, id).Scan(&sy.Id, &sy.Code, &sy.Name, &sy.Terms, &sy.Fields,
+		&sy.MinCases, &sy.Threshold, &sy.Active, &sy.UpdatedAt, &sy.CountedSince)
+
+	return sy, err
+}
+
+func (s *Server) handleGetSyndromes(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageSurveillance); err != nil {
+		return err
+	}
+
+	syndromes, err := s.querySyndromes("")
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, syndromes)
+}
+
+func (s *Server) handleCreateSyndrome(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageSurveillance); err != nil {
+		return err
+	}
+
+	var req SyndromeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if req.Fields == nil {
+		req.Fields = make([]RedFlagField, 0)
+	}
+
+	q := `INSERT INTO surveillance_syndrome(code, name, terms, fields, min_cases, threshold, active, updated_at, counted_since)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $8)
+	ON CONFLICT (code) DO NOTHING RETURNING syndrome_id`
+
+	var id int
+	err = s.db.QueryRow(context.Background(), q, req.Code, req.Name, req.Terms, req.Fields,
+		req.MinCases, req.Threshold, req.Active, time.Now()).Scan(&id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NewAPIError(http.StatusConflict, "syndrome with this code already exists")
+		}
+		return err
+	}
+
+	sy, err := s.getSyndrome(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, sy)
+}
+
+// handleUpdateSyndrome only affects reports created from now on, cases
+// already counted are kept. New terms or fields restart the wait for a
+// baseline, the buckets before were counted differently.
+func (s *Server) handleUpdateSyndrome(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageSurveillance); err != nil {
+		return err
+	}
+
+	id, err := getPathId("id", r)
+	if err != nil {
+		return BadRequest()
+	}
+
+	var req SyndromeRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return RequestBodyParsingError(err)
+	}
+
+	errs := req.validate()
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	if req.Fields == nil {
+		req.Fields = make([]RedFlagField, 0)
+	}
+
+	q := `SELECT 1 FROM surveillance_syndrome WHERE code = $1 AND syndrome_id <> $2`
+	err = s.db.QueryRow(context.Background(), q, req.Code, id).Scan(nil)
+	if err == nil {
+		return NewAPIError(http.StatusConflict, "syndrome with this code already exists")
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	q = `UPDATE surveillance_syndrome SET code = $1, name = $2, terms = $3, fields = $4, min_cases = $5,
+	threshold = $6, active = $7, updated_at = $8,
+	counted_since = CASE WHEN terms <> $3 OR fields <> $4 OR (NOT active AND $7) THEN $8 ELSE counted_since END
+	WHERE syndrome_id = $9`
+
+	tag, err := s.db.Exec(context.Background(), q, req.Code, req.Name, req.Terms, req.Fields,
+		req.MinCases, req.Threshold, req.Active, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return NewAPIError(http.StatusNotFound, "syndrome does not exist")
+	}
+
+	sy, err := s.getSyndrome(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, sy)
+}
+
+// surveillanceRequest reads the range and bucket like the statistics do
+func (s *Server) surveillanceRequest(r *http.Request) ([]SurveillancePoint, error) {
+	if err := s.requirePermission(r, PermManageSurveillance); err != nil {
+		return nil, err
+	}
+
+	req, errs := parseStatsRequest(r)
+	if len(errs) > 0 {
+		return nil, NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.surveillanceSeries(req.From, req.To, req.Bucket, scope)
+}
+
+func (s *Server) handleGetSurveillance(w http.ResponseWriter, r *http.Request) error {
+	points, err := s.surveillanceRequest(r)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, points)
+}
+
+// handleExportSurveillance is the series as CSV for the epidemiology team
+func (s *Server) handleExportSurveillance(w http.ResponseWriter, r *http.Request) error {
+	points, err := s.surveillanceRequest(r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="surveillance.csv"`)
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"start", "facility_id", "facility", "syndrome", "cases", "baseline", "alert"})
+	for _, p := range points {
+		out.Write([]string{
+			p.Start.Format(time.RFC3339),
+			strconv.Itoa(p.FacilityId),
+			p.Facility,
+			p.Syndrome,
+			strconv.Itoa(p.Cases),
+			strconv.FormatFloat(p.Baseline, 'f', 2, 64),
+			strconv.FormatBool(p.Alert),
+		})
+	}
+	out.Flush()
+
+	return out.Error()
+}
+
+func (s *Server) handleGetSurveillanceAlerts(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requirePermission(r, PermManageSurveillance); err != nil {
+		return err
+	}
+
+	req, errs := parseStatsRequest(r)
+	if len(errs) > 0 {
+		return NewAPIError(http.StatusUnprocessableEntity, errs)
+	}
+
+	scope, err := s.requestFacilities(r)
+	if err != nil {
+		return err
+	}
+
+	q := `SELECT a.alert_id, a.bucket_start, a.bucket, a.facility_id, f.name, a.syndrome_id, sy.code,
+	a.cases, a.baseline, a.created_at
+	FROM surveillance_alert a JOIN facility f ON f.facility_id = a.facility_id
+	JOIN surveillance_syndrome sy ON sy.syndrome_id = a.syndrome_id
+	WHERE a.created_at >= $1 AND a.created_at < $2 AND ($3 OR a.facility_id = ANY($4))
+	ORDER BY a.created_at DESC`
+
+	rows, err := s.db.Query(context.Background(), q, req.From, req.To, scope.all, scope.ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	alerts := make([]SurveillanceAlert, 0)
+	for rows.Next() {
+		var a SurveillanceAlert
+		err := rows.Scan(&a.Id, &a.Start, &a.Bucket, &a.FacilityId, &a.Facility, &a.SyndromeId, &a.Syndrome,
+			&a.Cases, &a.Baseline, &a.CreatedAt)
+		if err != nil {
+			return err
+		}
+		alerts = append(alerts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, alerts)
+}
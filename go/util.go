@@ -1,9 +1,39 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"strings"
 )
 
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// randomToken returns n random bytes hex encoded, for ids that must not be guessable
+func randomToken(n int) (string, error) {
+	b, err := randomBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored for bearer secrets like kiosk and password
+// reset tokens, they are random enough that a plain SHA-256 is fine
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func ContainsNumber(s string) bool {
 	return strings.ContainsAny(s, "0123456789")
 }
@@ -20,6 +50,55 @@ func ContainsSpecialCharacter(s string) bool {
 	return strings.ContainsAny(s, "!@#$%^*(),./;\\[]{}:|<>?")
 }
 
+// NormalizeCPF strips the usual formatting characters so that both
+// 123.456.789-09 and 12345678909 are stored the same way
+func NormalizeCPF(cpf string) string {
+	var b strings.Builder
+	for _, c := range strings.TrimSpace(cpf) {
+		if c == '.' || c == '-' || c == ' ' || c == '/' {
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// MaskCPF expects a normalized CPF and hides everything but the middle digits,
+// e.g. 12345678909 becomes ***.456.789-**
+func MaskCPF(cpf string) string {
+	if len(cpf) != 11 {
+		return "***.***.***-**"
+	}
+
+	return fmt.Sprintf("***.%s.%s-**", cpf[3:6], cpf[6:9])
+}
+
+// MaskIdentifier keeps only the last 3 characters of a document number
+func MaskIdentifier(id string) string {
+	if len(id) <= 3 {
+		return strings.Repeat("*", len(id))
+	}
+
+	return strings.Repeat("*", len(id)-3) + id[len(id)-3:]
+}
+
+// ValidateCPFLenient only checks the CPF shape, kiosks in lenient mode accept
+// typing errors in the verifier digits instead of blocking the patient
+func ValidateCPFLenient(cpf string) bool {
+	if len(cpf) != 11 {
+		return false
+	}
+
+	for i := 0; i < len(cpf); i++ {
+		if cpf[i] < '0' || cpf[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
 func ValidateCPF(cpf string) bool {
 	if len(cpf) != 11 {
 		return false
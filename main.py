@@ -1,8 +1,9 @@
 from fastapi import FastAPI, WebSocket, WebSocketDisconnect
 from tts import TextToSpeech
-from stt import SpeechToText
+from stt import SpeechToText, DEFAULT_LANGUAGE
 from typing import List
 import asyncio
+import json
 
 app = FastAPI()
 TTSEngine = TextToSpeech()
@@ -34,12 +35,13 @@ manager = ConnectionManager()
 
 @app.websocket("/ws/tts")
 async def websocket_tts(websocket: WebSocket):
+    lang = websocket.query_params.get("lang", DEFAULT_LANGUAGE)
     await manager.connect(websocket)
     try:
         while True:
             data = await websocket.receive_text()
             print(data)
-            audio_bytes = TTSEngine.synthesize_to_bytes(data)
+            audio_bytes = TTSEngine.synthesize_to_bytes(data, lang)
             await websocket.send_bytes(audio_bytes)
             await manager.send_message(f"You wrote: {data}", websocket)
     except WebSocketDisconnect:
@@ -47,22 +49,27 @@ async def websocket_tts(websocket: WebSocket):
 
 @app.websocket("/ws/stt")
 async def websocket_stt(websocket: WebSocket):
+    lang = websocket.query_params.get("lang", DEFAULT_LANGUAGE)
     await manager.connect(websocket)
-    recognizer = STTEngine.create_recognizer()
+    recognizer = STTEngine.create_recognizer(lang)
     if not recognizer:
         return
 
     sentence_parts = []
+    word_confidences = []
     timeout_task = None
     print("\STT Client conected. Waiting for message...")
 
     async def send_final_sentence():
-        nonlocal sentence_parts
+        nonlocal sentence_parts, word_confidences
         if sentence_parts:
             final_sentence = " ".join(sentence_parts)
-            print(f"STT Final sentence: '{final_sentence}'")
-            await manager.send_message(final_sentence, websocket)
+            # mean of the words, None when the model reported no word confidences
+            confidence = sum(word_confidences) / len(word_confidences) if word_confidences else None
+            print(f"STT Final sentence: '{final_sentence}' ({confidence})")
+            await manager.send_message(json.dumps({"text": final_sentence, "confidence": confidence}), websocket)
             sentence_parts = []
+            word_confidences = []
 
     try:
         while True:
@@ -71,12 +78,13 @@ async def websocket_stt(websocket: WebSocket):
 
             if recognizer.AcceptWaveform(audio_chunk):
                 result_json = recognizer.Result()
-                partial_text = STTEngine.process_final_result(result_json)
+                partial_text, confidences = STTEngine.process_final_result(result_json)
                 
                 print(f"\STT partial: '{partial_text}'")
                 
                 if partial_text:
                     sentence_parts.append(partial_text)
+                    word_confidences.extend(confidences)
 
                     if timeout_task:
                         timeout_task.cancel()
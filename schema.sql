@@ -2,16 +2,37 @@
 CREATE TABLE patient (
     patient_id    SERIAL PRIMARY KEY,
     name          VARCHAR(255) NOT NULL,
-    cpf           VARCHAR(11) NOT NULL,
+    -- sealed with the field encryption keys, looked up through cpf_hash
+    cpf           TEXT,
+    cpf_hash      CHAR(64),
+    -- for patients without a CPF: passport, rne, cns or birth_certificate
+    alt_id_type   VARCHAR(20),
+    alt_id        VARCHAR(40),
     date_of_birth DATE,
-    sex           CHAR(1) NOT NULL CHECK (sex IN ('M','F'))
+    sex           CHAR(1) NOT NULL CHECK (sex IN ('M','F')),
+    -- set when the patient's identifiers were scrubbed on an LGPD request
+    anonymized_at TIMESTAMP,
+    CHECK (cpf IS NOT NULL OR (alt_id_type IS NOT NULL AND alt_id IS NOT NULL) OR anonymized_at IS NOT NULL)
+);
+
+CREATE INDEX patient_cpf_hash_idx ON patient (cpf_hash);
+
+-- hospitals, clinics and emergency rooms of the network
+CREATE TABLE facility (
+    facility_id SERIAL PRIMARY KEY,
+    name        VARCHAR(100) NOT NULL,
+    created_at  TIMESTAMP NOT NULL
 );
 
 CREATE TYPE URGENCY AS ENUM ('undefined', 'green', 'yellow', 'red');
 
+-- short codes shown on the waiting room display instead of patient names
+CREATE SEQUENCE report_ticket_seq MINVALUE 1 MAXVALUE 999 CYCLE;
+
 CREATE TABLE report (
     report_id          SERIAL PRIMARY KEY,
     patient_id         INTEGER NOT NULL REFERENCES patient,
+    facility_id        INTEGER NOT NULL REFERENCES facility,
     weight             NUMERIC(5, 2),
     height             INTEGER,
     heart_rate         INTEGER,
@@ -19,19 +40,59 @@ CREATE TABLE report (
     diastolic_pressure INTEGER,
     temperature        NUMERIC(3, 1),
     oxygen_saturation  INTEGER,
-    interview          JSONB,
+    -- sealed JSON
+    interview          TEXT,
     occupation         VARCHAR(50),
     medications        TEXT[],
     allergies          TEXT[],
-    diseases           TEXT[],
+    -- sealed JSON array
+    diseases           TEXT,
     issued_at          TIMESTAMP NOT NULL,
-    urgency            URGENCY DEFAULT 'undefined'
+    urgency            URGENCY DEFAULT 'undefined',
+    ticket             VARCHAR(3) NOT NULL DEFAULT LPAD(nextval('report_ticket_seq')::TEXT, 3, '0'),
+    called_at          TIMESTAMP,
+    called_room        VARCHAR(20),
+    -- purged by the retention job when never consulted
+    test               BOOLEAN NOT NULL DEFAULT FALSE,
+    -- brought in by the CSV import, with ticket 000 and never shown on the
+    -- waiting room display
+    imported           BOOLEAN NOT NULL DEFAULT FALSE,
+    -- questionnaire_version the interview was answered on, NULL for
+    -- interviews sent by the kiosk
+    questionnaire_id      INTEGER,
+    questionnaire_version INTEGER,
+    -- language the patient answered in
+    language              VARCHAR(5) NOT NULL DEFAULT 'pt',
+    -- sealed JSON list of the red flag matches found on creation
+    red_flags             TEXT,
+    suggested_urgency     URGENCY NOT NULL DEFAULT 'undefined'
+);
+
+-- range scans of the retention job and the statistics
+CREATE INDEX report_issued_at_idx ON report (issued_at);
+
+-- reports moved out of report by the retention job, data is the gzipped
+-- report JSON sealed with the field encryption keys. The patient is only
+-- referenced by patient_id.
+CREATE TABLE report_archive (
+    report_id   INTEGER PRIMARY KEY,
+    patient_id  INTEGER NOT NULL REFERENCES patient,
+    issued_at   TIMESTAMP NOT NULL,
+    archived_at TIMESTAMP NOT NULL,
+    data        TEXT NOT NULL
 );
 
 CREATE TABLE employee_role (
     role_id        SERIAL PRIMARY KEY,
     name           VARCHAR(20) NOT NULL,
-    access_allowed BOOLEAN DEFAULT FALSE
+    access_allowed BOOLEAN DEFAULT FALSE,
+    -- e.g. view_identifiers, privacy_officer, manage_retention, manage_questionnaires,
+    -- manage_kiosks, access_recordings, manage_red_flags, manage_employees,
+    -- all_facilities, manage_facilities, view_stats, manage_surveillance,
+    -- import_data, export_reports
+    permissions    TEXT[] NOT NULL DEFAULT '{}',
+    -- employees of the role must enroll in TOTP before using the API
+    require_mfa    BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 CREATE TABLE employee (
@@ -39,8 +100,94 @@ CREATE TABLE employee (
     role_id        INTEGER REFERENCES employee_role DEFAULT 1,
     name           VARCHAR(255) NOT NULL,
     email          VARCHAR(255) NOT NULL,
-    cpf            VARCHAR(11) NOT NULL,
-    password_hash  VARCHAR(60) NOT NULL
+    -- the CPF and password are missing on employees provisioned through
+    -- single sign-on
+    cpf            TEXT,
+    cpf_hash       CHAR(64),
+    password_hash  VARCHAR(60),
+    -- sub claim of the identity provider
+    oidc_subject   VARCHAR(255) UNIQUE,
+    -- pending (self registered, awaiting approval), active, rejected or
+    -- deactivated (left, the row stays for their consultations)
+    status         VARCHAR(11) NOT NULL DEFAULT 'active',
+    deactivated_at TIMESTAMP,
+    -- shown to patients and on documents instead of the name when set
+    display_name   VARCHAR(100),
+    specialties    TEXT[] NOT NULL DEFAULT '{}',
+    -- council registration of clinical staff, CRM or COREN, digits only and
+    -- the state abbreviation
+    council        VARCHAR(5),
+    council_number VARCHAR(8),
+    council_state  CHAR(2),
+    -- set by someone with manage_employees who checked the registration with
+    -- the council, cleared when the employee changes it
+    council_verified_at TIMESTAMP,
+    council_verified_by INTEGER REFERENCES employee,
+    -- bumped on password or email changes, older tokens stop working
+    token_version  INTEGER NOT NULL DEFAULT 0,
+    -- sealed base32 TOTP secret, set on enrollment and only in use once
+    -- totp_enabled_at is set
+    totp_secret         TEXT,
+    totp_enabled_at     TIMESTAMP,
+    -- last accepted time step, codes can't be used twice
+    totp_last_step      BIGINT,
+    mfa_failed_attempts INTEGER NOT NULL DEFAULT 0,
+    mfa_locked_until    TIMESTAMP
+);
+
+CREATE INDEX employee_cpf_hash_idx ON employee (cpf_hash);
+CREATE UNIQUE INDEX employee_registration_idx ON employee (council, council_state, council_number);
+
+-- only the SHA-256 of the codes is stored
+CREATE TABLE mfa_recovery_code (
+    code_hash   CHAR(64) PRIMARY KEY,
+    employee_id INTEGER NOT NULL REFERENCES employee ON DELETE CASCADE,
+    used_at     TIMESTAMP
+);
+
+CREATE INDEX mfa_recovery_code_employee_idx ON mfa_recovery_code (employee_id);
+
+-- single use password reset tokens, only their SHA-256 is stored
+CREATE TABLE password_reset (
+    token_hash  CHAR(64) PRIMARY KEY,
+    employee_id INTEGER NOT NULL REFERENCES employee ON DELETE CASCADE,
+    created_at  TIMESTAMP NOT NULL,
+    expires_at  TIMESTAMP NOT NULL,
+    used_at     TIMESTAMP
+);
+
+CREATE INDEX password_reset_employee_idx ON password_reset (employee_id);
+
+-- single sign-on logins in progress, deleted by the callback
+CREATE TABLE oidc_login (
+    state_hash    CHAR(64) PRIMARY KEY,
+    -- sealed PKCE verifier
+    code_verifier TEXT NOT NULL,
+    nonce         VARCHAR(64) NOT NULL,
+    expires_at    TIMESTAMP NOT NULL
+);
+
+-- registration with a pre-assigned role, only the SHA-256 of the token is
+-- stored
+CREATE TABLE employee_invitation (
+    invitation_id SERIAL PRIMARY KEY,
+    token_hash    CHAR(64) NOT NULL UNIQUE,
+    email         VARCHAR(255) NOT NULL,
+    role_id       INTEGER NOT NULL REFERENCES employee_role,
+    invited_by    INTEGER REFERENCES employee ON DELETE SET NULL,
+    created_at    TIMESTAMP NOT NULL,
+    expires_at    TIMESTAMP NOT NULL,
+    accepted_at   TIMESTAMP,
+    employee_id   INTEGER REFERENCES employee ON DELETE SET NULL,
+    -- joined on registration
+    facility_ids  INTEGER[] NOT NULL DEFAULT '{}'
+);
+
+-- facilities an employee works at, roles with all_facilities see every one
+CREATE TABLE employee_facility (
+    employee_id INTEGER NOT NULL REFERENCES employee,
+    facility_id INTEGER NOT NULL REFERENCES facility,
+    PRIMARY KEY (employee_id, facility_id)
 );
 
 CREATE TABLE consultation (
@@ -48,3 +195,276 @@ CREATE TABLE consultation (
     doctor_id         INTEGER NOT NULL REFERENCES employee,
     consultation_date TIMESTAMP NOT NULL
 );
+
+CREATE TABLE questionnaire (
+    questionnaire_id SERIAL PRIMARY KEY,
+    name             VARCHAR(100) NOT NULL,
+    active           BOOLEAN NOT NULL DEFAULT FALSE,
+    current_version  INTEGER NOT NULL
+);
+
+-- rows are never updated, editing a questionnaire adds a new version
+CREATE TABLE questionnaire_version (
+    questionnaire_id INTEGER NOT NULL REFERENCES questionnaire,
+    version          INTEGER NOT NULL,
+    name             VARCHAR(100) NOT NULL,
+    -- questions, answer types and branching rules
+    definition       JSONB NOT NULL,
+    created_at       TIMESTAMP NOT NULL,
+    PRIMARY KEY (questionnaire_id, version)
+);
+
+CREATE TABLE interview_session (
+    session_id       VARCHAR(32) PRIMARY KEY,
+    questionnaire_id INTEGER NOT NULL REFERENCES questionnaire,
+    questionnaire_version INTEGER NOT NULL,
+    audio_consent    BOOLEAN NOT NULL DEFAULT FALSE,
+    language         VARCHAR(5) NOT NULL DEFAULT 'pt',
+    status           VARCHAR(20) NOT NULL CHECK (status IN ('in_progress', 'completed', 'submitted')),
+    -- NULL once the interview is over
+    current_question VARCHAR(50),
+    -- sealed JSON list of question and answers
+    answers          TEXT,
+    -- unlinked when the report is archived or purged
+    report_id        INTEGER REFERENCES report ON DELETE SET NULL,
+    -- passed on to the report
+    facility_id      INTEGER NOT NULL REFERENCES facility,
+    created_at       TIMESTAMP NOT NULL
+);
+
+-- per answer audio clips, only stored when the patient consented
+CREATE TABLE interview_recording (
+    recording_id SERIAL PRIMARY KEY,
+    session_id   VARCHAR(32) NOT NULL REFERENCES interview_session,
+    question_id  VARCHAR(50) NOT NULL,
+    -- set when the interview is submitted
+    report_id    INTEGER REFERENCES report ON DELETE CASCADE,
+    content_type VARCHAR(100) NOT NULL,
+    size         INTEGER NOT NULL,
+    -- sealed audio bytes and raw speech to text output
+    audio        TEXT NOT NULL,
+    transcript   TEXT,
+    confidence   REAL,
+    created_at   TIMESTAMP NOT NULL,
+    UNIQUE (session_id, question_id)
+);
+
+CREATE INDEX interview_recording_report_idx ON interview_recording (report_id);
+
+CREATE TABLE kiosk_device (
+    kiosk_id     SERIAL PRIMARY KEY,
+    name         VARCHAR(50) NOT NULL,
+    facility_id  INTEGER NOT NULL REFERENCES facility,
+    -- SHA-256 of the device token, the token itself is never stored
+    token_hash   CHAR(64) NOT NULL UNIQUE,
+    active       BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at   TIMESTAMP NOT NULL,
+    last_seen_at TIMESTAMP
+);
+
+-- terms scanned on new reports, terms is a JSON object of term lists by
+-- language and fields a JSON list, empty to scan every field
+CREATE TABLE red_flag_rule (
+    rule_id    SERIAL PRIMARY KEY,
+    name       VARCHAR(100) NOT NULL,
+    terms      JSONB NOT NULL,
+    fields     JSONB NOT NULL DEFAULT '[]',
+    urgency    URGENCY NOT NULL,
+    active     BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at TIMESTAMP NOT NULL
+);
+
+-- reports that raised red flags, until someone acknowledges them. Only the
+-- rule names are kept, the matches stay sealed on the report.
+CREATE TABLE red_flag_alert (
+    alert_id          SERIAL PRIMARY KEY,
+    report_id         INTEGER NOT NULL UNIQUE REFERENCES report ON DELETE CASCADE,
+    facility_id       INTEGER NOT NULL REFERENCES facility,
+    suggested_urgency URGENCY NOT NULL,
+    rules             TEXT[] NOT NULL,
+    created_at        TIMESTAMP NOT NULL,
+    acknowledged_at   TIMESTAMP,
+    acknowledged_by   INTEGER REFERENCES employee
+);
+
+CREATE INDEX red_flag_alert_created_at_idx ON red_flag_alert (created_at);
+
+-- symptoms and conditions counted for surveillance, terms and fields like
+-- red_flag_rule
+CREATE TABLE surveillance_syndrome (
+    syndrome_id SERIAL PRIMARY KEY,
+    code        VARCHAR(50) NOT NULL UNIQUE,
+    name        VARCHAR(100) NOT NULL,
+    terms       JSONB NOT NULL,
+    fields      JSONB NOT NULL DEFAULT '[]',
+    -- alerts need min_cases in a bucket and threshold times the baseline
+    min_cases   INTEGER NOT NULL,
+    threshold   DOUBLE PRECISION NOT NULL,
+    active      BOOLEAN NOT NULL DEFAULT TRUE,
+    updated_at  TIMESTAMP NOT NULL,
+    -- cases are counted from then on, alerts wait until the baseline buckets
+    -- all come after it
+    counted_since TIMESTAMP NOT NULL
+);
+
+-- a syndrome found on a report, nothing identifies the patient so the rows
+-- outlive archived reports
+CREATE TABLE surveillance_case (
+    report_id   INTEGER REFERENCES report ON DELETE SET NULL,
+    syndrome_id INTEGER NOT NULL REFERENCES surveillance_syndrome,
+    facility_id INTEGER NOT NULL REFERENCES facility,
+    issued_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX surveillance_case_issued_at_idx ON surveillance_case (issued_at);
+
+CREATE TABLE surveillance_alert (
+    alert_id     SERIAL PRIMARY KEY,
+    syndrome_id  INTEGER NOT NULL REFERENCES surveillance_syndrome,
+    facility_id  INTEGER NOT NULL REFERENCES facility,
+    -- hour, day or week
+    bucket       VARCHAR(4) NOT NULL,
+    bucket_start TIMESTAMP NOT NULL,
+    cases        INTEGER NOT NULL,
+    baseline     DOUBLE PRECISION NOT NULL,
+    created_at   TIMESTAMP NOT NULL,
+    UNIQUE (syndrome_id, facility_id, bucket, bucket_start)
+);
+
+CREATE TABLE audit_log (
+    audit_id    SERIAL PRIMARY KEY,
+    employee_id INTEGER REFERENCES employee,
+    action      VARCHAR(50) NOT NULL,
+    patient_id  INTEGER REFERENCES patient,
+    -- no foreign key, entries outlive archived and purged reports
+    report_id   INTEGER,
+    created_at  TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_log_patient_idx ON audit_log (patient_id);
+
+-- Upgrading a database created before field encryption: the server encrypts
+-- the existing plaintext values in the background once the columns are TEXT.
+--
+-- ALTER TABLE patient ALTER COLUMN cpf TYPE TEXT, ADD COLUMN cpf_hash CHAR(64);
+-- ALTER TABLE employee ALTER COLUMN cpf TYPE TEXT, ADD COLUMN cpf_hash CHAR(64);
+-- ALTER TABLE report ALTER COLUMN interview TYPE TEXT USING interview::TEXT;
+-- ALTER TABLE report ALTER COLUMN diseases TYPE TEXT USING array_to_json(diseases)::TEXT;
+--
+-- Upgrading a database created before questionnaire versioning:
+--
+-- CREATE TABLE questionnaire_version (...);
+-- INSERT INTO questionnaire_version
+--     SELECT questionnaire_id, 1, name, definition, updated_at FROM questionnaire;
+-- ALTER TABLE questionnaire ADD COLUMN current_version INTEGER NOT NULL DEFAULT 1;
+-- ALTER TABLE questionnaire DROP COLUMN definition, DROP COLUMN updated_at;
+-- ALTER TABLE interview_session ADD COLUMN questionnaire_version INTEGER NOT NULL DEFAULT 1;
+-- ALTER TABLE report ADD COLUMN questionnaire_id INTEGER, ADD COLUMN questionnaire_version INTEGER;
+--
+-- Upgrading a database created before answer recordings:
+--
+-- ALTER TABLE interview_session ADD COLUMN audio_consent BOOLEAN NOT NULL DEFAULT FALSE;
+--
+-- Upgrading a database created before multilingual interviews:
+--
+-- ALTER TABLE report ADD COLUMN language VARCHAR(5) NOT NULL DEFAULT 'pt';
+-- ALTER TABLE interview_session ADD COLUMN language VARCHAR(5) NOT NULL DEFAULT 'pt';
+--
+-- Upgrading a database created before red flag detection:
+--
+-- CREATE TABLE red_flag_rule (...);
+-- ALTER TABLE report ADD COLUMN red_flags TEXT,
+--     ADD COLUMN suggested_urgency URGENCY NOT NULL DEFAULT 'undefined';
+--
+-- Upgrading a database created before employee self-service:
+--
+-- ALTER TABLE employee ADD COLUMN token_version INTEGER NOT NULL DEFAULT 0;
+--
+-- Upgrading a database created before password resets:
+--
+-- CREATE TABLE password_reset (...);
+--
+-- Upgrading a database created before multi-factor authentication:
+--
+-- CREATE TABLE mfa_recovery_code (...);
+-- ALTER TABLE employee_role ADD COLUMN require_mfa BOOLEAN NOT NULL DEFAULT FALSE;
+-- ALTER TABLE employee ADD COLUMN totp_secret TEXT, ADD COLUMN totp_enabled_at TIMESTAMP,
+--     ADD COLUMN totp_last_step BIGINT, ADD COLUMN mfa_failed_attempts INTEGER NOT NULL DEFAULT 0,
+--     ADD COLUMN mfa_locked_until TIMESTAMP;
+--
+-- Upgrading a database created before registration approval:
+--
+-- CREATE TABLE employee_invitation (...);
+-- ALTER TABLE employee ADD COLUMN status VARCHAR(10) NOT NULL DEFAULT 'active';
+--
+-- Upgrading a database created before single sign-on:
+--
+-- CREATE TABLE oidc_login (...);
+-- ALTER TABLE employee ALTER COLUMN cpf DROP NOT NULL, ALTER COLUMN cpf_hash DROP NOT NULL,
+--     ALTER COLUMN password_hash DROP NOT NULL, ADD COLUMN oidc_subject VARCHAR(255) UNIQUE;
+--
+-- Upgrading a database created before employee deactivation:
+--
+-- ALTER TABLE employee ALTER COLUMN status TYPE VARCHAR(11), ADD COLUMN deactivated_at TIMESTAMP;
+--
+-- Upgrading a database created before professional registrations:
+--
+-- ALTER TABLE employee ADD COLUMN display_name VARCHAR(100),
+--     ADD COLUMN specialties TEXT[] NOT NULL DEFAULT '{}', ADD COLUMN council VARCHAR(5),
+--     ADD COLUMN council_number VARCHAR(8), ADD COLUMN council_state CHAR(2);
+-- CREATE UNIQUE INDEX employee_registration_idx ON employee (council, council_state, council_number);
+--
+-- Upgrading a database created before facilities, everything is assigned to
+-- a first facility:
+--
+-- CREATE TABLE facility (...);
+-- CREATE TABLE employee_facility (...);
+-- INSERT INTO facility(name, created_at) VALUES('Main', now());
+-- ALTER TABLE report ADD COLUMN facility_id INTEGER NOT NULL DEFAULT 1 REFERENCES facility;
+-- ALTER TABLE kiosk_device ADD COLUMN facility_id INTEGER NOT NULL DEFAULT 1 REFERENCES facility;
+-- ALTER TABLE interview_session ADD COLUMN facility_id INTEGER NOT NULL DEFAULT 1 REFERENCES facility;
+-- ALTER TABLE report ALTER COLUMN facility_id DROP DEFAULT;
+-- ALTER TABLE kiosk_device ALTER COLUMN facility_id DROP DEFAULT;
+-- ALTER TABLE interview_session ALTER COLUMN facility_id DROP DEFAULT;
+-- ALTER TABLE employee_invitation ADD COLUMN facility_ids INTEGER[] NOT NULL DEFAULT '{}';
+-- INSERT INTO employee_facility SELECT employee_id, 1 FROM employee;
+--
+-- Upgrading a database created before the statistics endpoint:
+--
+-- CREATE INDEX report_issued_at_idx ON report (issued_at);
+--
+-- Upgrading a database created before syndromic surveillance:
+--
+-- CREATE TABLE surveillance_syndrome (...);
+-- CREATE TABLE surveillance_case (...);
+-- CREATE INDEX surveillance_case_issued_at_idx ON surveillance_case (issued_at);
+-- CREATE TABLE surveillance_alert (...);
+--
+-- Upgrading a database where archiving or purging reports that came from an
+-- interview fails:
+--
+-- ALTER TABLE interview_session DROP CONSTRAINT interview_session_report_id_fkey,
+--     ADD CONSTRAINT interview_session_report_id_fkey FOREIGN KEY (report_id)
+--     REFERENCES report ON DELETE SET NULL;
+--
+-- Upgrading a database created before red flag alerts:
+--
+-- CREATE TABLE red_flag_alert (...);
+-- CREATE INDEX red_flag_alert_created_at_idx ON red_flag_alert (created_at);
+--
+-- Upgrading a database created before registrations were verified, existing
+-- ones have to be verified again before they are printed:
+--
+-- ALTER TABLE employee ADD COLUMN council_verified_at TIMESTAMP,
+--     ADD COLUMN council_verified_by INTEGER REFERENCES employee;
+--
+-- Upgrading a database where new syndromes alert before they have a baseline:
+--
+-- ALTER TABLE surveillance_syndrome ADD COLUMN counted_since TIMESTAMP;
+-- UPDATE surveillance_syndrome SET counted_since = updated_at;
+-- ALTER TABLE surveillance_syndrome ALTER COLUMN counted_since SET NOT NULL;
+--
+-- Upgrading a database where imported reports show up on the waiting room
+-- display:
+--
+-- ALTER TABLE report ADD COLUMN imported BOOLEAN NOT NULL DEFAULT FALSE;
@@ -1,22 +1,41 @@
 import json
 from vosk import Model, KaldiRecognizer
 
-STT_MODEL = "models/vosk-model-en-us-0.22"
+STT_MODELS = {
+    "pt": "models/vosk-model-small-pt-0.3",
+    "es": "models/vosk-model-small-es-0.42",
+    "en": "models/vosk-model-en-us-0.22",
+}
+DEFAULT_LANGUAGE = "pt"
+
 class SpeechToText:
     def __init__(self, sample_rate: float = 16000.0):
-        try:
-            self.model = Model(STT_MODEL)
-            self.sample_rate = sample_rate
-            print("Loaded Vosk model.")
-        except Exception as e:
-            print(f"ERROR loading Vosk model: {e}")
-            self.model = None
+        self.sample_rate = sample_rate
+        # models are loaded the first time their language is requested
+        self.models = {}
+
+    def model(self, lang: str) -> Model | None:
+        lang = lang if lang in STT_MODELS else DEFAULT_LANGUAGE
+        if lang not in self.models:
+            try:
+                self.models[lang] = Model(STT_MODELS[lang])
+                print(f"Loaded Vosk model for '{lang}'.")
+            except Exception as e:
+                print(f"ERROR loading Vosk model for '{lang}': {e}")
+                return None
+        return self.models[lang]
 
-    def create_recognizer(self) -> KaldiRecognizer | None:
-        if self.model:
-            return KaldiRecognizer(self.model, self.sample_rate)
+    def create_recognizer(self, lang: str = DEFAULT_LANGUAGE) -> KaldiRecognizer | None:
+        model = self.model(lang)
+        if model:
+            recognizer = KaldiRecognizer(model, self.sample_rate)
+            # word level results carry the confidence of every word
+            recognizer.SetWords(True)
+            return recognizer
         return None
 
-    def process_final_result(self, result_json: str) -> str:
+    def process_final_result(self, result_json: str) -> tuple[str, list[float]]:
+        """Returns the text and the confidence of each of its words."""
         result_dict = json.loads(result_json)
-        return result_dict.get("text", "")
\ No newline at end of file
+        confidences = [word["conf"] for word in result_dict.get("result", []) if "conf" in word]
+        return result_dict.get("text", ""), confidences
\ No newline at end of file
@@ -3,23 +3,34 @@ from piper.voice import PiperVoice
 import wave
 
 
-TTS_MODEL = "models/en_US-amy-medium.onnx"
+TTS_MODELS = {
+    "pt": "models/pt_BR-faber-medium.onnx",
+    "es": "models/es_MX-claude-high.onnx",
+    "en": "models/en_US-amy-medium.onnx",
+}
+DEFAULT_LANGUAGE = "pt"
 TTS_AUDIOFILE = "output.wav"
 
 class TextToSpeech:
     def __init__(self):
-        self.model_path = TTS_MODEL
-        self.voice = PiperVoice.load(self.model_path)
+        # voices are loaded the first time their language is requested
+        self.voices = {}
 
-    def synthesize_to_file(self, text):
+    def voice(self, lang):
+        lang = lang if lang in TTS_MODELS else DEFAULT_LANGUAGE
+        if lang not in self.voices:
+            self.voices[lang] = PiperVoice.load(TTS_MODELS[lang])
+        return self.voices[lang]
+
+    def synthesize_to_file(self, text, lang=DEFAULT_LANGUAGE):
         with wave.open(TTS_AUDIOFILE, "wb") as wav_file:
-            self.voice.synthesize_wav(text, wav_file)
+            self.voice(lang).synthesize_wav(text, wav_file)
         return TTS_AUDIOFILE
 
-    def synthesize_to_bytes(self, text):
+    def synthesize_to_bytes(self, text, lang=DEFAULT_LANGUAGE):
         buffer = io.BytesIO()
         with wave.open(buffer, "wb") as wav_file:
-            self.voice.synthesize_wav(text, wav_file)
+            self.voice(lang).synthesize_wav(text, wav_file)
         return buffer.getvalue()
 
 
@@ -28,5 +39,5 @@ if __name__ == "__main__":
 
     text = "Hello, this is a test with Piper TTS."
 
-    tts.synthesize_to_file(text)
-    varTest = tts.synthesize_to_bytes(text)
\ No newline at end of file
+    tts.synthesize_to_file(text, "en")
+    varTest = tts.synthesize_to_bytes(text, "en")
\ No newline at end of file